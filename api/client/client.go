@@ -2,7 +2,9 @@ package client
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/libopenstorage/openstorage/cluster"
 	"github.com/libopenstorage/openstorage/config"
+	"github.com/libopenstorage/openstorage/pkg/auth"
 	"github.com/libopenstorage/openstorage/volume"
 )
 
@@ -20,6 +23,56 @@ type Client struct {
 	base       *url.URL
 	version    string
 	httpClient *http.Client
+	tlsConfig  *tls.Config
+	token      string
+	hmacKey    []byte
+}
+
+// Option configures the connection of a client to a TCP listener.
+type Option func(*Client) error
+
+// WithTLS connects with TLS. The server certificate is verified with the CA
+// in caFile, or the system roots if caFile is empty. The client presents
+// the certificate in certFile and keyFile if they are set.
+func WithTLS(caFile string, certFile string, keyFile string) Option {
+	return func(c *Client) error {
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("Failed to read CA: %v", err)
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("No certificates in CA %v", caFile)
+			}
+		}
+		if certFile != "" || keyFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("Failed to load client certificate: %v", err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		c.tlsConfig = cfg
+		return nil
+	}
+}
+
+// WithToken authenticates requests with the bearer token.
+func WithToken(token string) Option {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+// WithHMAC authenticates requests with a signature computed with key.
+func WithHMAC(key string) Option {
+	return func(c *Client) error {
+		c.hmacKey = []byte(key)
+		return nil
+	}
 }
 
 var (
@@ -46,22 +99,37 @@ func (c *Client) Status() (*Status, error) {
 
 // Get returns a Request object setup for GET call.
 func (c *Client) Get() *Request {
-	return NewRequest(c.httpClient, c.base, "GET", c.version)
+	return c.newRequest("GET")
 }
 
 // Post returns a Request object setup for POST call.
 func (c *Client) Post() *Request {
-	return NewRequest(c.httpClient, c.base, "POST", c.version)
+	return c.newRequest("POST")
 }
 
 // Put returns a Request object setup for PUT call.
 func (c *Client) Put() *Request {
-	return NewRequest(c.httpClient, c.base, "PUT", c.version)
+	return c.newRequest("PUT")
 }
 
 // Put returns a Request object setup for DELETE call.
 func (c *Client) Delete() *Request {
-	return NewRequest(c.httpClient, c.base, "DELETE", c.version)
+	return c.newRequest("DELETE")
+}
+
+func (c *Client) newRequest(verb string) *Request {
+	r := NewRequest(c.httpClient, c.base, verb, c.version)
+	switch {
+	case len(c.hmacKey) != 0:
+		r.auth = func(req *http.Request, body []byte) {
+			auth.Sign(req, c.hmacKey, body)
+		}
+	case c.token != "":
+		r.auth = func(req *http.Request, body []byte) {
+			auth.SetToken(req, c.token)
+		}
+	}
+	return r
 }
 
 func unix2HTTP(u *url.URL) {
@@ -96,7 +164,7 @@ func newHTTPClient(u *url.URL, tlsConfig *tls.Config, timeout time.Duration) *ht
 }
 
 // NewClient returns a new REST client for specified server.
-func NewClient(host string, version string) (*Client, error) {
+func NewClient(host string, version string, opts ...Option) (*Client, error) {
 	baseURL, err := url.Parse(host)
 	if err != nil {
 		return nil, err
@@ -104,13 +172,25 @@ func NewClient(host string, version string) (*Client, error) {
 	if baseURL.Path == "" {
 		baseURL.Path = "/"
 	}
-	httpClient := getHttpClient(host)
-	unix2HTTP(baseURL)
 	c := &Client{
-		base:       baseURL,
-		version:    version,
-		httpClient: httpClient,
+		base:    baseURL,
+		version: version,
 	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.tlsConfig != nil {
+		if baseURL.Scheme == "http" {
+			baseURL.Scheme = "https"
+		}
+		// Connections with TLS are not shared with other clients.
+		c.httpClient = newHTTPClient(baseURL, c.tlsConfig, 10*time.Second)
+	} else {
+		c.httpClient = getHttpClient(host)
+	}
+	unix2HTTP(baseURL)
 	return c, nil
 }
 
@@ -136,10 +216,14 @@ func getHttpClient(host string) *http.Client {
 	return c
 }
 
+// DriverURL returns the URL of the unix socket of the specified driver.
+func DriverURL(driverName string) string {
+	return "unix://" + config.DriverAPIBase + driverName + ".sock"
+}
+
 // NewDriver returns a new REST client for specified driver.
 func NewDriverClient(driverName string) (*Client, error) {
-	sockPath := "unix://" + config.DriverAPIBase + driverName + ".sock"
-	return NewClient(sockPath, config.Version)
+	return NewClient(DriverURL(driverName), config.Version)
 }
 
 func init() {
@@ -1,7 +1,18 @@
 package client
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
 	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -11,6 +22,7 @@ import (
 	"github.com/libopenstorage/openstorage/volume"
 	"github.com/libopenstorage/openstorage/volume/drivers/nfs"
 	"github.com/libopenstorage/openstorage/volume/drivers/test"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -39,7 +51,7 @@ func TestAll(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to initialize Driver: %v", err)
 	}
-	server.StartServerAPI(nfs.Name, 9003, config.DriverAPIBase)
+	server.StartServerAPI(nfs.Name, 9003, config.DriverAPIBase, nil, nil)
 	time.Sleep(time.Second * 2)
 	c, err := NewDriverClient(nfs.Name)
 	if err != nil {
@@ -56,3 +68,180 @@ func TestConnections(t *testing.T) {
 		makeRequest(t)
 	}
 }
+
+func TestErrors(t *testing.T) {
+	c, err := NewDriverClient(nfs.Name)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	d := c.VolumeDriver()
+
+	resp := c.Delete().Resource(volumePath).Instance("nonexistent").Do()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+	assert.Equal(t, volume.ErrEnoEnt, d.Delete("nonexistent"))
+
+	id, err := d.Create(api.VolumeLocator{Name: "errors"}, nil,
+		&api.VolumeSpec{Size: 2 << 20, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	_, err = d.Create(api.VolumeLocator{Name: "errors"}, nil,
+		&api.VolumeSpec{Size: 2 << 20, Format: api.FsNone})
+	assert.Equal(t, volume.ErrExist, err, "Names must be unique")
+	assert.Equal(t, volume.ErrVolShrink, d.Set(id, nil, &api.VolumeSpec{Size: 1 << 20}))
+	assert.Equal(t, volume.ErrNotSnapshot, d.Restore(id, id))
+
+	_, err = d.Inspect([]api.VolumeID{"nonexistent"})
+	assert.NoError(t, err, "Inspect of missing volumes must succeed")
+	err = d.Mount(id, "")
+	assert.True(t, errors.Is(err, volume.ErrEinval), "Missing mount path must be invalid: %v", err)
+}
+
+// writeCert writes a certificate signed by parent, or self signed if parent
+// is nil, and its key to dir and returns the certificate and key.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	ioutil.WriteFile(path.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(path.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestTLSAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client_tls_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	file := func(name string) string { return path.Join(dir, name) }
+
+	if _, err := volume.Get(nfs.Name); err != nil {
+		os.MkdirAll(testPath, 0744)
+		if _, err = volume.New(nfs.Name, volume.DriverParams{"path": testPath}); err != nil {
+			t.Fatalf("Failed to initialize Driver: %v", err)
+		}
+	}
+	err = server.StartServerAPI(nfs.Name, 9004, dir, &config.Rest{
+		CertFile:     file("server.pem"),
+		KeyFile:      file("server-key.pem"),
+		ClientCAFile: file("ca.pem"),
+		Token:        "secret",
+	}, nil)
+	assert.NoError(t, err, "Failed to start server")
+
+	host := "https://localhost:9004"
+	c, err := NewClient(host, config.Version,
+		WithTLS(file("ca.pem"), file("client.pem"), file("client-key.pem")), WithToken("secret"))
+	assert.NoError(t, err, "Failed to create client")
+	_, err = c.VolumeDriver().Enumerate(api.VolumeLocator{}, nil)
+	assert.NoError(t, err, "Authenticated request must succeed")
+
+	c, err = NewClient(host, config.Version,
+		WithTLS(file("ca.pem"), file("client.pem"), file("client-key.pem")), WithToken("wrong"))
+	assert.NoError(t, err, "Failed to create client")
+	_, err = c.VolumeDriver().Enumerate(api.VolumeLocator{}, nil)
+	var resp *api.ErrorResponse
+	if assert.True(t, errors.As(err, &resp), "Wrong token must fail: %v", err) {
+		assert.Equal(t, api.ErrCodeUnauthorized, resp.Code)
+	}
+
+	c, err = NewClient(host, config.Version, WithTLS(file("ca.pem"), "", ""), WithToken("secret"))
+	assert.NoError(t, err, "Failed to create client")
+	_, err = c.VolumeDriver().Enumerate(api.VolumeLocator{}, nil)
+	assert.Error(t, err, "Clients without certificate must fail")
+}
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client_policy_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := volume.Get(nfs.Name); err != nil {
+		os.MkdirAll(testPath, 0744)
+		if _, err = volume.New(nfs.Name, volume.DriverParams{"path": testPath}); err != nil {
+			t.Fatalf("Failed to initialize Driver: %v", err)
+		}
+	}
+	err = server.StartServerAPI(nfs.Name, 9005, dir, &config.Rest{Token: "admin"}, &config.Policy{
+		Roles: map[string]config.Role{
+			"tenant": {
+				Verbs:  []string{server.VerbCreate, server.VerbDelete, server.VerbInspect},
+				Labels: map[string]string{"owner": config.UserLabel},
+			},
+		},
+		Users: map[string]config.User{
+			"alice": {Token: "alice", Roles: []string{"tenant"}},
+			"bob":   {Token: "bob", Roles: []string{"tenant"}},
+		},
+	})
+	assert.NoError(t, err, "Failed to start server")
+
+	driver := func(token string) volume.VolumeDriver {
+		c, err := NewClient("http://localhost:9005", config.Version, WithToken(token))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		return c.VolumeDriver()
+	}
+	alice, bob, admin := driver("alice"), driver("bob"), driver("admin")
+
+	id, err := alice.Create(api.VolumeLocator{Name: "alice"}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.NoError(t, err, "Failed in Create")
+	vols, err := admin.Inspect([]api.VolumeID{id})
+	if assert.NoError(t, err) && assert.Len(t, vols, 1) {
+		assert.Equal(t, "alice", vols[0].Locator.VolumeLabels["owner"], "Owner label must be set")
+	}
+
+	vols, err = bob.Inspect([]api.VolumeID{id})
+	assert.NoError(t, err, "Failed in Inspect")
+	assert.Empty(t, vols, "Inspect must hide volumes of other tenants")
+	assert.Equal(t, api.ErrCodeForbidden, volume.ErrorCode(bob.Delete(id)), "Other tenants must not delete")
+	vols, err = bob.Enumerate(api.VolumeLocator{}, nil)
+	assert.NoError(t, err, "Failed in Enumerate")
+	for _, v := range vols {
+		assert.NotEqual(t, id, v.ID, "Enumerate must hide volumes of other tenants")
+	}
+	_, err = bob.Create(api.VolumeLocator{
+		Name:         "bob",
+		VolumeLabels: api.Labels{"owner": "alice"},
+	}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.Equal(t, api.ErrCodeForbidden, volume.ErrorCode(err), "Tenants must not create volumes for others")
+	_, err = bob.Snapshot(id, true, api.VolumeLocator{})
+	assert.Equal(t, api.ErrCodeForbidden, volume.ErrorCode(err), "Roles must allow the verb")
+
+	assert.NoError(t, alice.Delete(id), "Owners must delete their volumes")
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"errors"
+
 	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/cluster"
 )
@@ -48,10 +50,71 @@ func (c *clusterClient) GetClusterNodeData() map[string]*api.Node {
 }
 
 func (c *clusterClient) Remove(nodes []api.Node) error {
+	var response api.ClusterResponse
+
+	req := c.c.Delete().Resource(clusterPath)
+	for _, n := range nodes {
+		req.QueryOption(string(api.OptNodeID), n.Id)
+	}
+	err := req.Do().Unmarshal(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
 	return nil
 }
 
 func (c *clusterClient) Shutdown(cluster bool, nodes []api.Node) error {
+	var response api.ClusterResponse
+
+	req := c.c.Put().Resource(clusterPath + "/shutdown")
+	if !cluster {
+		if len(nodes) == 0 {
+			return errors.New("No nodes specified for shutdown")
+		}
+		for _, n := range nodes {
+			req.QueryOption(string(api.OptNodeID), n.Id)
+		}
+	}
+	err := req.Do().Unmarshal(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+func (c *clusterClient) EnumerateAlerts(resourceType api.ResourceType, resourceID string) (api.Alerts, error) {
+	var alerts api.Alerts
+
+	req := c.c.Get().Resource(clusterPath + "/alerts")
+	if resourceType != "" {
+		req.QueryOption(string(api.OptResourceType), string(resourceType))
+	}
+	if resourceID != "" {
+		req.QueryOption(string(api.OptResourceID), resourceID)
+	}
+	err := req.Do().Unmarshal(&alerts)
+	if err != nil {
+		return api.Alerts{}, err
+	}
+	return alerts, nil
+}
+
+func (c *clusterClient) ClearAlert(alertID string) error {
+	var response api.ClusterResponse
+
+	err := c.c.Put().Resource(clusterPath + "/alerts").Instance(alertID).Do().Unmarshal(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
 	return nil
 }
 
@@ -11,6 +11,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
 )
 
 // Request is contructed iteratively by the client and finally dispatched.
@@ -31,6 +34,8 @@ type Request struct {
 	req      *http.Request
 	resp     *http.Response
 	timeout  time.Duration
+	// auth sets the credentials of the request with the body.
+	auth func(*http.Request, []byte)
 }
 
 // Response is a representation of HTTP response received from the server.
@@ -202,29 +207,16 @@ func headerVal(key string, resp *http.Response) (int, bool) {
 	return 0, false
 }
 
+// parseHTTPStatus returns the error of a failed request. Errors reported
+// in an ErrorResponse are returned as the errors of the volume package.
 func parseHTTPStatus(resp *http.Response, body []byte) error {
-
-	var (
-		status *Status
-		err    error
-	)
-
-	httpOK := resp.StatusCode >= http.StatusOK && resp.StatusCode <= http.StatusPartialContent
-	hasStatus := false
-	if body != nil {
-		err = json.Unmarshal(body, status)
-		if err == nil && status.Message != "" {
-			hasStatus = true
-		}
-	}
-	// If the status is NG, return an error regardless of HTTP status.
-	if hasStatus && status.ErrorCode != 0 {
-		return fmt.Errorf("Error %v : %v", status.ErrorCode, status.Message)
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode <= http.StatusPartialContent {
+		return nil
 	}
 
-	// Status is good and HTTP status is good, everything is good
-	if httpOK {
-		return nil
+	var status api.ErrorResponse
+	if err := json.Unmarshal(body, &status); err == nil && status.Code != "" {
+		return volume.ResponseError(&status)
 	}
 
 	// If HTTP status is NG, return an error.
@@ -258,6 +250,9 @@ func (r *Request) Do() *Response {
 
 	req.Header = r.headers
 	req.Header.Set("Content-Type", "application/json")
+	if r.auth != nil {
+		r.auth(req, r.body)
+	}
 	resp, err = r.client.Do(req)
 	if err != nil {
 		goto done
@@ -6,18 +6,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 
 	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/volume"
 )
 
 type volumeClient struct {
-	*volume.IoNotSupported
 	c *Client
 }
 
 func newVolumeClient(c *Client) volume.VolumeDriver {
-	return &volumeClient{IoNotSupported: &volume.IoNotSupported{}, c: c}
+	return &volumeClient{c: c}
 }
 
 // String description of this driver.
@@ -31,9 +31,10 @@ func (v *volumeClient) Type() api.DriverType {
 }
 
 const (
-	graphPath  = "/graph"
-	volumePath = "/volumes"
-	snapPath   = "/snapshot"
+	graphPath    = "/graph"
+	volumePath   = "/volumes"
+	snapPath     = "/snapshot"
+	capacityPath = "/capacity"
 )
 
 func (v *volumeClient) GraphDriverCreate(id, parent string) error {
@@ -210,6 +211,74 @@ func (v *volumeClient) Snapshot(volumeID api.VolumeID, readonly bool, locator ap
 	return response.ID, nil
 }
 
+// Restore specified volume to the contents of its snapshot snapID.
+// Errors ErrEnoEnt, ErrNotSnapshot, ErrVolMounted may be returned.
+func (v *volumeClient) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	var response api.VolumeResponse
+	restoreReq := api.SnapRestoreRequest{
+		ID:     volumeID,
+		SnapID: snapID,
+	}
+	err := v.c.Post().Resource(snapPath + "/restore").Body(&restoreReq).Do().Unmarshal(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// Read sz bytes from specified volume at specified offset.
+// Return number of bytes read and error.
+func (v *volumeClient) Read(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	var response api.VolumeIOResponse
+	if sz > uint64(len(buf)) {
+		return 0, volume.ErrEinval
+	}
+	err := v.c.Get().Resource(volumePath).Instance(string(volumeID)+"/io").
+		QueryOption(string(api.OptOffset), strconv.FormatInt(offset, 10)).
+		QueryOption(string(api.OptSize), strconv.FormatUint(sz, 10)).
+		Do().Unmarshal(&response)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(copy(buf, response.Data))
+	if response.Error != "" {
+		return n, errors.New(response.Error)
+	}
+	return n, nil
+}
+
+// Write sz bytes from specified volume at specified offset.
+// Return number of bytes written and error.
+func (v *volumeClient) Write(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	if sz > uint64(len(buf)) {
+		return 0, volume.ErrEinval
+	}
+	return v.volumeIO(volumeID, &api.VolumeIORequest{Offset: offset, Data: buf[:sz]})
+}
+
+// Flush writes to stable storage.
+// Return error.
+func (v *volumeClient) Flush(volumeID api.VolumeID) error {
+	_, err := v.volumeIO(volumeID, &api.VolumeIORequest{Flush: true})
+	return err
+}
+
+func (v *volumeClient) volumeIO(volumeID api.VolumeID, req *api.VolumeIORequest) (int64, error) {
+	var response api.VolumeIOResponse
+	err := v.c.Put().Resource(volumePath).Instance(string(volumeID) + "/io").
+		Body(req).Do().Unmarshal(&response)
+	if err != nil {
+		return 0, err
+	}
+	if response.Error != "" {
+		return response.Bytes, errors.New(response.Error)
+	}
+	return response.Bytes, nil
+}
+
 // Stats for specified volume.
 // Errors ErrEnoEnt may be returned
 func (v *volumeClient) Stats(volumeID api.VolumeID) (api.Stats, error) {
@@ -221,6 +290,17 @@ func (v *volumeClient) Stats(volumeID api.VolumeID) (api.Stats, error) {
 	return stats, nil
 }
 
+// Capacity of the storage pool backing the volumes of this driver.
+// Errors ErrNotSupported may be returned.
+func (v *volumeClient) Capacity() (api.Capacity, error) {
+	var capacity api.Capacity
+	err := v.c.Get().Resource(capacityPath).Do().Unmarshal(&capacity)
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	return capacity, nil
+}
+
 // Alerts on this volume.
 // Errors ErrEnoEnt may be returned
 func (v *volumeClient) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
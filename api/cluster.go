@@ -16,6 +16,15 @@ const (
 	StatusError
 )
 
+const (
+	// OptNodeID query parameter used to specify a node by ID.
+	OptNodeID = OptionKey("NodeID")
+	// OptResourceType query parameter used to filter alerts by resource type.
+	OptResourceType = OptionKey("ResourceType")
+	// OptResourceID query parameter used to filter alerts by resource.
+	OptResourceID = OptionKey("ResourceID")
+)
+
 type VolumeInfo struct {
 	Path     string
 	Storage  *VolumeSpec
@@ -66,6 +75,7 @@ type ClusterStateResponse struct {
 
 // VolumeResponse is embedded in all REST responses.
 type ClusterResponse struct {
-	// Error is "" on success or contains the error message on failure.
+	// Error is "" on success. Failed requests are answered with an
+	// ErrorResponse, older servers set Error to the error message.
 	Error string `json:"error"`
 }
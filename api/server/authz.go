@@ -0,0 +1,238 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/context"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/config"
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+// Verbs allowed by the roles of a policy.
+const (
+	// VerbAll allows all verbs.
+	VerbAll = "*"
+	// VerbCreate creates volumes.
+	VerbCreate = "create"
+	// VerbDelete deletes volumes.
+	VerbDelete = "delete"
+	// VerbSet updates the locator and spec of volumes.
+	VerbSet = "set"
+	// VerbMount attaches, mounts, unmounts and detaches volumes.
+	VerbMount = "mount"
+	// VerbSnap snapshots, clones and restores volumes.
+	VerbSnap = "snap"
+	// VerbInspect inspects and enumerates volumes and their stats, alerts
+	// and capacity.
+	VerbInspect = "inspect"
+	// VerbIO reads and writes volumes.
+	VerbIO = "io"
+	// VerbClusterInspect enumerates the nodes and alerts of the cluster.
+	VerbClusterInspect = "cluster-inspect"
+	// VerbClusterRemove removes nodes from the cluster.
+	VerbClusterRemove = "cluster-remove"
+	// VerbClusterShutdown shuts nodes down.
+	VerbClusterShutdown = "cluster-shutdown"
+	// VerbClusterAlerts clears the alerts of the cluster.
+	VerbClusterAlerts = "cluster-alerts"
+)
+
+type contextKey int
+
+// userKey is the context key of the user a request is authenticated as.
+const userKey contextKey = 0
+
+// setUser records that r is authenticated as user.
+func setUser(r *http.Request, user string) {
+	context.Set(r, userKey, user)
+}
+
+// requestUser returns the user r is authenticated as. Requests on unix
+// sockets and requests authenticated with the shared credentials are made
+// as the empty user, which the policy does not restrict.
+func requestUser(r *http.Request) string {
+	if user, ok := context.Get(r, userKey).(string); ok {
+		return user
+	}
+	return ""
+}
+
+// validatePolicy returns an error if p refers to roles or users it does
+// not define.
+func validatePolicy(p *config.Policy) error {
+	if p == nil {
+		return nil
+	}
+	for name, user := range p.Users {
+		if name == "" {
+			return fmt.Errorf("Policy users must be named")
+		}
+		for _, role := range user.Roles {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("Unknown role %v of user %v", role, name)
+			}
+		}
+	}
+	if _, ok := p.Users[p.DockerUser]; p.DockerUser != "" && !ok {
+		return fmt.Errorf("Unknown docker user %v", p.DockerUser)
+	}
+	return nil
+}
+
+// authorizer enforces a policy on the requests of a REST server. A nil
+// authorizer allows all requests.
+type authorizer struct {
+	policy *config.Policy
+	// user makes all requests if it is not empty.
+	user string
+}
+
+func newAuthorizer(policy *config.Policy, user string) *authorizer {
+	if policy == nil {
+		return nil
+	}
+	return &authorizer{policy: policy, user: user}
+}
+
+func forbidden(user string, verb string) error {
+	return &api.ErrorResponse{
+		Code:    api.ErrCodeForbidden,
+		Message: fmt.Sprintf("User %v is not allowed to %v", user, verb),
+	}
+}
+
+// requestUser returns the user r is made as.
+func (a *authorizer) requestUser(r *http.Request) string {
+	if a == nil {
+		return ""
+	}
+	if a.user != "" {
+		return a.user
+	}
+	return requestUser(r)
+}
+
+// grants returns the labels of the roles allowing user to verb, with
+// config.UserLabel replaced by user.
+func (a *authorizer) grants(user string, verb string) []api.Labels {
+	var grants []api.Labels
+	for _, name := range a.policy.Users[user].Roles {
+		role := a.policy.Roles[name]
+		for _, v := range role.Verbs {
+			if v != verb && v != VerbAll {
+				continue
+			}
+			labels := make(api.Labels)
+			for k, v := range role.Labels {
+				if v == config.UserLabel {
+					v = user
+				}
+				labels[k] = v
+			}
+			grants = append(grants, labels)
+			break
+		}
+	}
+	return grants
+}
+
+// allowed returns true if user may verb volumes with labels.
+func (a *authorizer) allowed(user string, verb string, labels api.Labels) bool {
+	if user == "" {
+		return true
+	}
+	for _, grant := range a.grants(user, verb) {
+		matches := true
+		for k, v := range grant {
+			if labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns an error unless the user of r may verb regardless of
+// volume labels.
+func (a *authorizer) authorize(r *http.Request, verb string) error {
+	user := a.requestUser(r)
+	if user == "" || len(a.grants(user, verb)) != 0 {
+		return nil
+	}
+	return forbidden(user, verb)
+}
+
+// authorizeLabels returns an error unless the user of r may verb volumes
+// with labels.
+func (a *authorizer) authorizeLabels(r *http.Request, verb string, labels api.Labels) error {
+	user := a.requestUser(r)
+	if a.allowed(user, verb, labels) {
+		return nil
+	}
+	return forbidden(user, verb)
+}
+
+// authorizeVolume returns an error unless the user of r may verb the
+// volume id of d. Unknown volumes are left to the driver to report.
+func (a *authorizer) authorizeVolume(r *http.Request, d volume.VolumeDriver, verb string, id api.VolumeID) error {
+	if a.requestUser(r) == "" {
+		return nil
+	}
+	vols, err := d.Inspect([]api.VolumeID{id})
+	if err != nil || len(vols) != 1 {
+		return nil
+	}
+	return a.authorizeLabels(r, verb, vols[0].Locator.VolumeLabels)
+}
+
+// authorizeCreate returns an error unless the user of r may verb to create
+// a volume with locator. The labels of the first role allowing it are
+// added to locator.
+func (a *authorizer) authorizeCreate(r *http.Request, verb string, locator *api.VolumeLocator) error {
+	user := a.requestUser(r)
+	if user == "" {
+		return nil
+	}
+	for _, grant := range a.grants(user, verb) {
+		conflicts := false
+		for k, v := range grant {
+			if l, ok := locator.VolumeLabels[k]; ok && l != v {
+				conflicts = true
+				break
+			}
+		}
+		if conflicts {
+			continue
+		}
+		if locator.VolumeLabels == nil && len(grant) != 0 {
+			locator.VolumeLabels = make(api.Labels)
+		}
+		for k, v := range grant {
+			locator.VolumeLabels[k] = v
+		}
+		return nil
+	}
+	return forbidden(user, verb)
+}
+
+// filter returns the volumes of vols the user of r may verb.
+func (a *authorizer) filter(r *http.Request, verb string, vols []api.Volume) []api.Volume {
+	user := a.requestUser(r)
+	if user == "" {
+		return vols
+	}
+	allowed := make([]api.Volume, 0, len(vols))
+	for _, v := range vols {
+		if a.allowed(user, verb, v.Locator.VolumeLabels) {
+			allowed = append(allowed, v)
+		}
+	}
+	return allowed
+}
@@ -2,9 +2,15 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
+	"github.com/gorilla/mux"
+
+	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/cluster"
+	"github.com/libopenstorage/openstorage/config"
+	"github.com/libopenstorage/openstorage/volume"
 )
 
 const (
@@ -15,8 +21,12 @@ type clusterApi struct {
 	restBase
 }
 
-func newClusterAPI(name string) restServer {
-	return &clusterApi{restBase{version: clusterApiVersion, name: name}}
+func newClusterAPI(name string, policy *config.Policy) restServer {
+	return &clusterApi{restBase{
+		version: clusterApiVersion,
+		name:    name,
+		authz:   newAuthorizer(policy, ""),
+	}}
 }
 
 func (c *clusterApi) String() string {
@@ -26,15 +36,20 @@ func (c *clusterApi) String() string {
 func (c *clusterApi) enumerate(w http.ResponseWriter, r *http.Request) {
 	method := "enumerate"
 
+	if err := c.authz.authorize(r, VerbClusterInspect); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
 	inst, err := cluster.Inst()
 	if err != nil {
-		c.sendError(c.name, method, w, err.Error(), http.StatusInternalServerError)
+		c.sendErrorResponse(method, "", w, err)
 		return
 	}
 
 	cluster, err := inst.Enumerate()
 	if err != nil {
-		c.sendError(c.name, method, w, err.Error(), http.StatusInternalServerError)
+		c.sendErrorResponse(method, "", w, err)
 		return
 	}
 
@@ -44,19 +59,137 @@ func (c *clusterApi) enumerate(w http.ResponseWriter, r *http.Request) {
 func (c *clusterApi) inspect(w http.ResponseWriter, r *http.Request) {
 	method := "inspect"
 
-	c.sendError(c.name, method, w, "Not implemented.", http.StatusNotImplemented)
+	if err := c.authz.authorize(r, VerbClusterInspect); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	c.sendErrorResponse(method, "", w, volume.ErrNotSupported)
+}
+
+// parseNodes returns the nodes specified in the path or the query parameters.
+func (c *clusterApi) parseNodes(r *http.Request) []api.Node {
+	nodes := make([]api.Node, 0)
+	if id, ok := mux.Vars(r)["id"]; ok {
+		nodes = append(nodes, api.Node{Id: id})
+	}
+	for _, id := range r.URL.Query()[string(api.OptNodeID)] {
+		nodes = append(nodes, api.Node{Id: id})
+	}
+	return nodes
 }
 
 func (c *clusterApi) delete(w http.ResponseWriter, r *http.Request) {
+	var resp api.ClusterResponse
 	method := "delete"
 
-	c.sendError(c.name, method, w, "Not implemented.", http.StatusNotImplemented)
+	if err := c.authz.authorize(r, VerbClusterRemove); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	nodes := c.parseNodes(r)
+	if len(nodes) == 0 {
+		c.sendErrorResponse(method, "", w, invalidArgument(errors.New("missing node ID")))
+		return
+	}
+
+	inst, err := cluster.Inst()
+	if err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	for _, n := range nodes {
+		c.logReq(method, n.Id).Info("")
+	}
+
+	if err = inst.Remove(nodes); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&resp)
 }
 
 func (c *clusterApi) shutdown(w http.ResponseWriter, r *http.Request) {
+	var resp api.ClusterResponse
 	method := "shutdown"
 
-	c.sendError(c.name, method, w, "Not implemented.", http.StatusNotImplemented)
+	if err := c.authz.authorize(r, VerbClusterShutdown); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	inst, err := cluster.Inst()
+	if err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	// Without any nodes specified, the entire cluster is shut down.
+	nodes := c.parseNodes(r)
+	c.logReq(method, "").Infof("nodes %v", nodes)
+
+	if err = inst.Shutdown(len(nodes) == 0, nodes); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+func (c *clusterApi) enumerateAlerts(w http.ResponseWriter, r *http.Request) {
+	method := "enumerateAlerts"
+
+	if err := c.authz.authorize(r, VerbClusterInspect); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	inst, err := cluster.Inst()
+	if err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	params := r.URL.Query()
+	resourceType := api.ResourceType(params.Get(string(api.OptResourceType)))
+	alerts, err := inst.EnumerateAlerts(resourceType, params.Get(string(api.OptResourceID)))
+	if err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func (c *clusterApi) clearAlert(w http.ResponseWriter, r *http.Request) {
+	var resp api.ClusterResponse
+	method := "clearAlert"
+
+	if err := c.authz.authorize(r, VerbClusterAlerts); err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	id, ok := mux.Vars(r)["id"]
+	if !ok || id == "" {
+		c.sendErrorResponse(method, "", w, invalidArgument(errors.New("missing alert ID")))
+		return
+	}
+
+	inst, err := cluster.Inst()
+	if err != nil {
+		c.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	c.logReq(method, id).Info("")
+
+	if err = inst.ClearAlert(id); err != nil {
+		c.sendErrorResponse(method, id, w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&resp)
 }
 
 func clusterVersion(route string) string {
@@ -73,7 +206,9 @@ func (c *clusterApi) Routes() []*Route {
 		&Route{verb: "GET", path: clusterPath("/inspect/{id}"), fn: c.inspect},
 		&Route{verb: "DELETE", path: clusterPath(""), fn: c.delete},
 		&Route{verb: "DELETE", path: clusterPath("/{id}"), fn: c.delete},
-		&Route{verb: "PUT", path: snapPath("shutdown"), fn: c.shutdown},
-		&Route{verb: "PUT", path: snapPath("shutdown/{id}"), fn: c.shutdown},
+		&Route{verb: "PUT", path: clusterPath("/shutdown"), fn: c.shutdown},
+		&Route{verb: "PUT", path: clusterPath("/shutdown/{id}"), fn: c.shutdown},
+		&Route{verb: "GET", path: clusterPath("/alerts"), fn: c.enumerateAlerts},
+		&Route{verb: "PUT", path: clusterPath("/alerts/{id}"), fn: c.clearAlert},
 	}
 }
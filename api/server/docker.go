@@ -9,7 +9,10 @@ import (
 	"path"
 	"strconv"
 
+	"github.com/portworx/kvdb"
+
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/cluster"
 	"github.com/libopenstorage/openstorage/config"
 	"github.com/libopenstorage/openstorage/volume"
 )
@@ -22,6 +25,7 @@ const (
 // Implementation of the Docker volumes plugin specification.
 type driver struct {
 	restBase
+	mounts *mountTable
 }
 
 type handshakeResp struct {
@@ -31,6 +35,8 @@ type handshakeResp struct {
 type volumeRequest struct {
 	Name string
 	Opts map[string]string
+	// ID of the caller of mount and unmount requests.
+	ID string
 }
 
 type volumeResponse struct {
@@ -41,12 +47,79 @@ type volumePathResponse struct {
 	Err        error
 }
 
+// volumeStatus describes a volume to Docker. Status carries the metadata
+// shown by docker volume inspect.
+type volumeStatus struct {
+	Name       string
+	Mountpoint string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+type volumeGetResponse struct {
+	Volume *volumeStatus `json:",omitempty"`
+	Err    string
+}
+
+type volumeListResponse struct {
+	Volumes []*volumeStatus
+	Err     string
+}
+
+type capabilitiesResponse struct {
+	Capabilities struct {
+		// Scope is global if volumes are visible from every node.
+		Scope string
+	}
+}
+
 type volumeInfo struct {
 	vol *api.Volume
 }
 
-func newVolumePlugin(name string) restServer {
-	return &driver{restBase{name: name, version: "0.3"}}
+func newVolumePlugin(name string, policy *config.Policy) restServer {
+	d := &driver{
+		restBase: restBase{name: name, version: "0.3"},
+		mounts:   newMountTable(kvdb.Instance(), name, nodeID()),
+	}
+	if policy != nil {
+		d.authz = newAuthorizer(policy, policy.DockerUser)
+	}
+	d.clean()
+	return d
+}
+
+// nodeID returns the ID of this node in the cluster, or its hostname
+// without a cluster.
+func nodeID() string {
+	if c, err := cluster.Inst(); err == nil {
+		return c.NodeID()
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// clean drops the references to volumes that are not mounted on this node,
+// such as those left over from before a reboot.
+func (d *driver) clean() {
+	v, err := volume.Get(d.name)
+	if err != nil {
+		return
+	}
+	ids, err := d.mounts.volumes()
+	if err != nil {
+		d.logReq("clean", "").Warnf("Cannot enumerate mounts: %v", err)
+		return
+	}
+	for _, id := range ids {
+		vols, err := v.Inspect([]api.VolumeID{id})
+		if err == nil && len(vols) == 1 && isMounted(vols[0].AttachPath) {
+			continue
+		}
+		d.logReq("clean", string(id)).Infof("Dropping references to volume that is not mounted")
+		if err := d.mounts.clear(id); err != nil {
+			d.logReq("clean", string(id)).Warnf("Cannot drop references: %v", err)
+		}
+	}
 }
 
 func (d *driver) String() string {
@@ -58,7 +131,7 @@ func volDriverPath(method string) string {
 }
 
 func (d *driver) volNotFound(request string, id string, e error, w http.ResponseWriter) error {
-	err := fmt.Errorf("Failed to locate volume: " + e.Error())
+	err := fmt.Errorf("Failed to locate volume: %v", e)
 	d.logReq(request, id).Warn(http.StatusNotFound, " ", err.Error())
 	return err
 }
@@ -76,6 +149,9 @@ func (d *driver) Routes() []*Route {
 		&Route{verb: "POST", path: volDriverPath("Mount"), fn: d.mount},
 		&Route{verb: "POST", path: volDriverPath("Path"), fn: d.path},
 		&Route{verb: "POST", path: volDriverPath("Unmount"), fn: d.unmount},
+		&Route{verb: "POST", path: volDriverPath("Get"), fn: d.get},
+		&Route{verb: "POST", path: volDriverPath("List"), fn: d.list},
+		&Route{verb: "POST", path: volDriverPath("Capabilities"), fn: d.capabilities},
 		&Route{verb: "POST", path: "/Plugin.Activate", fn: d.handshake},
 		&Route{verb: "GET", path: "/status", fn: d.status},
 	}
@@ -101,6 +177,15 @@ func (d *driver) volFromName(name string) (*volumeInfo, error) {
 	return nil, fmt.Errorf("Cannot locate volume %s", name)
 }
 
+// authorize returns an error unless the docker user may verb the volume.
+func (d *driver) authorize(r *http.Request, method string, verb string, volInfo *volumeInfo) error {
+	err := d.authz.authorizeLabels(r, verb, volInfo.vol.Locator.VolumeLabels)
+	if err != nil {
+		d.logReq(method, string(volInfo.vol.ID)).Warn(err)
+	}
+	return err
+}
+
 func (d *driver) decode(method string, w http.ResponseWriter, r *http.Request) (*volumeRequest, error) {
 	var request volumeRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
@@ -152,6 +237,11 @@ func (d *driver) specFromOpts(Opts map[string]string) *api.VolumeSpec {
 		case api.SpecSnapshotInterval:
 			snapshotInterval, _ := strconv.ParseInt(v, 10, 64)
 			spec.SnapshotInterval = int(snapshotInterval)
+		case api.SpecSnapshotRetain:
+			if spec.ConfigLabels == nil {
+				spec.ConfigLabels = make(api.Labels)
+			}
+			spec.ConfigLabels[api.SpecSnapshotRetain] = v
 		}
 	}
 	return &spec
@@ -174,8 +264,14 @@ func (d *driver) create(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(&volumeResponse{Err: err})
 			return
 		}
+		locator := api.VolumeLocator{Name: request.Name}
+		if err = d.authz.authorizeCreate(r, VerbCreate, &locator); err != nil {
+			d.logReq(method, request.Name).Warn(err)
+			json.NewEncoder(w).Encode(&volumeResponse{Err: err})
+			return
+		}
 		spec := d.specFromOpts(request.Opts)
-		_, err = v.Create(api.VolumeLocator{Name: request.Name}, nil, spec)
+		_, err = v.Create(locator, nil, spec)
 		if err != nil {
 			json.NewEncoder(w).Encode(&volumeResponse{Err: err})
 			return
@@ -196,12 +292,16 @@ func (d *driver) remove(w http.ResponseWriter, r *http.Request) {
 	d.logReq(method, request.Name).Info("")
 
 	// It is an error if the volume doesn't exist.
-	_, err = d.volFromName(request.Name)
+	volInfo, err := d.volFromName(request.Name)
 	if err != nil {
 		e := d.volNotFound(method, request.Name, err, w)
 		json.NewEncoder(w).Encode(&volumeResponse{Err: e})
 		return
 	}
+	if err = d.authorize(r, method, VerbDelete, volInfo); err != nil {
+		json.NewEncoder(w).Encode(&volumeResponse{Err: err})
+		return
+	}
 
 	json.NewEncoder(w).Encode(&volumeResponse{})
 }
@@ -230,29 +330,62 @@ func (d *driver) mount(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
 		return
 	}
+	if err = d.authorize(r, method, VerbMount, volInfo); err != nil {
+		json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
+		return
+	}
 
-	// If this is a block driver, first attach the volume.
-	if v.Type()&api.Block != 0 {
-		attachPath, err := v.Attach(volInfo.vol.ID)
-		if err != nil {
-			d.logReq(method, request.Name).Warnf("Cannot attach volume: %v", err.Error())
-			json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
-			return
-		}
-		d.logReq(method, request.Name).Debugf("response %v", attachPath)
+	lock, err := d.mounts.lock(volInfo.vol.ID)
+	if err != nil {
+		json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
+		return
 	}
+	defer d.mounts.unlock(lock)
 
-	// Now mount it.
-	response.Mountpoint = path.Join(config.MountBase, request.Name)
-	os.MkdirAll(response.Mountpoint, 0755)
+	// Another caller may have mounted the volume while waiting for the
+	// lock.
+	vols, err := v.Inspect([]api.VolumeID{volInfo.vol.ID})
+	if err == nil && len(vols) != 1 {
+		err = fmt.Errorf("Cannot locate volume %v", volInfo.vol.ID)
+	}
+	if err != nil {
+		json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
+		return
+	}
+	volInfo.vol = &vols[0]
 
-	err = v.Mount(volInfo.vol.ID, response.Mountpoint)
+	refs, err := d.mounts.add(volInfo.vol.ID, request.ID)
 	if err != nil {
-		d.logReq(method, request.Name).Warnf("Cannot mount volume %v, %v",
-			response.Mountpoint, err)
+		d.logReq(method, request.Name).Warnf("Cannot reference volume: %v", err)
 		json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
 		return
 	}
+
+	// Only the first caller attaches and mounts the volume. The
+	// references of a mount that is gone, such as one from before a
+	// reboot, are dropped.
+	response.Mountpoint = path.Join(config.MountBase, request.Name)
+	if refs != 0 && (volInfo.vol.AttachPath != response.Mountpoint || !isMounted(response.Mountpoint)) {
+		d.logReq(method, request.Name).Warnf("Dropping %v references, volume is not mounted", refs)
+		if err = d.mounts.clear(volInfo.vol.ID); err == nil {
+			refs, err = d.mounts.add(volInfo.vol.ID, request.ID)
+		}
+		if err != nil {
+			json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
+			return
+		}
+	}
+	if refs == 0 {
+		if err = d.attachMount(v, volInfo.vol.ID, response.Mountpoint); err != nil {
+			d.logReq(method, request.Name).Warnf("Cannot mount volume %v, %v",
+				response.Mountpoint, err)
+			d.mounts.remove(volInfo.vol.ID, request.ID)
+			json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
+			return
+		}
+	} else {
+		d.logReq(method, request.Name).Debugf("already mounted for %v callers", refs)
+	}
 	response.Mountpoint = path.Join(response.Mountpoint, config.DataDir)
 	os.MkdirAll(response.Mountpoint, 0755)
 
@@ -260,6 +393,24 @@ func (d *driver) mount(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&response)
 }
 
+// attachMount attaches volID if v is a block driver and mounts it at
+// mountpoint.
+func (d *driver) attachMount(v volume.VolumeDriver, volID api.VolumeID, mountpoint string) error {
+	if v.Type()&api.Block != 0 {
+		attachPath, err := v.Attach(volID)
+		if err != nil {
+			return err
+		}
+		d.logReq("mount", string(volID)).Debugf("attached at %v", attachPath)
+	}
+	os.MkdirAll(mountpoint, 0755)
+	err := v.Mount(volID, mountpoint)
+	if err != nil && v.Type()&api.Block != 0 {
+		v.Detach(volID)
+	}
+	return err
+}
+
 func (d *driver) path(w http.ResponseWriter, r *http.Request) {
 	method := "path"
 	var response volumePathResponse
@@ -275,6 +426,10 @@ func (d *driver) path(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(&volumePathResponse{Err: e})
 		return
 	}
+	if err = d.authorize(r, method, VerbMount, volInfo); err != nil {
+		json.NewEncoder(w).Encode(&volumePathResponse{Err: err})
+		return
+	}
 
 	d.logReq(method, request.Name).Debug("")
 	response.Mountpoint = volInfo.vol.AttachPath
@@ -311,12 +466,37 @@ func (d *driver) unmount(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(&volumeResponse{Err: e})
 		return
 	}
+	if err = d.authorize(r, method, VerbMount, volInfo); err != nil {
+		json.NewEncoder(w).Encode(&volumeResponse{Err: err})
+		return
+	}
+
+	lock, err := d.mounts.lock(volInfo.vol.ID)
+	if err != nil {
+		json.NewEncoder(w).Encode(&volumeResponse{Err: err})
+		return
+	}
+	defer d.mounts.unlock(lock)
 
+	refs, err := d.mounts.remove(volInfo.vol.ID, request.ID)
+	if err != nil {
+		d.logReq(method, request.Name).Warnf("Cannot dereference volume: %v", err)
+		json.NewEncoder(w).Encode(&volumeResponse{Err: err})
+		return
+	}
+
+	// Only the last caller unmounts and detaches the volume.
+	if refs != 0 {
+		d.logReq(method, request.Name).Debugf("still mounted for %v callers", refs)
+		d.emptyResponse(w)
+		return
+	}
 	mountpoint := path.Join(config.MountBase, request.Name)
 	err = v.Unmount(volInfo.vol.ID, mountpoint)
 	if err != nil {
 		d.logReq(method, request.Name).Warnf("Cannot unmount volume %v, %v",
 			mountpoint, err)
+		d.mounts.add(volInfo.vol.ID, request.ID)
 		json.NewEncoder(w).Encode(&volumeResponse{Err: err})
 		return
 	}
@@ -326,3 +506,92 @@ func (d *driver) unmount(w http.ResponseWriter, r *http.Request) {
 	}
 	d.emptyResponse(w)
 }
+
+// volumeStatus returns the description of vol. Volumes are mounted at
+// their attach path, and the status carries the state, spec and labels.
+func (d *driver) volumeStatus(vol *api.Volume) *volumeStatus {
+	status := &volumeStatus{
+		Name: vol.Locator.Name,
+		Status: map[string]interface{}{
+			"ID":     vol.ID,
+			"State":  vol.State.String(),
+			"Status": vol.Status,
+			"Format": vol.Format,
+			"Spec":   vol.Spec,
+			"Labels": vol.Locator.VolumeLabels,
+			"Usage":  vol.Usage,
+			"Ctime":  vol.Ctime,
+		},
+	}
+	if status.Name == "" {
+		status.Name = string(vol.ID)
+	}
+	if vol.AttachPath != "" {
+		status.Mountpoint = path.Join(vol.AttachPath, config.DataDir)
+	}
+	if vol.Error != "" {
+		status.Status["Error"] = vol.Error
+	}
+	if refs, err := d.mounts.get(vol.ID); err == nil {
+		status.Status["Mounts"] = refs.count()
+	}
+	return status
+}
+
+func (d *driver) get(w http.ResponseWriter, r *http.Request) {
+	method := "get"
+
+	request, err := d.decode(method, w, r)
+	if err != nil {
+		return
+	}
+
+	volInfo, err := d.volFromName(request.Name)
+	if err != nil {
+		e := d.volNotFound(method, request.Name, err, w)
+		json.NewEncoder(w).Encode(&volumeGetResponse{Err: e.Error()})
+		return
+	}
+	if err = d.authorize(r, method, VerbInspect, volInfo); err != nil {
+		json.NewEncoder(w).Encode(&volumeGetResponse{Err: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&volumeGetResponse{Volume: d.volumeStatus(volInfo.vol)})
+}
+
+func (d *driver) list(w http.ResponseWriter, r *http.Request) {
+	method := "list"
+	d.logReq(method, "").Debug("")
+
+	v, err := volume.Get(d.name)
+	if err != nil {
+		d.logReq(method, "").Warnf("Cannot locate volume driver: %v", err.Error())
+		json.NewEncoder(w).Encode(&volumeListResponse{Err: err.Error()})
+		return
+	}
+
+	vols, err := v.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		d.logReq(method, "").Warnf("Cannot enumerate volumes: %v", err.Error())
+		json.NewEncoder(w).Encode(&volumeListResponse{Err: err.Error()})
+		return
+	}
+	response := volumeListResponse{Volumes: make([]*volumeStatus, 0, len(vols))}
+	for _, vol := range d.authz.filter(r, VerbInspect, vols) {
+		response.Volumes = append(response.Volumes, d.volumeStatus(&vol))
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// capabilities reports global scope if the node is part of a cluster,
+// since every node then sees the same volumes.
+func (d *driver) capabilities(w http.ResponseWriter, r *http.Request) {
+	var response capabilitiesResponse
+	response.Capabilities.Scope = "local"
+	if _, err := cluster.Inst(); err == nil {
+		response.Capabilities.Scope = "global"
+	}
+	d.logReq("capabilities", "").Debugf("scope %v", response.Capabilities.Scope)
+	json.NewEncoder(w).Encode(&response)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/libopenstorage/openstorage/volume/drivers/nfs"
+)
+
+const testPath = "/tmp/openstorage_server_test"
+
+// call posts request to the plugin endpoint of d and decodes the response.
+func call(t *testing.T, d *driver, endpoint string, request interface{}, response interface{}) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+	r, err := http.NewRequest("POST", volDriverPath(endpoint), bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	newRouter(d.Routes(), nil).ServeHTTP(w, r)
+	if err := json.NewDecoder(w.Body).Decode(response); err != nil {
+		t.Fatalf("Failed to decode %v response: %v", endpoint, err)
+	}
+}
+
+func TestPluginGetList(t *testing.T) {
+	os.MkdirAll(testPath, 0744)
+	v, err := volume.New(nfs.Name, volume.DriverParams{"path": testPath})
+	if err != nil {
+		t.Fatalf("Failed to initialize Driver: %v", err)
+	}
+	d := newVolumePlugin(nfs.Name, nil).(*driver)
+
+	id, err := v.Create(api.VolumeLocator{
+		Name:         "plugin_test",
+		VolumeLabels: api.Labels{"owner": "alice"},
+	}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.NoError(t, err, "Failed in Create")
+	defer v.Delete(id)
+
+	var get volumeGetResponse
+	call(t, d, "Get", &volumeRequest{Name: "plugin_test"}, &get)
+	assert.Empty(t, get.Err)
+	if assert.NotNil(t, get.Volume, "Get must describe the volume") {
+		assert.Equal(t, "plugin_test", get.Volume.Name)
+		assert.Empty(t, get.Volume.Mountpoint, "Volume is not mounted")
+		assert.Equal(t, string(id), get.Volume.Status["ID"])
+		assert.Equal(t, map[string]interface{}{"owner": "alice"}, get.Volume.Status["Labels"])
+		assert.Contains(t, get.Volume.Status, "Spec")
+		assert.Contains(t, get.Volume.Status, "State")
+	}
+	get = volumeGetResponse{}
+	call(t, d, "Get", &volumeRequest{Name: "none"}, &get)
+	assert.NotEmpty(t, get.Err, "Unknown volumes must fail")
+	assert.Nil(t, get.Volume)
+
+	var list volumeListResponse
+	call(t, d, "List", struct{}{}, &list)
+	assert.Empty(t, list.Err)
+	found := false
+	for _, vol := range list.Volumes {
+		found = found || vol.Name == "plugin_test"
+	}
+	assert.True(t, found, "List must include the volume")
+
+	var caps capabilitiesResponse
+	call(t, d, "Capabilities", struct{}{}, &caps)
+	assert.Equal(t, "local", caps.Capabilities.Scope, "Volumes are local without a cluster")
+}
+
+func init() {
+	kv, err := kvdb.New(mem.Name, "server_test", []string{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	kvdb.SetInstance(kv)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/portworx/kvdb"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+// mountKeyBase is the kvdb prefix of the mount references of the Docker
+// plugin.
+const mountKeyBase = "openstorage/docker/mounts/"
+
+// mountLockTTL is the time in seconds a mount may hold the lock of a
+// volume. It covers attaching and formatting the volume on its first mount.
+const mountLockTTL = 600
+
+// mountRefs are the callers a volume is mounted for. Docker passes the ID
+// of the container with each mount. Callers of older versions of the
+// protocol do not and are counted under the empty ID.
+type mountRefs struct {
+	Callers map[string]int
+}
+
+// count returns the number of references.
+func (m *mountRefs) count() int {
+	n := 0
+	for _, c := range m.Callers {
+		n += c
+	}
+	return n
+}
+
+// mountTable keeps the mount references of the volumes of a driver on a
+// node in kvdb, so that they survive restarts of the daemon. The kvdb is
+// shared by the nodes of a cluster, each keeps its own references.
+type mountTable struct {
+	kv     kvdb.Kvdb
+	prefix string
+}
+
+func newMountTable(kv kvdb.Kvdb, driver string, node string) *mountTable {
+	return &mountTable{kv: kv, prefix: mountKeyBase + driver + "/" + node + "/"}
+}
+
+func (t *mountTable) key(volID api.VolumeID) string {
+	return t.prefix + string(volID)
+}
+
+// lock serializes the mounts and unmounts of volID.
+func (t *mountTable) lock(volID api.VolumeID) (*kvdb.KVPair, error) {
+	return t.kv.Lock(t.key(volID)+".lock", mountLockTTL)
+}
+
+func (t *mountTable) unlock(kvp *kvdb.KVPair) error {
+	return t.kv.Unlock(kvp)
+}
+
+// get returns the references of volID.
+func (t *mountTable) get(volID api.VolumeID) (*mountRefs, error) {
+	refs := &mountRefs{}
+	if _, err := t.kv.GetVal(t.key(volID), refs); err != nil && err != kvdb.ErrNotFound {
+		return nil, err
+	}
+	if refs.Callers == nil {
+		refs.Callers = make(map[string]int)
+	}
+	return refs, nil
+}
+
+func (t *mountTable) put(volID api.VolumeID, refs *mountRefs) error {
+	if len(refs.Callers) == 0 {
+		_, err := t.kv.Delete(t.key(volID))
+		if err == kvdb.ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+	_, err := t.kv.Put(t.key(volID), refs, 0)
+	return err
+}
+
+// volumes returns the volumes with references.
+func (t *mountTable) volumes() ([]api.VolumeID, error) {
+	kvps, err := t.kv.Enumerate(t.prefix)
+	if err != nil && err != kvdb.ErrNotFound {
+		return nil, err
+	}
+	var ids []api.VolumeID
+	for _, kvp := range kvps {
+		if !strings.HasSuffix(kvp.Key, ".lock") {
+			ids = append(ids, api.VolumeID(path.Base(kvp.Key)))
+		}
+	}
+	return ids, nil
+}
+
+// clear drops all references to volID.
+func (t *mountTable) clear(volID api.VolumeID) error {
+	return t.put(volID, &mountRefs{})
+}
+
+// add references volID for caller and returns the number of references
+// before. Mounting twice for the same caller ID references the volume
+// once.
+func (t *mountTable) add(volID api.VolumeID, caller string) (int, error) {
+	refs, err := t.get(volID)
+	if err != nil {
+		return 0, err
+	}
+	n := refs.count()
+	if caller == "" || refs.Callers[caller] == 0 {
+		refs.Callers[caller]++
+	}
+	return n, t.put(volID, refs)
+}
+
+// remove drops the reference of caller to volID and returns the number of
+// references left. Unmounting for a caller that has no reference leaves
+// the others. Volumes without references are reported as unreferenced.
+func (t *mountTable) remove(volID api.VolumeID, caller string) (int, error) {
+	refs, err := t.get(volID)
+	if err != nil {
+		return 0, err
+	}
+	if refs.Callers[caller] > 1 {
+		refs.Callers[caller]--
+	} else {
+		delete(refs.Callers, caller)
+	}
+	return refs.count(), t.put(volID, refs)
+}
+
+// isMounted returns true if a filesystem is mounted at mountpoint.
+func isMounted(mountpoint string) bool {
+	if mountpoint == "" {
+		return false
+	}
+	b, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == mountpoint {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestMountTable(t *testing.T) {
+	kv, err := kvdb.New(mem.Name, "mounts_test", []string{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create kvdb: %v", err)
+	}
+	m := newMountTable(kv, "test", "node1")
+
+	n, err := m.add("vol", "c1")
+	assert.NoError(t, err, "Failed to add reference")
+	assert.Equal(t, 0, n, "First mount must mount the volume")
+	n, err = m.add("vol", "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = m.add("vol", "c2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n, "Mounting twice for a caller must reference the volume once")
+	n, err = m.add("vol", "")
+	assert.NoError(t, err)
+	n, err = m.add("vol", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n, "Callers without ID must be counted")
+
+	// Other nodes keep their own references.
+	other := newMountTable(kv, "test", "node2")
+	n, err = other.add("vol", "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Mounts on other nodes must not be counted")
+	ids, err := other.volumes()
+	assert.NoError(t, err)
+	assert.Equal(t, []api.VolumeID{"vol"}, ids)
+	assert.NoError(t, other.clear("vol"))
+	ids, err = other.volumes()
+	assert.NoError(t, err)
+	assert.Empty(t, ids, "Cleared volumes must not be referenced")
+
+	// A restarted daemon reads the references back from kvdb.
+	m = newMountTable(kv, "test", "node1")
+	n, err = m.remove("vol", "c1")
+	assert.NoError(t, err, "Failed to remove reference")
+	assert.Equal(t, 3, n)
+	n, err = m.remove("vol", "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n, "Unknown callers must leave the others")
+	n, err = m.remove("vol", "")
+	assert.NoError(t, err)
+	n, err = m.remove("vol", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = m.remove("vol", "c2")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Last unmount must unmount the volume")
+	_, err = kv.Get(m.key("vol"))
+	assert.Equal(t, kvdb.ErrNotFound, err, "Unreferenced volumes must be removed from kvdb")
+
+	n, err = m.remove("other", "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Volumes without references must be unmounted")
+}
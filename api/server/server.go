@@ -1,7 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -9,8 +13,34 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/config"
+	"github.com/libopenstorage/openstorage/pkg/auth"
+	"github.com/libopenstorage/openstorage/volume"
 )
 
+// errorStatus is the HTTP status of responses to requests failed with
+// the error code. Other codes are sent with http.StatusInternalServerError.
+var errorStatus = map[api.ErrorCode]int{
+	api.ErrCodeInvalid:        http.StatusBadRequest,
+	api.ErrCodeVolShrink:      http.StatusBadRequest,
+	api.ErrCodeNotSnapshot:    http.StatusBadRequest,
+	api.ErrCodeVolBounds:      http.StatusBadRequest,
+	api.ErrCodeNotFound:       http.StatusNotFound,
+	api.ErrCodeDriverNotFound: http.StatusNotFound,
+	api.ErrCodeExists:         http.StatusConflict,
+	api.ErrCodeVolAttached:    http.StatusConflict,
+	api.ErrCodeVolDetached:    http.StatusConflict,
+	api.ErrCodeVolMounted:     http.StatusConflict,
+	api.ErrCodeVolHasSnaps:    http.StatusConflict,
+	api.ErrCodeNoSpace:        http.StatusInsufficientStorage,
+	api.ErrCodeNoMemory:       http.StatusServiceUnavailable,
+	api.ErrCodeNotSupported:   http.StatusNotImplemented,
+	api.ErrCodeUnauthorized:   http.StatusUnauthorized,
+	api.ErrCodeForbidden:      http.StatusForbidden,
+}
+
 // Route is a specification and  handler for a REST endpoint.
 type Route struct {
 	verb string
@@ -23,12 +53,14 @@ type restServer interface {
 	String() string
 	logReq(request string, id string) *log.Entry
 	sendError(request string, id string, w http.ResponseWriter, msg string, code int)
+	sendErrorResponse(request string, id string, w http.ResponseWriter, err error)
 }
 
 type restBase struct {
 	restServer
 	version string
 	name    string
+	authz   *authorizer
 }
 
 func (rest *restBase) logReq(request string, id string) *log.Entry {
@@ -43,22 +75,147 @@ func (rest *restBase) sendError(request string, id string, w http.ResponseWriter
 	http.Error(w, msg, code)
 }
 
+// sendErrorResponse replies to a failed request with the ErrorResponse of
+// err and the HTTP status of its code.
+func (rest *restBase) sendErrorResponse(request string, id string, w http.ResponseWriter, err error) {
+	status := writeErrorResponse(w, err)
+	rest.logReq(request, id).Warn(status, " ", err)
+}
+
+// writeErrorResponse writes the ErrorResponse of err and returns its HTTP
+// status.
+func writeErrorResponse(w http.ResponseWriter, err error) int {
+	resp := api.ErrorResponse{
+		Code:    volume.ErrorCode(err),
+		Message: err.Error(),
+	}
+	status, ok := errorStatus[resp.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	resp.Retryable = status == http.StatusServiceUnavailable
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&resp)
+	return status
+}
+
+// authenticate wraps fn to reject requests without valid credentials and
+// record the user of the others.
+func authenticate(a *auth.Authenticator, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.Verify(r)
+		if err != nil {
+			log.Warnf("Rejected %v %v from %v: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeErrorResponse(w, &api.ErrorResponse{
+				Code:    api.ErrCodeUnauthorized,
+				Message: err.Error(),
+			})
+			return
+		}
+		setUser(r, user)
+		fn(w, r)
+	}
+}
+
+// newRouter returns a router of routes. Requests must be authenticated by
+// a unless it is nil.
+func newRouter(routes []*Route, a *auth.Authenticator) *mux.Router {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	for _, v := range routes {
+		fn := v.fn
+		if a != nil {
+			fn = authenticate(a, fn)
+		}
+		router.Methods(v.verb).Path(v.path).HandlerFunc(fn)
+	}
+	return router
+}
+
+// tlsConfig returns the TLS configuration of rest, or nil if TLS is not
+// enabled.
+func tlsConfig(rest *config.Rest) (*tls.Config, error) {
+	if rest.CertFile == "" && rest.KeyFile == "" {
+		if rest.ClientCAFile != "" {
+			return nil, fmt.Errorf("Client CA requires a server certificate and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(rest.CertFile, rest.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load server certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if rest.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(rest.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read client CA: %v", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in client CA %v", rest.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// credentials returns the credentials of the users of policy and of the
+// shared credentials of rest, which authenticate the empty user.
+func credentials(rest *config.Rest, policy *config.Policy) map[string]auth.Credentials {
+	users := map[string]auth.Credentials{
+		"": {Token: rest.Token, Key: rest.HMACKey},
+	}
+	if policy != nil {
+		for name, user := range policy.Users {
+			users[name] = auth.Credentials{Token: user.Token, Key: user.HMACKey}
+		}
+	}
+	return users
+}
+
+// listenTCP serves routes on port with the TLS of rest, authenticating
+// requests with the credentials of rest and policy.
+func listenTCP(port int, routes []*Route, rest *config.Rest, policy *config.Policy) error {
+	if rest == nil {
+		rest = &config.Rest{}
+	}
+	cfg, err := tlsConfig(rest)
+	if err != nil {
+		return err
+	}
+	a := auth.New(credentials(rest, policy))
+	if cfg == nil && a == nil {
+		log.Warnf("REST service on port %v is exposed without TLS or authentication", port)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if err != nil {
+		log.Warnf("Cannot listen on port %v: %v", port, err)
+		return err
+	}
+	if cfg != nil {
+		listener = tls.NewListener(listener, cfg)
+	}
+	log.Printf("Starting REST service on port %v", port)
+	go http.Serve(listener, newRouter(routes, a))
+	return nil
+}
+
 func notFound(w http.ResponseWriter, r *http.Request) {
 	log.Warnf("Not found: %+v ", r.URL)
 	http.NotFound(w, r)
 }
 
-func startServer(name string, sockBase string, port int, routes []*Route) error {
+func startServer(name string, sockBase string, port int, routes []*Route,
+	rest *config.Rest, policy *config.Policy) error {
 	var (
 		listener net.Listener
 		err      error
 	)
-	router := mux.NewRouter()
-	router.NotFoundHandler = http.HandlerFunc(notFound)
-
-	for _, v := range routes {
-		router.Methods(v.verb).Path(v.path).HandlerFunc(v.fn)
-	}
 	socket := path.Join(sockBase, name+".sock")
 	os.Remove(socket)
 	os.MkdirAll(path.Dir(socket), 0755)
@@ -69,9 +226,9 @@ func startServer(name string, sockBase string, port int, routes []*Route) error
 		log.Warn("Cannot listen on UNIX socket: ", err)
 		return err
 	}
-	go http.Serve(listener, router)
+	go http.Serve(listener, newRouter(routes, nil))
 	if port != 0 {
-		go http.ListenAndServe(fmt.Sprintf(":%v", port), router)
+		return listenTCP(port, routes, rest, policy)
 	}
 	return nil
 }
@@ -80,21 +237,30 @@ func startServer(name string, sockBase string, port int, routes []*Route) error
 func StartGraphAPI(name string, port int, restBase string) error {
 	graphPlugin := newGraphPlugin(name)
 	routes := append(graphPlugin.Routes())
-	return startServer(name, restBase, port, routes)
+	return startServer(name, restBase, port, routes, nil, nil)
 }
 
 // StartServerAPI starts a REST server to receive driver configuration commands
-// from the CLI/UX.
-func StartServerAPI(name string, port int, restBase string) error {
-	volApi := newVolumeAPI(name)
-	clusterApi := newClusterAPI(name)
+// from the CLI/UX. If port is not 0, the API is also served on the TCP port
+// with the TLS and authentication configured in rest, and the requests of
+// the users of policy are authorized by it. Either may be nil.
+func StartServerAPI(name string, port int, restBase string, rest *config.Rest, policy *config.Policy) error {
+	if err := validatePolicy(policy); err != nil {
+		return err
+	}
+	volApi := newVolumeAPI(name, policy)
+	clusterApi := newClusterAPI(name, policy)
 	routes := append(volApi.Routes(), clusterApi.Routes()...)
-	return startServer(name, restBase, port, routes)
+	return startServer(name, restBase, port, routes, rest, policy)
 }
 
 // StartPluginAPI starts a REST server to receive volume commands from the
-// Linux container engine.
-func StartPluginAPI(name string, pluginBase string) error {
-	rest := newVolumePlugin(name)
-	return startServer(name, pluginBase, 0, rest.Routes())
+// Linux container engine. Requests are authorized as the docker user of
+// policy, which may be nil.
+func StartPluginAPI(name string, pluginBase string, policy *config.Policy) error {
+	if err := validatePolicy(policy); err != nil {
+		return err
+	}
+	rest := newVolumePlugin(name, policy)
+	return startServer(name, pluginBase, 0, rest.Routes(), nil, nil)
 }
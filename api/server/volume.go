@@ -4,30 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/config"
 	"github.com/libopenstorage/openstorage/volume"
 )
 
 const (
 	volApiVersion = "v1"
+	// maxIOSize largest read or write accepted by the io endpoint.
+	maxIOSize = 4 << 20
 )
 
 type volApi struct {
 	restBase
 }
 
-func responseStatus(err error) string {
-	if err == nil {
-		return ""
-	}
-	return err.Error()
+// invalidArgument returns ErrEinval with the cause err.
+func invalidArgument(err error) error {
+	return fmt.Errorf("%w: %v", volume.ErrEinval, err)
 }
 
-func newVolumeAPI(name string) restServer {
-	return &volApi{restBase{version: volApiVersion, name: name}}
+func newVolumeAPI(name string, policy *config.Policy) restServer {
+	return &volApi{restBase{
+		version: volApiVersion,
+		name:    name,
+		authz:   newAuthorizer(policy, ""),
+	}}
 }
 
 func (vd *volApi) String() string {
@@ -48,17 +54,28 @@ func (vd *volApi) create(w http.ResponseWriter, r *http.Request) {
 	method := "create"
 
 	if err := json.NewDecoder(r.Body).Decode(&dcReq); err != nil {
-		vd.sendError(vd.name, method, w, err.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+	err = vd.authz.authorizeCreate(r, VerbCreate, &dcReq.Locator)
+	if err == nil && dcReq.Source != nil && dcReq.Source.Parent != "" {
+		err = vd.authz.authorizeVolume(r, d, VerbSnap, dcReq.Source.Parent)
+	}
+	if err != nil {
+		vd.sendErrorResponse(method, dcReq.Locator.Name, w, err)
 		return
 	}
 	ID, err := d.Create(dcReq.Locator, dcReq.Source, dcReq.Spec)
-	dcRes.VolumeResponse = api.VolumeResponse{Error: responseStatus(err)}
+	if err != nil {
+		vd.sendErrorResponse(method, dcReq.Locator.Name, w, err)
+		return
+	}
 	dcRes.ID = ID
 
 	vd.logReq(method, string(ID)).Info("")
@@ -77,12 +94,12 @@ func (vd *volApi) volumeSet(w http.ResponseWriter, r *http.Request) {
 
 	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		vd.sendError(vd.name, method, w, err.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
 	if volumeID, err = vd.parseVolumeID(r); err != nil {
-		vd.sendError(vd.name, method, w, err.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
@@ -90,12 +107,21 @@ func (vd *volApi) volumeSet(w http.ResponseWriter, r *http.Request) {
 
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
 	if req.Locator != nil || req.Spec != nil {
-		err = d.Set(volumeID, req.Locator, req.Spec)
+		err = vd.authz.authorizeVolume(r, d, VerbSet, volumeID)
+		if err == nil && req.Locator != nil {
+			err = vd.authz.authorizeLabels(r, VerbSet, req.Locator.VolumeLabels)
+		}
+		if err == nil {
+			err = d.Set(volumeID, req.Locator, req.Spec)
+		}
+	}
+	if err == nil && req.Action != nil {
+		err = vd.authz.authorizeVolume(r, d, VerbMount, volumeID)
 	}
 
 	for err == nil && req.Action != nil {
@@ -112,7 +138,7 @@ func (vd *volApi) volumeSet(w http.ResponseWriter, r *http.Request) {
 		if req.Action.Mount != api.ParamIgnore {
 			if req.Action.Mount == api.ParamOn {
 				if req.Action.MountPath == "" {
-					err = fmt.Errorf("Invalid mount path")
+					err = invalidArgument(fmt.Errorf("missing mount path"))
 					break
 				}
 				err = d.Mount(volumeID, req.Action.MountPath)
@@ -127,18 +153,18 @@ func (vd *volApi) volumeSet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		resp.VolumeResponse.Error = err.Error()
-	} else {
-		v, err := d.Inspect([]api.VolumeID{volumeID})
-		if err != nil || v == nil || len(v) != 1 {
-			if err == nil {
-				err = fmt.Errorf("Failed to inspect volume")
-			}
-			resp.VolumeResponse.Error = err.Error()
-		} else {
-			resp.Volume = v[0]
-		}
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
 	}
+	v, err := d.Inspect([]api.VolumeID{volumeID})
+	if err == nil && len(v) != 1 {
+		err = volume.ErrEnoEnt
+	}
+	if err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	resp.Volume = v[0]
 	json.NewEncoder(w).Encode(resp)
 }
 
@@ -149,21 +175,23 @@ func (vd *volApi) inspect(w http.ResponseWriter, r *http.Request) {
 	method := "inspect"
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
 	if volumeID, err = vd.parseVolumeID(r); err != nil {
-		e := fmt.Errorf("Failed to parse parse volumeID: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
 	vd.logReq(method, string(volumeID)).Info("")
 
 	dk, err := d.Inspect([]api.VolumeID{volumeID})
+	for i := 0; err == nil && i < len(dk); i++ {
+		err = vd.authz.authorizeLabels(r, VerbInspect, dk[i].Locator.VolumeLabels)
+	}
 	if err != nil {
-		vd.sendError(vd.name, method, w, err.Error(), http.StatusNotFound)
+		vd.sendErrorResponse(method, string(volumeID), w, err)
 		return
 	}
 
@@ -176,8 +204,7 @@ func (vd *volApi) delete(w http.ResponseWriter, r *http.Request) {
 
 	method := "delete"
 	if volumeID, err = vd.parseVolumeID(r); err != nil {
-		e := fmt.Errorf("Failed to parse parse volumeID: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
@@ -185,13 +212,19 @@ func (vd *volApi) delete(w http.ResponseWriter, r *http.Request) {
 
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
-	err = d.Delete(volumeID)
-	res := api.ResponseStatusNew(err)
-	json.NewEncoder(w).Encode(res)
+	if err = vd.authz.authorizeVolume(r, d, VerbDelete, volumeID); err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	if err = d.Delete(volumeID); err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&api.VolumeResponse{})
 }
 
 func (vd *volApi) enumerate(w http.ResponseWriter, r *http.Request) {
@@ -204,7 +237,7 @@ func (vd *volApi) enumerate(w http.ResponseWriter, r *http.Request) {
 
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 	params := r.URL.Query()
@@ -215,15 +248,15 @@ func (vd *volApi) enumerate(w http.ResponseWriter, r *http.Request) {
 	v = params[string(api.OptLabel)]
 	if v != nil {
 		if err = json.Unmarshal([]byte(v[0]), &locator.VolumeLabels); err != nil {
-			e := fmt.Errorf("Failed to parse parse VolumeLabels: %s", err.Error())
-			vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+			vd.sendErrorResponse(method, "", w, invalidArgument(err))
+			return
 		}
 	}
 	v = params[string(api.OptConfigLabel)]
 	if v != nil {
 		if err = json.Unmarshal([]byte(v[0]), &configLabels); err != nil {
-			e := fmt.Errorf("Failed to parse parse configLabels: %s", err.Error())
-			vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+			vd.sendErrorResponse(method, "", w, invalidArgument(err))
+			return
 		}
 	}
 	v = params[string(api.OptVolumeID)]
@@ -234,14 +267,13 @@ func (vd *volApi) enumerate(w http.ResponseWriter, r *http.Request) {
 		}
 		vols, err = d.Inspect(ids)
 		if err != nil {
-			e := fmt.Errorf("Failed to inspect volumeID: %s", err.Error())
-			vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+			vd.sendErrorResponse(method, "", w, err)
 			return
 		}
 	} else {
 		vols, _ = d.Enumerate(locator, configLabels)
 	}
-	json.NewEncoder(w).Encode(vols)
+	json.NewEncoder(w).Encode(vd.authz.filter(r, VerbInspect, vols))
 }
 
 func (vd *volApi) snap(w http.ResponseWriter, r *http.Request) {
@@ -250,23 +282,65 @@ func (vd *volApi) snap(w http.ResponseWriter, r *http.Request) {
 	method := "snap"
 
 	if err := json.NewDecoder(r.Body).Decode(&snapReq); err != nil {
-		vd.sendError(vd.name, method, w, err.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
 	vd.logReq(method, string(snapReq.ID)).Info("")
 
+	err = vd.authz.authorizeVolume(r, d, VerbSnap, snapReq.ID)
+	if err == nil {
+		err = vd.authz.authorizeCreate(r, VerbSnap, &snapReq.Locator)
+	}
+	if err != nil {
+		vd.sendErrorResponse(method, string(snapReq.ID), w, err)
+		return
+	}
 	ID, err := d.Snapshot(snapReq.ID, snapReq.Readonly, snapReq.Locator)
-	snapRes.VolumeCreateResponse.VolumeResponse = api.VolumeResponse{Error: responseStatus(err)}
+	if err != nil {
+		vd.sendErrorResponse(method, string(snapReq.ID), w, err)
+		return
+	}
 	snapRes.VolumeCreateResponse.ID = ID
 	json.NewEncoder(w).Encode(&snapRes)
 }
 
+func (vd *volApi) restore(w http.ResponseWriter, r *http.Request) {
+	var restoreReq api.SnapRestoreRequest
+	method := "restore"
+
+	if err := json.NewDecoder(r.Body).Decode(&restoreReq); err != nil {
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
+		return
+	}
+	d, err := volume.Get(vd.name)
+	if err != nil {
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	vd.logReq(method, string(restoreReq.ID)).Info("")
+
+	err = vd.authz.authorizeVolume(r, d, VerbSnap, restoreReq.ID)
+	if err == nil {
+		err = vd.authz.authorizeVolume(r, d, VerbSnap, restoreReq.SnapID)
+	}
+	if err != nil {
+		vd.sendErrorResponse(method, string(restoreReq.ID), w, err)
+		return
+	}
+	if err = d.Restore(restoreReq.ID, restoreReq.SnapID); err != nil {
+		vd.sendErrorResponse(method, string(restoreReq.ID), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&api.VolumeResponse{})
+}
+
 func (vd *volApi) snapEnumerate(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var labels api.Labels
@@ -275,15 +349,15 @@ func (vd *volApi) snapEnumerate(w http.ResponseWriter, r *http.Request) {
 	method := "snapEnumerate"
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 	params := r.URL.Query()
 	v := params[string(api.OptLabel)]
 	if v != nil {
 		if err = json.Unmarshal([]byte(v[0]), &labels); err != nil {
-			e := fmt.Errorf("Failed to parse parse VolumeLabels: %s", err.Error())
-			vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+			vd.sendErrorResponse(method, "", w, invalidArgument(err))
+			return
 		}
 	}
 
@@ -297,12 +371,11 @@ func (vd *volApi) snapEnumerate(w http.ResponseWriter, r *http.Request) {
 
 	snaps, err := d.SnapEnumerate(ids, labels)
 	if err != nil {
-		e := fmt.Errorf("Failed to enumerate snaps: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(snaps)
+	json.NewEncoder(w).Encode(vd.authz.filter(r, VerbInspect, snaps))
 }
 
 func (vd *volApi) stats(w http.ResponseWriter, r *http.Request) {
@@ -311,8 +384,7 @@ func (vd *volApi) stats(w http.ResponseWriter, r *http.Request) {
 
 	method := "stats"
 	if volumeID, err = vd.parseVolumeID(r); err != nil {
-		e := fmt.Errorf("Failed to parse parse volumeID: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
@@ -320,45 +392,165 @@ func (vd *volApi) stats(w http.ResponseWriter, r *http.Request) {
 
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
+	err = vd.authz.authorizeVolume(r, d, VerbInspect, volumeID)
+	if err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
 	stats, err := d.Stats(volumeID)
 	if err != nil {
-		e := fmt.Errorf("Failed to get stats: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, string(volumeID), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(stats)
 }
 
+func (vd *volApi) capacity(w http.ResponseWriter, r *http.Request) {
+	method := "capacity"
+	vd.logReq(method, "").Info("")
+
+	d, err := volume.Get(vd.name)
+	if err != nil {
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	if err = vd.authz.authorize(r, VerbInspect); err != nil {
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+	capacity, err := d.Capacity()
+	if err != nil {
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(capacity)
+}
+
 func (vd *volApi) alerts(w http.ResponseWriter, r *http.Request) {
 	var volumeID api.VolumeID
 	var err error
 
 	method := "alerts"
 	if volumeID, err = vd.parseVolumeID(r); err != nil {
-		e := fmt.Errorf("Failed to parse parse volumeID: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
 		return
 	}
 
 	d, err := volume.Get(vd.name)
 	if err != nil {
-		notFound(w, r)
+		vd.sendErrorResponse(method, "", w, err)
 		return
 	}
 
+	err = vd.authz.authorizeVolume(r, d, VerbInspect, volumeID)
+	if err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
 	alerts, err := d.Alerts(volumeID)
 	if err != nil {
-		e := fmt.Errorf("Failed to get alerts: %s", err.Error())
-		vd.sendError(vd.name, method, w, e.Error(), http.StatusBadRequest)
+		vd.sendErrorResponse(method, string(volumeID), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(alerts)
 }
 
+func (vd *volApi) read(w http.ResponseWriter, r *http.Request) {
+	var volumeID api.VolumeID
+	var err error
+
+	method := "read"
+	if volumeID, err = vd.parseVolumeID(r); err != nil {
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
+		return
+	}
+	params := r.URL.Query()
+	offset, err := strconv.ParseInt(params.Get(string(api.OptOffset)), 10, 64)
+	if err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, invalidArgument(err))
+		return
+	}
+	size, err := strconv.ParseUint(params.Get(string(api.OptSize)), 10, 64)
+	if err != nil || size > maxIOSize {
+		e := fmt.Errorf("size must be at most %v bytes", maxIOSize)
+		vd.sendErrorResponse(method, string(volumeID), w, invalidArgument(e))
+		return
+	}
+
+	d, err := volume.Get(vd.name)
+	if err != nil {
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	if err = vd.authz.authorizeVolume(r, d, VerbIO, volumeID); err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	buf := make([]byte, size)
+	n, err := d.Read(volumeID, buf, size, offset)
+	if err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	resp := api.VolumeIOResponse{
+		Data:  buf[:n],
+		Bytes: n,
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+func (vd *volApi) write(w http.ResponseWriter, r *http.Request) {
+	var volumeID api.VolumeID
+	var req api.VolumeIORequest
+	var err error
+
+	method := "write"
+	if volumeID, err = vd.parseVolumeID(r); err != nil {
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
+		return
+	}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		vd.sendErrorResponse(method, "", w, invalidArgument(err))
+		return
+	}
+	if len(req.Data) > maxIOSize {
+		e := fmt.Errorf("size must be at most %v bytes", maxIOSize)
+		vd.sendErrorResponse(method, string(volumeID), w, invalidArgument(e))
+		return
+	}
+
+	vd.logReq(method, string(volumeID)).Info("")
+
+	d, err := volume.Get(vd.name)
+	if err != nil {
+		vd.sendErrorResponse(method, "", w, err)
+		return
+	}
+
+	if err = vd.authz.authorizeVolume(r, d, VerbIO, volumeID); err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	var resp api.VolumeIOResponse
+	if len(req.Data) > 0 {
+		resp.Bytes, err = d.Write(volumeID, req.Data, uint64(len(req.Data)), req.Offset)
+	}
+	if err == nil && req.Flush {
+		err = d.Flush(volumeID)
+	}
+	if err != nil {
+		vd.sendErrorResponse(method, string(volumeID), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
 func volVersion(route string) string {
 	return "/" + volApiVersion + "/" + route
 }
@@ -378,11 +570,15 @@ func (vd *volApi) Routes() []*Route {
 		&Route{verb: "GET", path: volPath(""), fn: vd.enumerate},
 		&Route{verb: "GET", path: volPath("/{id}"), fn: vd.inspect},
 		&Route{verb: "DELETE", path: volPath("/{id}"), fn: vd.delete},
+		&Route{verb: "GET", path: volPath("/{id}/io"), fn: vd.read},
+		&Route{verb: "PUT", path: volPath("/{id}/io"), fn: vd.write},
 		&Route{verb: "GET", path: volPath("/stats"), fn: vd.stats},
 		&Route{verb: "GET", path: volPath("/stats/{id}"), fn: vd.stats},
 		&Route{verb: "GET", path: volPath("/alerts"), fn: vd.alerts},
 		&Route{verb: "GET", path: volPath("/alerts/{id}"), fn: vd.alerts},
+		&Route{verb: "GET", path: volVersion("capacity"), fn: vd.capacity},
 		&Route{verb: "POST", path: snapPath(""), fn: vd.snap},
 		&Route{verb: "GET", path: snapPath(""), fn: vd.snapEnumerate},
+		&Route{verb: "POST", path: snapPath("/restore"), fn: vd.restore},
 	}
 }
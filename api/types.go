@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -61,6 +62,24 @@ const (
 // VolumeStateAny a filter that selects all volumes
 const VolumeStateAny = VolumePending | VolumeAvailable | VolumeAttached | VolumeDetaching | VolumeDetached | VolumeError | VolumeDeleted
 
+var volumeStateNames = map[VolumeState]string{
+	VolumePending:   "Pending",
+	VolumeAvailable: "Available",
+	VolumeAttached:  "Attached",
+	VolumeDetached:  "Detached",
+	VolumeDetaching: "Detaching",
+	VolumeError:     "Error",
+	VolumeDeleted:   "Deleted",
+}
+
+// String returns the name of the state.
+func (s VolumeState) String() string {
+	if name, ok := volumeStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("VolumeState(%d)", int(s))
+}
+
 // Labels a name-value map
 type Labels map[string]string
 
@@ -77,6 +96,9 @@ type VolumeLocator struct {
 type Source struct {
 	// Parent if specified will create a clone of Parent.
 	Parent VolumeID
+	// Clone is set if the volume was created from Parent as a clone
+	// rather than taken as a snapshot of it.
+	Clone bool
 	// Seed will seed the volume from the specified URI. Any
 	// additional config for the source comes from the labels in the spec.
 	Seed string
@@ -105,6 +127,18 @@ const (
 	SpecDedupe           = "dedupe"
 )
 
+// Labels used by scheduled snapshots.
+const (
+	// SnapScheduleLabel marks a snapshot taken by the snapshot scheduler,
+	// its value is the snapshot interval in minutes.
+	SnapScheduleLabel = "snapshot_schedule"
+	// SnapCreatedLabel creation time of a scheduled snapshot in RFC3339.
+	SnapCreatedLabel = "snapshot_created"
+	// SpecSnapshotRetain ConfigLabels key holding the number of scheduled
+	// snapshots to keep. All snapshots are kept if it is not set or 0.
+	SpecSnapshotRetain = "snapshot_retain"
+)
+
 // VolumeSpec has the properties needed to create a volume.
 type VolumeSpec struct {
 	// Ephemeral storage
@@ -149,7 +183,7 @@ type Volume struct {
 	Ctime time.Time
 	// Spec User specified VolumeSpec
 	Spec *VolumeSpec
-	// Usage Volume usage
+	// Usage bytes allocated to the volume
 	Usage uint64
 	// LastScan time when an integrity check for run
 	LastScan time.Time
@@ -189,8 +223,70 @@ type Stats struct {
 	IOProgress int64
 	// IOMs time spent doing I/Os ms.
 	IOMs int64
+	// BytesUsed bytes in use on the volume.
+	BytesUsed int64
 }
 
-// Alerts
+// Capacity of the storage pool backing the volumes of a driver.
+type Capacity struct {
+	// TotalBytes size of the pool.
+	TotalBytes uint64
+	// FreeBytes available in the pool.
+	FreeBytes uint64
+	// UsedBytes in use in the pool.
+	UsedBytes uint64
+	// ProvisionedBytes sum of the sizes of all volumes in the pool.
+	ProvisionedBytes uint64
+	// OvercommitRatio of ProvisionedBytes to TotalBytes up to which
+	// volumes may be created, 0 if there is no limit.
+	OvercommitRatio float64
+}
+
+// AlertSeverity indicates how urgently an alert must be acted upon.
+type AlertSeverity string
+
+const (
+	// AlertNotify informational, no action is required.
+	AlertNotify = AlertSeverity("Notify")
+	// AlertWarning a condition that may need attention.
+	AlertWarning = AlertSeverity("Warning")
+	// AlertCritical a failure that needs immediate attention.
+	AlertCritical = AlertSeverity("Critical")
+)
+
+// ResourceType the kind of resource an alert is raised against.
+type ResourceType string
+
+const (
+	// ResourceVolume alert on a volume, the resource ID is the VolumeID.
+	ResourceVolume = ResourceType("Volume")
+	// ResourceNode alert on a node, the resource ID is the node ID.
+	ResourceNode = ResourceType("Node")
+	// ResourceCluster alert on the cluster, the resource ID is the cluster ID.
+	ResourceCluster = ResourceType("Cluster")
+)
+
+// Alert is an event raised against a resource.
+type Alert struct {
+	// ID unique identifier of this alert.
+	ID string
+	// Severity see AlertSeverity
+	Severity AlertSeverity
+	// ResourceType see ResourceType
+	ResourceType ResourceType
+	// ResourceID identifier of the resource within its type.
+	ResourceID string
+	// Timestamp time when the alert was raised.
+	Timestamp time.Time
+	// Message describing the alert.
+	Message string
+	// Cleared is set once the alert has been acknowledged.
+	Cleared bool
+	// ClearedTime time when the alert was cleared.
+	ClearedTime time.Time
+}
+
+// Alerts a set of alerts.
 type Alerts struct {
+	Alerts []Alert
 }
@@ -12,6 +12,10 @@ const (
 	OptLabel = OptionKey("Label")
 	// OptConfigLabel query parameter used to lookup volume by set of labels.
 	OptConfigLabel = OptionKey("ConfigLabel")
+	// OptOffset query parameter used to specify the offset of volume I/O.
+	OptOffset = OptionKey("Offset")
+	// OptSize query parameter used to specify the size of volume I/O.
+	OptSize = OptionKey("Size")
 )
 
 // VolumeCreateRequest is the body of create REST request
@@ -74,10 +78,69 @@ type VolumeSetResponse struct {
 
 // VolumeResponse is embedded in all REST responses.
 type VolumeResponse struct {
-	// Error is "" on success or contains the error message on failure.
+	// Error is "" on success. Failed requests are answered with an
+	// ErrorResponse, older servers set Error to the error message.
 	Error string `json:"error"`
 }
 
+// ErrorCode identifies the cause of a failed REST request.
+type ErrorCode string
+
+const (
+	// ErrCodeUnknown is reported for errors without a more specific code.
+	ErrCodeUnknown = ErrorCode("unknown")
+	// ErrCodeInvalid is reported for invalid requests.
+	ErrCodeInvalid = ErrorCode("invalid_argument")
+	// ErrCodeNotFound is reported if the volume does not exist.
+	ErrCodeNotFound = ErrorCode("not_found")
+	// ErrCodeExists is reported if the volume or its name already exists.
+	ErrCodeExists = ErrorCode("already_exists")
+	// ErrCodeDriverNotFound is reported if the driver is not initialized.
+	ErrCodeDriverNotFound = ErrorCode("driver_not_found")
+	// ErrCodeVolAttached is reported if the volume must be detached.
+	ErrCodeVolAttached = ErrorCode("volume_attached")
+	// ErrCodeVolDetached is reported if the volume must be attached.
+	ErrCodeVolDetached = ErrorCode("volume_detached")
+	// ErrCodeVolMounted is reported if the volume must be unmounted.
+	ErrCodeVolMounted = ErrorCode("volume_mounted")
+	// ErrCodeVolHasSnaps is reported if the volume has snapshots.
+	ErrCodeVolHasSnaps = ErrorCode("volume_has_snapshots")
+	// ErrCodeVolShrink is reported on requests to reduce the volume size.
+	ErrCodeVolShrink = ErrorCode("volume_shrink")
+	// ErrCodeNotSnapshot is reported if a volume is not a snapshot of another.
+	ErrCodeNotSnapshot = ErrorCode("not_snapshot")
+	// ErrCodeVolBounds is reported for I/O beyond the end of the volume.
+	ErrCodeVolBounds = ErrorCode("out_of_bounds")
+	// ErrCodeNoSpace is reported if the storage pool is full.
+	ErrCodeNoSpace = ErrorCode("no_space")
+	// ErrCodeNoMemory is reported if the server is out of memory.
+	ErrCodeNoMemory = ErrorCode("out_of_memory")
+	// ErrCodeNotSupported is reported if the driver does not support the
+	// request.
+	ErrCodeNotSupported = ErrorCode("not_supported")
+	// ErrCodeUnauthorized is reported for requests without valid
+	// credentials.
+	ErrCodeUnauthorized = ErrorCode("unauthorized")
+	// ErrCodeForbidden is reported for requests the policy does not allow
+	// the user to make.
+	ErrCodeForbidden = ErrorCode("forbidden")
+)
+
+// ErrorResponse is the body of REST responses to failed requests, which
+// are sent with an HTTP error status.
+type ErrorResponse struct {
+	// Code identifies the cause of the error.
+	Code ErrorCode `json:"code"`
+	// Message describes the error.
+	Message string `json:"message"`
+	// Retryable is true if the request may succeed if sent again.
+	Retryable bool `json:"retryable"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return e.Message
+}
+
 // SnapCreateRequest request body to create a snap.
 type SnapCreateRequest struct {
 	ID       VolumeID      `json:"id"`
@@ -90,6 +153,31 @@ type SnapCreateResponse struct {
 	VolumeCreateResponse
 }
 
+// SnapRestoreRequest request body to restore a volume from a snap.
+type SnapRestoreRequest struct {
+	ID     VolumeID `json:"id"`
+	SnapID VolumeID `json:"snap_id"`
+}
+
+// VolumeIORequest is the body of the REST request to write to a volume.
+type VolumeIORequest struct {
+	// Offset in bytes to write Data at.
+	Offset int64 `json:"offset"`
+	// Data to write.
+	Data []byte `json:"data,omitempty"`
+	// Flush writes to stable storage once Data is written.
+	Flush bool `json:"flush"`
+}
+
+// VolumeIOResponse is the body of the REST response to volume I/O.
+type VolumeIOResponse struct {
+	// Data read.
+	Data []byte `json:"data,omitempty"`
+	// Bytes read or written.
+	Bytes int64 `json:"bytes"`
+	VolumeResponse
+}
+
 // ResponseStatusNew create VolumeResponse from error
 func ResponseStatusNew(err error) VolumeResponse {
 	if err == nil {
@@ -2,6 +2,9 @@ package cli
 
 import (
 	"github.com/codegangsta/cli"
+
+	"github.com/libopenstorage/openstorage/api/client"
+	"github.com/libopenstorage/openstorage/config"
 )
 
 const (
@@ -11,8 +14,74 @@ const (
 	DaemonFlag = "daemon"
 	// DriverFlag key for for the driver parameter.
 	DriverFlag = "driver"
+	// HostFlag key for the URL of the REST API of the driver.
+	HostFlag = "host"
+	// TLSCAFlag key for the CA verifying the server certificate.
+	TLSCAFlag = "tls-ca"
+	// TLSCertFlag key for the client certificate.
+	TLSCertFlag = "tls-cert"
+	// TLSKeyFlag key for the key of the client certificate.
+	TLSKeyFlag = "tls-key"
+	// TokenFlag key for the bearer token of requests.
+	TokenFlag = "token"
+	// HMACKeyFlag key for the key signing requests.
+	HMACKeyFlag = "hmac-key"
 )
 
+// ClientFlags are the global flags connecting to the REST API over TCP.
+func ClientFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  HostFlag,
+			Usage: "URL of the driver REST API e.g. https://osd1:9005, the unix socket of the driver by default",
+		},
+		cli.StringFlag{
+			Name:  TLSCAFlag,
+			Usage: "CA file to verify the server certificate, enables TLS",
+		},
+		cli.StringFlag{
+			Name:  TLSCertFlag,
+			Usage: "client certificate file, enables TLS",
+		},
+		cli.StringFlag{
+			Name:  TLSKeyFlag,
+			Usage: "client key file",
+		},
+		cli.StringFlag{
+			Name:   TokenFlag,
+			Usage:  "bearer token to authenticate requests with",
+			EnvVar: "OSD_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   HMACKeyFlag,
+			Usage:  "key to sign requests with",
+			EnvVar: "OSD_HMAC_KEY",
+		},
+	}
+}
+
+// NewClient returns a client of the REST API at the host specified in the
+// -<HostFlag> parameter, or at defaultHost, with the TLS and credentials
+// specified in the client flags.
+func NewClient(c *cli.Context, defaultHost string) (*client.Client, error) {
+	host := c.GlobalString(HostFlag)
+	if host == "" {
+		host = defaultHost
+	}
+	var opts []client.Option
+	ca, cert, key := c.GlobalString(TLSCAFlag), c.GlobalString(TLSCertFlag), c.GlobalString(TLSKeyFlag)
+	if ca != "" || cert != "" || key != "" {
+		opts = append(opts, client.WithTLS(ca, cert, key))
+	}
+	if token := c.GlobalString(TokenFlag); token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+	if key := c.GlobalString(HMACKeyFlag); key != "" {
+		opts = append(opts, client.WithHMAC(key))
+	}
+	return client.NewClient(host, config.Version, opts...)
+}
+
 // DaemonMode returns true if we are running as daemon
 func DaemonMode(c *cli.Context) bool {
 	return c.GlobalBool(DaemonFlag)
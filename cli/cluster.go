@@ -3,12 +3,13 @@ package cli
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/codegangsta/cli"
 
 	"github.com/libopenstorage/openstorage/api"
-	"github.com/libopenstorage/openstorage/api/client"
 	"github.com/libopenstorage/openstorage/cluster"
 )
 
@@ -18,7 +19,7 @@ type clusterClient struct {
 }
 
 func (c *clusterClient) clusterOptions(context *cli.Context) {
-	clnt, err := client.NewClient("http://localhost:9001", "v1")
+	clnt, err := NewClient(context, "http://localhost:9001")
 	if err != nil {
 		fmt.Printf("Failed to initialize client library: %v\n", err)
 		os.Exit(1)
@@ -100,10 +101,122 @@ func (c *clusterClient) enumerate(context *cli.Context) {
 	}
 }
 
+// machines returns the nodes specified with the machine flag or as arguments.
+func machines(context *cli.Context) []api.Node {
+	ids := make([]string, 0)
+	if m := context.String("machine"); m != "" {
+		ids = append(ids, strings.Split(m, ",")...)
+	}
+	ids = append(ids, context.Args()...)
+
+	nodes := make([]api.Node, 0, len(ids))
+	for _, id := range ids {
+		if id = strings.TrimSpace(id); id != "" {
+			nodes = append(nodes, api.Node{Id: id})
+		}
+	}
+	return nodes
+}
+
 func (c *clusterClient) remove(context *cli.Context) {
+	fn := "remove"
+
+	nodes := machines(context)
+	if len(nodes) == 0 {
+		missingParameter(context, fn, "machine", "Machine IDs to remove from the cluster")
+		return
+	}
+
+	c.clusterOptions(context)
+	err := c.manager.Remove(nodes)
+	if err != nil {
+		cmdError(context, fn, err)
+		return
+	}
+
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.Id
+	}
+	fmtOutput(context, &Format{UUID: ids})
 }
 
 func (c *clusterClient) shutdown(context *cli.Context) {
+	fn := "shutdown"
+
+	// Shutdown the entire cluster if no machines are specified.
+	nodes := machines(context)
+	c.clusterOptions(context)
+	err := c.manager.Shutdown(len(nodes) == 0, nodes)
+	if err != nil {
+		cmdError(context, fn, err)
+		return
+	}
+
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.Id
+	}
+	fmtOutput(context, &Format{UUID: ids})
+}
+
+func (c *clusterClient) alerts(context *cli.Context) {
+	c.clusterOptions(context)
+	jsonOut := context.GlobalBool("json")
+	outFd := os.Stdout
+	fn := "alerts"
+
+	alerts, err := c.manager.EnumerateAlerts(api.ResourceType(context.String("type")), context.String("id"))
+	if err != nil {
+		cmdError(context, fn, err)
+		return
+	}
+
+	if !context.Bool("all") {
+		outstanding := make([]api.Alert, 0, len(alerts.Alerts))
+		for _, a := range alerts.Alerts {
+			if !a.Cleared {
+				outstanding = append(outstanding, a)
+			}
+		}
+		alerts.Alerts = outstanding
+	}
+
+	if jsonOut {
+		cmdOutput(context, alerts)
+	} else {
+		w := new(tabwriter.Writer)
+		w.Init(outFd, 12, 12, 1, ' ', 0)
+
+		fmt.Fprintln(w, "ID	 SEVERITY	 RESOURCE	 TIME	 CLEARED	 MESSAGE")
+		for _, a := range alerts.Alerts {
+			fmt.Fprintln(w, a.ID, "	", a.Severity, "	",
+				string(a.ResourceType)+"/"+a.ResourceID, "	",
+				a.Timestamp.Format(time.RFC3339), "	", a.Cleared, "	", a.Message)
+		}
+
+		fmt.Fprintln(w)
+		w.Flush()
+	}
+}
+
+func (c *clusterClient) clearAlert(context *cli.Context) {
+	fn := "clear-alert"
+
+	if len(context.Args()) < 1 {
+		missingParameter(context, fn, "alertID", "Invalid number of arguments")
+		return
+	}
+
+	c.clusterOptions(context)
+	for _, id := range context.Args() {
+		if err := c.manager.ClearAlert(id); err != nil {
+			cmdError(context, fn, err)
+			return
+		}
+	}
+
+	fmtOutput(context, &Format{UUID: context.Args()})
 }
 
 func (c *clusterClient) disableGossip(context *cli.Context) {
@@ -172,6 +285,34 @@ func ClusterCommands(name string) []cli.Command {
 				},
 			},
 		},
+		{
+			Name:    "alerts",
+			Aliases: []string{"a"},
+			Usage:   "List alerts raised in the cluster",
+			Action:  c.alerts,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "type,t",
+					Usage: "Resource type: Volume|Node|Cluster, all types if not specified",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "id,i",
+					Usage: "Resource ID, all resources of the type if not specified",
+					Value: "",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Include cleared alerts",
+				},
+			},
+		},
+		{
+			Name:    "clear-alert",
+			Aliases: []string{"ca"},
+			Usage:   "Clear the specified alerts",
+			Action:  c.clearAlert,
+		},
 		{
 			Name:   "shutdown",
 			Usage:  "Shutdown a cluster or a specific machine",
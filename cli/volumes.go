@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/codegangsta/cli"
@@ -50,7 +51,7 @@ func processLabels(s string) (api.Labels, error) {
 }
 
 func (v *volDriver) volumeOptions(context *cli.Context) {
-	clnt, err := client.NewDriverClient(v.name)
+	clnt, err := NewClient(context, client.DriverURL(v.name))
 	if err != nil {
 		fmt.Printf("Failed to initialize client library: %v\n", err)
 		os.Exit(1)
@@ -89,6 +90,9 @@ func (v *volDriver) volumeCreate(context *cli.Context) {
 		Cos:              api.VolumeCos(context.Int("cos")),
 		SnapshotInterval: context.Int("si"),
 	}
+	if retain := context.Int("snap_retain"); retain > 0 {
+		spec.ConfigLabels = api.Labels{api.SpecSnapshotRetain: strconv.Itoa(retain)}
+	}
 	source := &api.Source{
 		Seed: context.String("seed"),
 	}
@@ -146,6 +150,31 @@ func (v *volDriver) volumeUnmount(context *cli.Context) {
 	fmtOutput(context, &Format{UUID: []string{volumeID}})
 }
 
+func (v *volDriver) volumeResize(context *cli.Context) {
+	v.volumeOptions(context)
+	fn := "resize"
+
+	if len(context.Args()) < 1 {
+		missingParameter(context, fn, "volumeID", "Invalid number of arguments")
+		return
+	}
+	volumeID := context.Args()[0]
+
+	size := uint64(VolumeSzUnits(context.Int("s")) * MiB)
+	if size == 0 {
+		missingParameter(context, fn, "size", "New volume size in MB")
+		return
+	}
+
+	err := v.volDriver.Set(api.VolumeID(volumeID), nil, &api.VolumeSpec{Size: size})
+	if err != nil {
+		cmdError(context, fn, err)
+		return
+	}
+
+	fmtOutput(context, &Format{UUID: []string{volumeID}})
+}
+
 func (v *volDriver) volumeAttach(context *cli.Context) {
 	fn := "attach"
 	if len(context.Args()) < 1 {
@@ -220,6 +249,19 @@ func (v *volDriver) volumeStats(context *cli.Context) {
 	cmdOutput(context, stats)
 }
 
+func (v *volDriver) volumeCapacity(context *cli.Context) {
+	v.volumeOptions(context)
+	fn := "capacity"
+
+	capacity, err := v.volDriver.Capacity()
+	if err != nil {
+		cmdError(context, fn, err)
+		return
+	}
+
+	cmdOutput(context, capacity)
+}
+
 func (v *volDriver) volumeAlerts(context *cli.Context) {
 	v.volumeOptions(context)
 	fn := "alerts"
@@ -309,6 +351,25 @@ func (v *volDriver) snapCreate(context *cli.Context) {
 	fmtOutput(context, &Format{UUID: []string{string(id)}})
 }
 
+func (v *volDriver) snapRestore(context *cli.Context) {
+	fn := "restore"
+	if len(context.Args()) != 2 {
+		missingParameter(context, fn, "volumeID snapID", "Invalid number of arguments")
+		return
+	}
+	volumeID := api.VolumeID(context.Args()[0])
+	snapID := api.VolumeID(context.Args()[1])
+
+	v.volumeOptions(context)
+	err := v.volDriver.Restore(volumeID, snapID)
+	if err != nil {
+		cmdError(context, fn, err)
+		return
+	}
+
+	fmtOutput(context, &Format{UUID: []string{string(volumeID)}})
+}
+
 func (v *volDriver) snapEnumerate(context *cli.Context) {
 	var locator api.VolumeLocator
 	var err error
@@ -385,6 +446,11 @@ func baseVolumeCommand(v *volDriver) []cli.Command {
 					Usage: "snapshot interval in minutes, 0 disables snaps",
 					Value: 0,
 				},
+				cli.IntFlag{
+					Name:  "snap_retain",
+					Usage: "number of scheduled snapshots to keep, 0 keeps all",
+					Value: 0,
+				},
 			},
 		},
 		{
@@ -411,6 +477,17 @@ func baseVolumeCommand(v *volDriver) []cli.Command {
 				},
 			},
 		},
+		{
+			Name:   "resize",
+			Usage:  "Grow specified volume",
+			Action: v.volumeResize,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "size,s",
+					Usage: "new size in MB, must not be smaller than the current size",
+				},
+			},
+		},
 		{
 			Name:    "delete",
 			Aliases: []string{"rm"},
@@ -449,6 +526,11 @@ func baseVolumeCommand(v *volDriver) []cli.Command {
 			Usage:  "volume stats",
 			Action: v.volumeStats,
 		},
+		{
+			Name:   "capacity",
+			Usage:  "storage pool capacity",
+			Action: v.volumeCapacity,
+		},
 		{
 			Name:    "snap",
 			Aliases: []string{"sc"},
@@ -469,6 +551,11 @@ func baseVolumeCommand(v *volDriver) []cli.Command {
 				},
 			},
 		},
+		{
+			Name:   "restore",
+			Usage:  "Restore volume to snap, the volume must not be mounted",
+			Action: v.snapRestore,
+		},
 		{
 			Name:    "snapEnumerate",
 			Aliases: []string{"se"},
@@ -80,6 +80,13 @@ type Cluster interface {
 	// Shutdown node(s) or the entire cluster.
 	Shutdown(cluster bool, nodes []api.Node) error
 
+	// EnumerateAlerts lists alerts on the resource resourceID of the given
+	// type. Empty arguments match all resource types or resources.
+	EnumerateAlerts(resourceType api.ResourceType, resourceID string) (api.Alerts, error)
+
+	// ClearAlert marks the specified alert as cleared.
+	ClearAlert(alertID string) error
+
 	// Start starts the cluster manager and state machine.
 	// It also causes this node to join the cluster.
 	Start() error
@@ -7,7 +7,9 @@ import (
 	"container/list"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -15,13 +17,17 @@ import (
 	"github.com/libopenstorage/gossip"
 	"github.com/libopenstorage/gossip/types"
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/volume"
 
 	"github.com/portworx/kvdb"
 	"github.com/portworx/systemutils"
 )
 
 const (
-	heartbeatKey = "heartbeat"
+	heartbeatKey   = "heartbeat"
+	clusterLockKey = "cluster/lock"
+	shutdownKey    = "cluster/shutdown/"
 )
 
 type ClusterManager struct {
@@ -30,6 +36,7 @@ type ClusterManager struct {
 	kv        kvdb.Kvdb
 	status    api.Status
 	nodeCache map[string]api.Node // Cached info on the nodes in the cluster.
+	nodeLock  sync.Mutex          // Guards nodeCache.
 	docker    *docker.Client
 	g         gossip.Gossiper
 	gEnabled  bool
@@ -74,8 +81,15 @@ func externalIp() (string, error) {
 	return "", errors.New("Node not connected to the network.")
 }
 
+// NodeID returns the ID of this node in the cluster.
+func (c *ClusterManager) NodeID() string {
+	return c.config.NodeId
+}
+
 func (c *ClusterManager) LocateNode(nodeID string) (api.Node, error) {
+	c.nodeLock.Lock()
 	n, ok := c.nodeCache[nodeID]
+	c.nodeLock.Unlock()
 
 	if !ok {
 		return api.Node{}, errors.New("Unable to locate node with provided UUID.")
@@ -95,6 +109,9 @@ func (c *ClusterManager) UpdateNodeData(dataKey string, value interface{}) {
 }
 
 func (c *ClusterManager) GetClusterNodeData() map[string]*api.Node {
+	c.nodeLock.Lock()
+	defer c.nodeLock.Unlock()
+
 	nodes := make(map[string]*api.Node)
 	for _, value := range c.nodeCache {
 		nodes[value.Id] = &value
@@ -119,7 +136,10 @@ func (c *ClusterManager) getCurrentState() *api.Node {
 }
 
 func (c *ClusterManager) initNode(db *Database) (*api.Node, bool) {
-	c.nodeCache[c.selfNode.Id] = *c.getCurrentState()
+	self := *c.getCurrentState()
+	c.nodeLock.Lock()
+	c.nodeCache[c.selfNode.Id] = self
+	c.nodeLock.Unlock()
 
 	_, exists := db.NodeEntries[c.selfNode.Id]
 
@@ -205,9 +225,11 @@ done:
 }
 
 func (c *ClusterManager) heartBeat() {
-	for {
+	for c.status != api.StatusOffline {
 		node := c.getCurrentState()
+		c.nodeLock.Lock()
 		c.nodeCache[node.Id] = *node
+		c.nodeLock.Unlock()
 
 		c.g.UpdateSelf(types.StoreKey(heartbeatKey+c.config.ClusterId), *node)
 
@@ -226,10 +248,17 @@ func (c *ClusterManager) heartBeat() {
 				continue
 			}
 
+			c.nodeLock.Lock()
 			_, ok = c.nodeCache[n.Id]
+			if ok && n.Status == api.StatusOk && nodeInfo.Status != types.NODE_STATUS_DOWN {
+				c.nodeCache[n.Id] = n
+			}
+			c.nodeLock.Unlock()
 			if ok {
 				if n.Status != api.StatusOk {
 					logrus.Warn("Detected node ", n.Id, " to be unhealthy.")
+					alerts.Raise(api.AlertWarning, api.ResourceNode, n.Id,
+						"Node is unhealthy")
 
 					for e := c.listeners.Front(); e != nil && c.gEnabled; e = e.Next() {
 						err := e.Value.(ClusterListener).Update(&n)
@@ -238,9 +267,13 @@ func (c *ClusterManager) heartBeat() {
 						}
 					}
 
+					c.nodeLock.Lock()
 					delete(c.nodeCache, n.Id)
+					c.nodeLock.Unlock()
 				} else if nodeInfo.Status == types.NODE_STATUS_DOWN {
 					logrus.Warn("Detected node ", n.Id, " to be offline due to inactivity.")
+					alerts.Raise(api.AlertCritical, api.ResourceNode, n.Id,
+						"Node is offline due to inactivity")
 
 					n.Status = api.StatusOffline
 					for e := c.listeners.Front(); e != nil && c.gEnabled; e = e.Next() {
@@ -250,15 +283,24 @@ func (c *ClusterManager) heartBeat() {
 						}
 					}
 
+					c.nodeLock.Lock()
 					delete(c.nodeCache, n.Id)
-				} else {
-					c.nodeCache[n.Id] = n
+					c.nodeLock.Unlock()
 				}
 			} else if nodeInfo.Status == types.NODE_STATUS_UP {
+				// A node that was removed from the cluster may still be
+				// gossiping, only admit nodes present in the database.
+				if !c.inDatabase(n.Id) {
+					continue
+				}
+
 				// A node discovered in the cluster.
 				logrus.Warn("Detected node ", n.Id, " to be in the cluster.")
+				alerts.ClearResource(api.ResourceNode, n.Id)
 
+				c.nodeLock.Lock()
 				c.nodeCache[n.Id] = n
+				c.nodeLock.Unlock()
 				for e := c.listeners.Front(); e != nil && c.gEnabled; e = e.Next() {
 					err := e.Value.(ClusterListener).Add(&n)
 					if err != nil {
@@ -270,6 +312,74 @@ func (c *ClusterManager) heartBeat() {
 
 		time.Sleep(2 * time.Second)
 	}
+	logrus.Info("Heartbeat stopped, node ", c.config.NodeId, " has left the cluster.")
+}
+
+// inDatabase returns true if the node is registered in the cluster database.
+func (c *ClusterManager) inDatabase(nodeID string) bool {
+	db, err := readDatabase()
+	if err != nil {
+		return false
+	}
+	_, ok := db.NodeEntries[nodeID]
+	return ok
+}
+
+// attachedVolumes returns the volumes, across all volume drivers, that are
+// attached on the specified node.
+func attachedVolumes(nodeID string) []api.VolumeID {
+	attached := make([]api.VolumeID, 0)
+	for _, d := range volume.Instances() {
+		vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+		if err != nil {
+			logrus.Warnf("Failed to enumerate volumes for %s: %v", d.String(), err)
+			continue
+		}
+		for _, v := range vols {
+			if v.AttachedOn == api.MachineID(nodeID) {
+				attached = append(attached, v.ID)
+			}
+		}
+	}
+	return attached
+}
+
+// watchShutdown is called when a shutdown of this node is requested through
+// the KV store.
+func (c *ClusterManager) watchShutdown(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+	if err != nil || kvp == nil || kvp.Action == kvdb.KVDelete {
+		return err
+	}
+
+	logrus.Warn("Received a request to shutdown node ", c.config.NodeId)
+	kvdb.Instance().Delete(kvp.Key)
+	c.leave()
+
+	// Stop watching, this node is no longer part of the cluster.
+	return errors.New("Node has left the cluster.")
+}
+
+// leave alerts all listeners that this node is leaving the cluster and stops
+// participating in the gossip protocol.
+func (c *ClusterManager) leave() {
+	if c.status == api.StatusOffline {
+		return
+	}
+
+	for e := c.listeners.Front(); e != nil; e = e.Next() {
+		err := e.Value.(ClusterListener).Leave(&c.selfNode)
+		if err != nil {
+			logrus.Warnf("Failed to notify %s of shutdown: %v",
+				e.Value.(ClusterListener).String(), err)
+		}
+	}
+
+	c.status = api.StatusOffline
+	c.selfNode.Status = api.StatusOffline
+	if c.g != nil {
+		c.g.UpdateSelf(types.StoreKey(heartbeatKey+c.config.ClusterId), c.selfNode)
+		c.g.Stop()
+	}
 }
 
 func (c *ClusterManager) DisableGossipUpdates() {
@@ -298,7 +408,7 @@ func (c *ClusterManager) Start() error {
 	c.selfNode.Ip, _ = externalIp()
 	c.selfNode.NodeData = make(map[string]interface{})
 
-	kvlock, err := kvdb.Lock("cluster/lock", 60)
+	kvlock, err := kvdb.Lock(clusterLockKey, 60)
 	if err != nil {
 		logrus.Panic("Fatal, Unable to obtain cluster lock.", err)
 	}
@@ -360,6 +470,13 @@ func (c *ClusterManager) Start() error {
 		logrus.Panic(err)
 	}
 
+	// Discard a stale shutdown request and watch for new ones.
+	kvdb.Delete(shutdownKey + c.config.NodeId)
+	err = kvdb.WatchKey(shutdownKey+c.config.NodeId, 0, nil, c.watchShutdown)
+	if err != nil {
+		logrus.Warnf("Unable to watch for shutdown requests: %v", err)
+	}
+
 	// Start heartbeating to other nodes.
 	c.g.Start()
 	go c.heartBeat()
@@ -370,6 +487,9 @@ func (c *ClusterManager) Start() error {
 func (c *ClusterManager) Enumerate() (api.Cluster, error) {
 	i := 0
 
+	c.nodeLock.Lock()
+	defer c.nodeLock.Unlock()
+
 	cluster := api.Cluster{Id: c.config.ClusterId, Status: c.status}
 	cluster.Nodes = make([]api.Node, len(c.nodeCache))
 	for _, n := range c.nodeCache {
@@ -380,12 +500,122 @@ func (c *ClusterManager) Enumerate() (api.Cluster, error) {
 	return cluster, nil
 }
 
+// Remove node(s) from the cluster permanently.  A node cannot be removed
+// while it has volumes attached to it.
 func (c *ClusterManager) Remove(nodes []api.Node) error {
-	// TODO
+	kvdb := kvdb.Instance()
+
+	kvlock, err := kvdb.Lock(clusterLockKey, 60)
+	if err != nil {
+		logrus.Warn("Unable to obtain cluster lock for remove: ", err)
+		return err
+	}
+	defer kvdb.Unlock(kvlock)
+
+	db, err := readDatabase()
+	if err != nil {
+		return err
+	}
+
+	// Validate all nodes before modifying the cluster.
+	for _, n := range nodes {
+		if n.Id == c.config.NodeId {
+			return fmt.Errorf("Cannot remove node %s from itself, shut it down first.", n.Id)
+		}
+		if _, ok := db.NodeEntries[n.Id]; !ok {
+			return fmt.Errorf("Node %s is not part of the cluster.", n.Id)
+		}
+		if vols := attachedVolumes(n.Id); len(vols) != 0 {
+			return fmt.Errorf("Node %s has %d volume(s) attached: %v",
+				n.Id, len(vols), vols)
+		}
+	}
+
+	removed := make([]NodeEntry, 0, len(nodes))
+	for _, n := range nodes {
+		removed = append(removed, db.NodeEntries[n.Id])
+		delete(db.NodeEntries, n.Id)
+	}
+
+	err = writeDatabase(&db)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range removed {
+		c.nodeLock.Lock()
+		node, ok := c.nodeCache[entry.Id]
+		c.nodeLock.Unlock()
+		if !ok {
+			node = api.Node{Id: entry.Id, Ip: entry.Ip}
+		}
+		node.Status = api.StatusOffline
+
+		logrus.Infof("Removing node %s with IP %s from the cluster.", entry.Id, entry.Ip)
+		for e := c.listeners.Front(); e != nil; e = e.Next() {
+			err := e.Value.(ClusterListener).Remove(&node)
+			if err != nil {
+				logrus.Warnf("Failed to notify %s of node removal: %v",
+					e.Value.(ClusterListener).String(), err)
+			}
+		}
+
+		// Stop gossiping with this node.
+		if c.g != nil {
+			c.g.RemoveNode(entry.Ip + ":9002")
+		}
+		c.nodeLock.Lock()
+		delete(c.nodeCache, entry.Id)
+		c.nodeLock.Unlock()
+	}
+
 	return nil
 }
 
+// Shutdown node(s) or the entire cluster.  Remote nodes are asked to leave
+// the cluster through the KV store.
 func (c *ClusterManager) Shutdown(cluster bool, nodes []api.Node) error {
-	// TODO
+	kvdb := kvdb.Instance()
+
+	if cluster {
+		db, err := readDatabase()
+		if err != nil {
+			return err
+		}
+		nodes = make([]api.Node, 0, len(db.NodeEntries))
+		for id, n := range db.NodeEntries {
+			nodes = append(nodes, api.Node{Id: id, Ip: n.Ip})
+		}
+	}
+
+	self := false
+	for _, n := range nodes {
+		if n.Id == c.config.NodeId {
+			self = true
+			continue
+		}
+		logrus.Info("Requesting shutdown of node ", n.Id)
+		if _, err := kvdb.Put(shutdownKey+n.Id, []byte(c.config.NodeId), 0); err != nil {
+			logrus.Warnf("Failed to request shutdown of node %s: %v", n.Id, err)
+			return err
+		}
+	}
+
+	// Shut ourselves down last so that all requests are delivered.
+	if self {
+		c.leave()
+	}
+
 	return nil
 }
+
+// EnumerateAlerts lists alerts on the resource resourceID of the given type.
+// Empty arguments match all resource types or resources.
+func (c *ClusterManager) EnumerateAlerts(resourceType api.ResourceType, resourceID string) (api.Alerts, error) {
+	return alerts.Enumerate(resourceType, resourceID)
+}
+
+// ClearAlert marks the specified alert as cleared.
+func (c *ClusterManager) ClearAlert(alertID string) error {
+	return alerts.Clear(alertID)
+}
@@ -87,12 +87,13 @@ func start(c *cli.Context) {
 			logrus.Warnf("Unable to start volume driver: %v, %v", d, err)
 			return
 		}
-		err = server.StartServerAPI(d, 0, config.DriverAPIBase)
+		err = server.StartServerAPI(d, cfg.Osd.Rest.Ports[d], config.DriverAPIBase,
+			&cfg.Osd.Rest, &cfg.Osd.Policy)
 		if err != nil {
 			logrus.Warnf("Unable to start volume driver: %v", err)
 			return
 		}
-		err = server.StartPluginAPI(d, config.PluginAPIBase)
+		err = server.StartPluginAPI(d, config.PluginAPIBase, &cfg.Osd.Policy)
 		if err != nil {
 			logrus.Warnf("Unable to start volume plugin: %v", err)
 			return
@@ -109,6 +110,9 @@ func start(c *cli.Context) {
 		}
 	}
 
+	// Take scheduled snapshots of volumes with a snapshot interval.
+	volume.NewSnapScheduler(kv, volume.SnapSchedulePeriod).Start()
+
 	if cm != nil {
 		err = cm.Start()
 		if err != nil {
@@ -161,6 +165,7 @@ func main() {
 			Value: "",
 		},
 	}
+	app.Flags = append(app.Flags, osdcli.ClientFlags()...)
 	app.Action = start
 
 	app.Commands = []cli.Command{
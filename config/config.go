@@ -13,10 +13,62 @@ import (
 
 type osd struct {
 	ClusterConfig cluster.Config `yaml:"cluster"`
+	Rest          Rest           `yaml:"rest"`
+	Policy        Policy         `yaml:"policy"`
 	Drivers       map[string]volume.DriverParams
 	GraphDrivers  map[string]volume.DriverParams
 }
 
+// Rest configures the TCP listeners of the driver REST APIs. The APIs are
+// always served on unix sockets without TLS or authentication.
+type Rest struct {
+	// Ports the API of each driver listens on, by driver name.
+	Ports map[string]int `yaml:"ports"`
+	// CertFile and KeyFile enable TLS with the server certificate.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile requires clients to present a certificate signed by
+	// the CA.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// Token requires requests to carry it as a bearer token.
+	Token string `yaml:"token"`
+	// HMACKey requires requests to be signed with the key. Requests are
+	// accepted with either the token or a signature if both are set.
+	// Requests authenticated with the token or the key are not restricted
+	// by the policy.
+	HMACKey string `yaml:"hmac_key"`
+}
+
+// Policy authorizes the requests of users to the REST and Docker plugin
+// APIs. Requests on the unix socket of the REST API are not restricted.
+type Policy struct {
+	// Roles by name.
+	Roles map[string]Role `yaml:"roles"`
+	// Users by name. Users authenticate on the TCP listeners with their
+	// own token or HMAC key.
+	Users map[string]User `yaml:"users"`
+	// DockerUser is the user the requests of the Docker plugin API are
+	// made as. The plugin API is not restricted if it is empty.
+	DockerUser string `yaml:"docker_user"`
+}
+
+// Role allows verbs on volumes with labels.
+type Role struct {
+	// Verbs allowed by the role, or "*" for all verbs.
+	Verbs []string `yaml:"verbs"`
+	// Labels the volumes must have. The value UserLabel is replaced by
+	// the name of the user. Volumes created with the role are given the
+	// labels.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// User is granted the verbs of its roles.
+type User struct {
+	Token   string   `yaml:"token"`
+	HMACKey string   `yaml:"hmac_key"`
+	Roles   []string `yaml:"roles"`
+}
+
 type Config struct {
 	Osd osd
 }
@@ -30,6 +82,8 @@ const (
 	MountBase          = "/var/lib/osd/mounts/"
 	DataDir            = ".data"
 	Version            = "v1"
+	// UserLabel is replaced by the name of the user in role labels.
+	UserLabel = "$user"
 )
 
 var (
@@ -0,0 +1,168 @@
+// Package alerts records alerts raised against volumes, nodes and the
+// cluster in the cluster wide key-value store.
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/pborman/uuid"
+	"github.com/portworx/kvdb"
+)
+
+const (
+	alertsKey = "alerts/"
+	// clearedRetention is how long cleared alerts are kept.
+	clearedRetention = 24 * time.Hour
+)
+
+var (
+	// ErrNotFound is returned if the alert does not exist.
+	ErrNotFound = errors.New("Alert does not exist")
+)
+
+// resourceKey is the prefix of the alerts on a resource. Resource IDs are
+// escaped, and prefixed so that empty IDs do not produce empty segments.
+// Segments starting with an underscore are hidden by etcd.
+func resourceKey(resourceType api.ResourceType, resourceID string) string {
+	return alertsKey + string(resourceType) + "/id." + url.QueryEscape(resourceID) + "/"
+}
+
+func alertKey(a *api.Alert) string {
+	return resourceKey(a.ResourceType, a.ResourceID) + a.ID
+}
+
+// byTimestamp sorts alerts in the order they were raised.
+type byTimestamp []api.Alert
+
+func (a byTimestamp) Len() int           { return len(a) }
+func (a byTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTimestamp) Less(i, j int) bool { return a[i].Timestamp.Before(a[j].Timestamp) }
+
+// Raise records an alert against the specified resource and returns its ID.
+// If an identical alert is already outstanding, its ID is returned instead
+// of raising a new one.
+func Raise(
+	severity api.AlertSeverity,
+	resourceType api.ResourceType,
+	resourceID string,
+	message string) (string, error) {
+
+	outstanding, err := Enumerate(resourceType, resourceID)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range outstanding.Alerts {
+		if !a.Cleared && a.Severity == severity && a.Message == message {
+			return a.ID, nil
+		}
+	}
+	prune(outstanding.Alerts)
+
+	a := api.Alert{
+		ID:           uuid.New(),
+		Severity:     severity,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Timestamp:    time.Now(),
+		Message:      message,
+	}
+	if _, err := kvdb.Instance().Create(alertKey(&a), &a, 0); err != nil {
+		logrus.Warnf("Failed to raise alert %q on %v %v: %v",
+			message, resourceType, resourceID, err)
+		return "", err
+	}
+	logrus.Warnf("%v alert on %v %v: %v", severity, resourceType, resourceID, message)
+	return a.ID, nil
+}
+
+// prune deletes the alerts that were cleared longer than clearedRetention
+// ago.
+func prune(alerts []api.Alert) {
+	for i := range alerts {
+		a := &alerts[i]
+		if a.Cleared && time.Since(a.ClearedTime) > clearedRetention {
+			kvdb.Instance().Delete(alertKey(a))
+		}
+	}
+}
+
+// Clear marks the specified alert as cleared.
+func Clear(id string) error {
+	all, err := Enumerate("", "")
+	if err != nil {
+		return err
+	}
+	for _, a := range all.Alerts {
+		if a.ID == id {
+			return clear(&a)
+		}
+	}
+	return ErrNotFound
+}
+
+func clear(a *api.Alert) error {
+	a.Cleared = true
+	a.ClearedTime = time.Now()
+	_, err := kvdb.Instance().Put(alertKey(a), a, 0)
+	return err
+}
+
+// ClearResource marks all alerts on the specified resource as cleared.
+func ClearResource(resourceType api.ResourceType, resourceID string) error {
+	outstanding, err := Enumerate(resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	for _, a := range outstanding.Alerts {
+		if a.Cleared {
+			continue
+		}
+		if err := clear(&a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enumerate returns alerts in the order they were raised. An empty
+// resourceType or resourceID matches all resource types or resources.
+func Enumerate(resourceType api.ResourceType, resourceID string) (api.Alerts, error) {
+	alerts := api.Alerts{Alerts: make([]api.Alert, 0)}
+	prefix := alertsKey
+	if resourceType != "" {
+		prefix += string(resourceType) + "/"
+		if resourceID != "" {
+			prefix = resourceKey(resourceType, resourceID)
+		}
+	}
+	kvp, err := kvdb.Instance().Enumerate(prefix)
+	if err != nil {
+		if err == kvdb.ErrNotFound {
+			// No alerts raised yet.
+			return alerts, nil
+		}
+		return alerts, err
+	}
+	for _, v := range kvp {
+		var a api.Alert
+		if err := json.Unmarshal(v.Value, &a); err != nil {
+			logrus.Warnf("Failed to decode alert %v: %v", v.Key, err)
+			continue
+		}
+		if resourceType != "" && a.ResourceType != resourceType {
+			continue
+		}
+		if resourceID != "" && a.ResourceID != resourceID {
+			continue
+		}
+		alerts.Alerts = append(alerts.Alerts, a)
+	}
+	sort.Sort(byTimestamp(alerts.Alerts))
+	return alerts, nil
+}
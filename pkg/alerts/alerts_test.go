@@ -0,0 +1,93 @@
+package alerts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	kv, err := kvdb.New(mem.Name, "alerts_test", []string{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	kvdb.SetInstance(kv)
+}
+
+func TestRaiseClear(t *testing.T) {
+	id, err := Raise(api.AlertWarning, api.ResourceVolume, "vol1", "Volume is full")
+	assert.NoError(t, err, "Failed to raise alert")
+	assert.NotEmpty(t, id)
+
+	dup, err := Raise(api.AlertWarning, api.ResourceVolume, "vol1", "Volume is full")
+	assert.NoError(t, err, "Failed to raise alert")
+	assert.Equal(t, id, dup, "Outstanding alert should not be raised again")
+
+	_, err = Raise(api.AlertCritical, api.ResourceNode, "node1", "Node is offline")
+	assert.NoError(t, err, "Failed to raise alert")
+
+	alerts, err := Enumerate(api.ResourceVolume, "")
+	assert.NoError(t, err, "Failed to enumerate alerts")
+	assert.Equal(t, 1, len(alerts.Alerts))
+	assert.Equal(t, "vol1", alerts.Alerts[0].ResourceID)
+
+	alerts, err = Enumerate("", "")
+	assert.NoError(t, err, "Failed to enumerate alerts")
+	assert.Equal(t, 2, len(alerts.Alerts))
+
+	err = Clear(id)
+	assert.NoError(t, err, "Failed to clear alert")
+	alerts, err = Enumerate(api.ResourceVolume, "vol1")
+	assert.NoError(t, err, "Failed to enumerate alerts")
+	assert.True(t, alerts.Alerts[0].Cleared, "Alert should be cleared")
+
+	again, err := Raise(api.AlertWarning, api.ResourceVolume, "vol1", "Volume is full")
+	assert.NoError(t, err, "Failed to raise alert")
+	assert.NotEqual(t, id, again, "Cleared alert should be raised again")
+
+	err = ClearResource(api.ResourceNode, "node1")
+	assert.NoError(t, err, "Failed to clear node alerts")
+	alerts, err = Enumerate(api.ResourceNode, "node1")
+	assert.NoError(t, err, "Failed to enumerate alerts")
+	assert.True(t, alerts.Alerts[0].Cleared, "Alert should be cleared")
+
+	assert.Equal(t, ErrNotFound, Clear("nonexistent"))
+}
+
+func TestPrune(t *testing.T) {
+	old := api.Alert{
+		ID:           "old",
+		ResourceType: api.ResourceVolume,
+		ResourceID:   "vol2",
+		Timestamp:    time.Now().Add(-3 * clearedRetention),
+		Cleared:      true,
+		ClearedTime:  time.Now().Add(-2 * clearedRetention),
+	}
+	_, err := kvdb.Instance().Create(alertKey(&old), &old, 0)
+	assert.NoError(t, err, "Failed to create alert")
+	recent := api.Alert{
+		ID:           "recent",
+		ResourceType: api.ResourceVolume,
+		ResourceID:   "vol2",
+		Timestamp:    time.Now().Add(-2 * clearedRetention),
+	}
+	_, err = kvdb.Instance().Create(alertKey(&recent), &recent, 0)
+	assert.NoError(t, err, "Failed to create alert")
+	assert.NoError(t, Clear("recent"), "Failed to clear alert")
+
+	_, err = Raise(api.AlertWarning, api.ResourceVolume, "vol2", "Volume is full")
+	assert.NoError(t, err, "Failed to raise alert")
+	alerts, err := Enumerate(api.ResourceVolume, "vol2")
+	assert.NoError(t, err, "Failed to enumerate alerts")
+	if assert.Equal(t, 2, len(alerts.Alerts), "Old cleared alerts must be pruned") {
+		assert.Equal(t, "recent", alerts.Alerts[0].ID, "Recently cleared alerts must be kept")
+	}
+
+	alerts, err = Enumerate(api.ResourceVolume, "vol")
+	assert.NoError(t, err, "Failed to enumerate alerts")
+	assert.Empty(t, alerts.Alerts, "Resource IDs must match exactly")
+}
@@ -0,0 +1,137 @@
+// Package auth authenticates REST requests with a bearer token or an HMAC
+// signature computed with a shared key.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthorizationHeader carries the token or signature of a request.
+	AuthorizationHeader = "Authorization"
+	// DateHeader carries the time a request was signed at, in RFC 3339.
+	DateHeader = "X-Osd-Date"
+	// BearerScheme authenticates requests with a token.
+	BearerScheme = "Bearer"
+	// HMACScheme authenticates requests with a signature.
+	HMACScheme = "HMAC-SHA256"
+	// MaxSkew is the largest difference between the date of a signed
+	// request and the time it is verified at.
+	MaxSkew = 5 * time.Minute
+	// MaxBodySize is the largest body of a signed request, which is read
+	// before the request is authenticated. It fits the largest write of
+	// the io endpoint, base64 encoded in JSON.
+	MaxBodySize = 8 << 20
+)
+
+var (
+	// ErrUnauthorized is returned for requests without valid credentials.
+	ErrUnauthorized = errors.New("Missing or invalid credentials")
+)
+
+// Signature returns the hex encoded HMAC-SHA256 with key of the method, the
+// request URI (path and query), the date and the SHA-256 of the body.
+func Signature(key []byte, method string, uri string, date string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + uri + "\n" + date + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetToken authenticates r with token.
+func SetToken(r *http.Request, token string) {
+	r.Header.Set(AuthorizationHeader, BearerScheme+" "+token)
+}
+
+// Sign authenticates r, whose body is body, with a signature computed
+// with key.
+func Sign(r *http.Request, key []byte, body []byte) {
+	date := time.Now().UTC().Format(time.RFC3339)
+	r.Header.Set(DateHeader, date)
+	r.Header.Set(AuthorizationHeader, HMACScheme+" "+
+		Signature(key, r.Method, r.URL.RequestURI(), date, body))
+}
+
+// Credentials authenticate a user with a token, a key or both. Either may
+// be empty to disable the scheme.
+type Credentials struct {
+	Token string
+	Key   string
+}
+
+// Authenticator verifies the credentials of requests.
+type Authenticator struct {
+	users map[string]Credentials
+	now   func() time.Time
+}
+
+// New returns an Authenticator accepting requests with the credentials of
+// users, by user name. New returns nil if no user has credentials.
+func New(users map[string]Credentials) *Authenticator {
+	a := &Authenticator{users: make(map[string]Credentials), now: time.Now}
+	for user, c := range users {
+		if c.Token != "" || c.Key != "" {
+			a.users[user] = c
+		}
+	}
+	if len(a.users) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Verify returns the user whose token r carries or whose key r is signed
+// with, or ErrUnauthorized. The body of signed requests is read and
+// replaced, bodies over MaxBodySize fail.
+func (a *Authenticator) Verify(r *http.Request) (string, error) {
+	var scheme, credentials string
+	if f := strings.SplitN(r.Header.Get(AuthorizationHeader), " ", 2); len(f) == 2 {
+		scheme, credentials = f[0], f[1]
+	}
+	switch scheme {
+	case BearerScheme:
+		for user, c := range a.users {
+			if c.Token != "" &&
+				subtle.ConstantTimeCompare([]byte(credentials), []byte(c.Token)) == 1 {
+				return user, nil
+			}
+		}
+	case HMACScheme:
+		date := r.Header.Get(DateHeader)
+		t, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return "", ErrUnauthorized
+		}
+		if skew := a.now().Sub(t); skew > MaxSkew || skew < -MaxSkew {
+			return "", ErrUnauthorized
+		}
+		var body []byte
+		if r.Body != nil {
+			body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MaxBodySize))
+			if err != nil {
+				return "", err
+			}
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		for user, c := range a.users {
+			if c.Key == "" {
+				continue
+			}
+			expected := Signature([]byte(c.Key), r.Method, r.URL.RequestURI(), date, body)
+			if hmac.Equal([]byte(credentials), []byte(expected)) {
+				return user, nil
+			}
+		}
+	}
+	return "", ErrUnauthorized
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRequest(t *testing.T, body string) *http.Request {
+	r, err := http.NewRequest("PUT", "http://localhost/v1/volumes/vol1?Label=a", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	return r
+}
+
+func TestNew(t *testing.T) {
+	assert.Nil(t, New(nil), "Authentication must be disabled without credentials")
+	assert.Nil(t, New(map[string]Credentials{"a": {}}))
+}
+
+// verify returns the error of a.Verify(r).
+func verify(a *Authenticator, r *http.Request) error {
+	_, err := a.Verify(r)
+	return err
+}
+
+func TestToken(t *testing.T) {
+	a := New(map[string]Credentials{"": {Token: "secret"}})
+	r := newRequest(t, "")
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Requests without token must fail")
+	SetToken(r, "wrong")
+	assert.Equal(t, ErrUnauthorized, verify(a, r))
+	SetToken(r, "secret")
+	assert.NoError(t, verify(a, r))
+
+	Sign(r, []byte("secret"), nil)
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Signatures must fail without a key")
+}
+
+func TestHMAC(t *testing.T) {
+	a := New(map[string]Credentials{"": {Key: "key"}})
+	body := `{"spec":{"size":1024}}`
+	r := newRequest(t, body)
+	Sign(r, []byte("key"), []byte(body))
+	assert.NoError(t, verify(a, r))
+	b := new(bytes.Buffer)
+	b.ReadFrom(r.Body)
+	assert.Equal(t, body, b.String(), "Body must be readable after verification")
+
+	r = newRequest(t, `{"spec":{"size":1}}`)
+	Sign(r, []byte("key"), []byte(body))
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Modified body must fail")
+
+	r = newRequest(t, body)
+	Sign(r, []byte("other"), []byte(body))
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Wrong key must fail")
+
+	r = newRequest(t, body)
+	Sign(r, []byte("key"), []byte(body))
+	a.now = func() time.Time { return time.Now().Add(2 * MaxSkew) }
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Replayed request must fail")
+
+	SetToken(r, "key")
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Tokens must fail without a token")
+
+	a.now = time.Now
+	big := strings.Repeat("a", MaxBodySize+1)
+	r = newRequest(t, big)
+	Sign(r, []byte("key"), []byte(big))
+	assert.Error(t, verify(a, r), "Bodies over the limit must fail")
+}
+
+func TestUsers(t *testing.T) {
+	a := New(map[string]Credentials{
+		"":      {Token: "admin"},
+		"alice": {Token: "alice"},
+		"bob":   {Key: "bob"},
+	})
+	r := newRequest(t, "")
+	SetToken(r, "alice")
+	user, err := a.Verify(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user)
+	SetToken(r, "admin")
+	user, err = a.Verify(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "", user)
+	Sign(r, []byte("bob"), nil)
+	user, err = a.Verify(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", user)
+	SetToken(r, "bob")
+	assert.Equal(t, ErrUnauthorized, verify(a, r), "Keys are not tokens")
+}
@@ -0,0 +1,43 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrNotSupported is returned if the filesystem cannot be grown online.
+	ErrNotSupported = errors.New("Filesystem resize not supported")
+)
+
+// Grow expands the filesystem of the given format on devicePath to fill
+// the underlying device. Filesystems that can only be grown while mounted
+// require mountPath to be set.
+func Grow(format string, devicePath string, mountPath string) error {
+	var cmd *exec.Cmd
+
+	switch {
+	case format == "" || format == "none":
+		return nil
+	case strings.HasPrefix(format, "ext"):
+		cmd = exec.Command("/sbin/resize2fs", devicePath)
+	case format == "xfs":
+		if mountPath == "" {
+			return fmt.Errorf("xfs on %v must be mounted to be grown", devicePath)
+		}
+		cmd = exec.Command("/sbin/xfs_growfs", mountPath)
+	case format == "btrfs":
+		if mountPath == "" {
+			return fmt.Errorf("btrfs on %v must be mounted to be grown", devicePath)
+		}
+		cmd = exec.Command("/sbin/btrfs", "filesystem", "resize", "max", mountPath)
+	default:
+		return ErrNotSupported
+	}
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to run %v: %v (%s)", cmd.Args, err, o)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// Package fscopy copies files and file trees for volume drivers that implement
+// snapshots and clones by copying. Mode, ownership, modification times and
+// extended attributes are preserved, symbolic and hard links are recreated
+// and sparse files are kept sparse.
+package fscopy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Defined in <linux/fs.h>:
+	FICLONE = 0x40049409
+	// Defined in <unistd.h>:
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+
+	blockSize = 4096
+	bufSize   = 1 << 20
+)
+
+// Progress is called as data is copied with the total number of bytes
+// copied so far.
+type Progress func(copied int64)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+type copier struct {
+	progress Progress
+	copied   int64
+	// links maps source inodes with more than one link to the first
+	// destination path they were copied to.
+	links map[inode]string
+}
+
+// File copies the file source to dest, replacing dest if it exists. If
+// source is a symbolic link, the link is copied rather than its target.
+// progress may be nil.
+func File(source string, dest string, progress Progress) error {
+	c := &copier{progress: progress}
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	return c.copy(source, dest, fi)
+}
+
+// Dir recursively copies the directory source to dest, which is created if
+// it does not exist. Hard links within source are preserved. progress may
+// be nil.
+func Dir(source string, dest string, progress Progress) error {
+	c := &copier{progress: progress, links: make(map[inode]string)}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "copy", Path: source, Err: syscall.ENOTDIR}
+	}
+	return c.copy(source, dest, fi)
+}
+
+func (c *copier) copy(source string, dest string, fi os.FileInfo) error {
+	st, _ := fi.Sys().(*syscall.Stat_t)
+	if c.links != nil && st != nil && st.Nlink > 1 && !fi.IsDir() {
+		key := inode{dev: uint64(st.Dev), ino: st.Ino}
+		if first, ok := c.links[key]; ok {
+			os.Remove(dest)
+			return os.Link(first, dest)
+		}
+		c.links[key] = dest
+	}
+
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		if err := c.dir(source, dest, fi); err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		if err := c.file(source, dest, fi); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+		// Only the ownership of a symbolic link can be changed.
+		if st != nil {
+			return os.Lchown(dest, int(st.Uid), int(st.Gid))
+		}
+		return nil
+	case mode&(os.ModeDevice|os.ModeNamedPipe) != 0 && st != nil:
+		os.Remove(dest)
+		if err := syscall.Mknod(dest, st.Mode, int(st.Rdev)); err != nil {
+			return &os.PathError{Op: "mknod", Path: dest, Err: err}
+		}
+	default:
+		// Sockets belong to the process that created them.
+		return nil
+	}
+	return copyAttrs(source, dest, fi)
+}
+
+func (c *copier) dir(source string, dest string, fi os.FileInfo) error {
+	// Create dest writable so it can be filled, its mode is set last.
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	d, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	entries, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := c.copy(filepath.Join(source, entry.Name()), filepath.Join(dest, entry.Name()), entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) file(source string, dest string, fi os.FileInfo) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = c.contents(in, out, fi.Size()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// contents copies size bytes from in to out. A reflink is tried first,
+// otherwise only the data extents of in are copied and blocks of zeros are
+// skipped, so that holes in in remain holes in out.
+func (c *copier) contents(in *os.File, out *os.File, size int64) error {
+	if ioctl(out.Fd(), FICLONE, in.Fd()) == nil {
+		c.report(size)
+		return nil
+	}
+
+	buf := make([]byte, bufSize)
+	zero := make([]byte, blockSize)
+	fd := int(in.Fd())
+	for off := int64(0); off < size; {
+		data, err := syscall.Seek(fd, off, SEEK_DATA)
+		if err == syscall.ENXIO {
+			// No data past off.
+			break
+		} else if err != nil {
+			// SEEK_DATA is not supported, copy everything.
+			data = off
+		}
+		hole, err := syscall.Seek(fd, data, SEEK_HOLE)
+		if err != nil || hole > size {
+			hole = size
+		}
+		for data < hole {
+			n, err := in.ReadAt(buf[:min(int64(len(buf)), hole-data)], data)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				// source was truncated while being copied.
+				break
+			}
+			for i := 0; i < n; i += blockSize {
+				end := i + blockSize
+				if end > n {
+					end = n
+				}
+				if bytes.Equal(buf[i:end], zero[:end-i]) {
+					continue
+				}
+				if _, err := out.WriteAt(buf[i:end], data+int64(i)); err != nil {
+					return err
+				}
+			}
+			data += int64(n)
+			c.report(int64(n))
+		}
+		off = hole
+	}
+	return out.Truncate(size)
+}
+
+func (c *copier) report(n int64) {
+	c.copied += n
+	if c.progress != nil {
+		c.progress(c.copied)
+	}
+}
+
+// copyAttrs copies the ownership, extended attributes, mode and modification
+// time of source to dest. The mode is set after the ownership because chown
+// clears the setuid and setgid bits.
+func copyAttrs(source string, dest string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := copyXattrs(source, dest); err != nil {
+		return err
+	}
+	if err := os.Chmod(dest, fi.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+}
+
+func copyXattrs(source string, dest string) error {
+	sz, err := syscall.Listxattr(source, nil)
+	if err == syscall.ENOTSUP || (err == nil && sz <= 0) {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "listxattr", Path: source, Err: err}
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(source, buf); err != nil {
+		return &os.PathError{Op: "listxattr", Path: source, Err: err}
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00") {
+		n, err := syscall.Getxattr(source, name, nil)
+		if err != nil {
+			return &os.PathError{Op: "getxattr " + name, Path: source, Err: err}
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(source, name, value); err != nil {
+			return &os.PathError{Op: "getxattr " + name, Path: source, Err: err}
+		}
+		if err = syscall.Setxattr(dest, name, value[:n], 0); err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: dest, Err: err}
+		}
+	}
+	return nil
+}
+
+func ioctl(a1, a2, a3 uintptr) (err error) {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a1, a2, a3)
+	if errno != 0 {
+		err = errno
+	}
+	return err
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,105 @@
+package fscopy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setup(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "copy_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestFileSparse(t *testing.T) {
+	dir := setup(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	f, err := os.Create(source)
+	assert.NoError(t, err, "Failed to create source")
+	assert.NoError(t, f.Truncate(64<<20))
+	_, err = f.WriteAt([]byte("data"), 32<<20)
+	assert.NoError(t, err, "Failed to write source")
+	f.Close()
+
+	var copied int64
+	dest := filepath.Join(dir, "dest")
+	err = File(source, dest, func(n int64) { copied = n })
+	assert.NoError(t, err, "Failed to copy")
+	assert.True(t, copied > 0, "No progress reported")
+
+	b, err := ioutil.ReadFile(dest)
+	assert.NoError(t, err, "Failed to read dest")
+	assert.Equal(t, 64<<20, len(b))
+	assert.Equal(t, "data", string(b[32<<20:32<<20+4]))
+
+	fi, err := os.Stat(dest)
+	assert.NoError(t, err, "Failed to stat dest")
+	blocks := fi.Sys().(*syscall.Stat_t).Blocks * 512
+	assert.True(t, blocks < 1<<20, "Copy of sparse file allocated %v bytes", blocks)
+}
+
+func TestDir(t *testing.T) {
+	dir := setup(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "sub"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "sub", "file"), []byte("file"), 0640))
+	assert.NoError(t, os.Link(filepath.Join(source, "sub", "file"), filepath.Join(source, "link")))
+	assert.NoError(t, os.Symlink("sub/file", filepath.Join(source, "symlink")))
+	assert.NoError(t, os.Chmod(filepath.Join(source, "sub"), 0750))
+	xattrs := syscall.Setxattr(filepath.Join(source, "sub", "file"), "user.test", []byte("xattr"), 0) == nil
+
+	dest := filepath.Join(dir, "dest")
+	assert.NoError(t, Dir(source, dest, nil), "Failed to copy")
+
+	b, err := ioutil.ReadFile(filepath.Join(dest, "sub", "file"))
+	assert.NoError(t, err, "Failed to read file")
+	assert.Equal(t, "file", string(b))
+
+	fi, err := os.Stat(filepath.Join(dest, "sub", "file"))
+	assert.NoError(t, err, "Failed to stat file")
+	assert.Equal(t, os.FileMode(0640), fi.Mode())
+	link, err := os.Stat(filepath.Join(dest, "link"))
+	assert.NoError(t, err, "Failed to stat link")
+	assert.True(t, os.SameFile(fi, link), "Hard link not preserved")
+
+	fi, err = os.Stat(filepath.Join(dest, "sub"))
+	assert.NoError(t, err, "Failed to stat dir")
+	assert.Equal(t, os.ModeDir|0750, fi.Mode())
+
+	target, err := os.Readlink(filepath.Join(dest, "symlink"))
+	assert.NoError(t, err, "Failed to read symlink")
+	assert.Equal(t, "sub/file", target)
+
+	if xattrs {
+		value := make([]byte, 16)
+		n, err := syscall.Getxattr(filepath.Join(dest, "sub", "file"), "user.test", value)
+		assert.NoError(t, err, "Failed to get xattr")
+		assert.Equal(t, "xattr", string(value[:n]))
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	dir := setup(t)
+	defer os.RemoveAll(dir)
+
+	err := File(filepath.Join(dir, "missing"), filepath.Join(dir, "dest"), nil)
+	assert.True(t, os.IsNotExist(err), "Expected not exist error, got %v", err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("file"), 0644))
+	err = Dir(filepath.Join(dir, "file"), filepath.Join(dir, "dest"), nil)
+	assert.Error(t, err, "Copy of a file as a directory must fail")
+
+	err = File(filepath.Join(dir, "file"), filepath.Join(dir, "missing", "dest"), nil)
+	assert.Error(t, err, "Copy into a missing directory must fail")
+}
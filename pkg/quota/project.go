@@ -0,0 +1,274 @@
+package quota
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// FS_IOC_FSGETXATTR and FS_IOC_FSSETXATTR from linux/fs.h.
+	fsIocFsGetXattr = 0x801c581f
+	fsIocFsSetXattr = 0x401c5820
+	// fsXflagProjInherit makes new files inherit the project of their
+	// directory.
+	fsXflagProjInherit = 0x200
+
+	// quotactl commands from linux/dqblk_xfs.h, which XFS and ext4 both
+	// implement.
+	qXGetQuota = 0x5803
+	qXSetQLim  = 0x5804
+	prjQuota   = 2
+
+	fsDquotVersion = 1
+	fsProjQuota    = 2
+	fsDqBSoft      = 1 << 0
+	fsDqBHard      = 1 << 1
+
+	// basicBlock is the unit of quota limits and usage.
+	basicBlock = 512
+)
+
+// fsxattr from linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// fsDiskQuota from linux/dqblk_xfs.h.
+type fsDiskQuota struct {
+	version      int8
+	flags        int8
+	fieldmask    uint16
+	id           uint32
+	blkHardlimit uint64
+	blkSoftlimit uint64
+	inoHardlimit uint64
+	inoSoftlimit uint64
+	bcount       uint64
+	icount       uint64
+	itimer       int32
+	btimer       int32
+	iwarns       uint16
+	bwarns       uint16
+	itimerHi     int8
+	btimerHi     int8
+	rtbtimerHi   int8
+	padding2     int8
+	rtbHardlimit uint64
+	rtbSoftlimit uint64
+	rtbcount     uint64
+	rtbtimer     int32
+	rtbwarns     uint16
+	padding3     int16
+	padding4     [8]byte
+}
+
+// projectQuota assigns a project to each directory tree and limits the
+// blocks allocated to the project.
+type projectQuota struct {
+	sync.Mutex
+	// dev is the block device holding the filesystem.
+	dev string
+	// next is the next free project ID.
+	next uint32
+}
+
+func newProjectQuota(root string) (*projectQuota, error) {
+	dev, err := blockDevice(root)
+	if err != nil {
+		return nil, err
+	}
+	q := &projectQuota{dev: dev, next: 1}
+	// Quotas are rejected if they are not enabled on the filesystem.
+	if _, err := q.get(0); err != nil && err != syscall.ENOENT {
+		return nil, ErrNotSupported
+	}
+
+	// Projects are not recorded anywhere but on the trees under root.
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		attr, err := getXattr(filepath.Join(root, fi.Name()))
+		if err == nil && attr.projid >= q.next {
+			q.next = attr.projid + 1
+		}
+	}
+	return q, nil
+}
+
+func (q *projectQuota) String() string {
+	return "project"
+}
+
+func (q *projectQuota) Set(path string, size uint64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	attr, err := getXattr(path)
+	if err != nil {
+		return err
+	}
+	id := attr.projid
+	if id == 0 {
+		id = q.next
+		// Files already in the tree are moved to the project, new ones
+		// inherit it from their directory.
+		err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsDir() && !fi.Mode().IsRegular() {
+				return nil
+			}
+			return setProject(p, id)
+		})
+		if err != nil {
+			return err
+		}
+		q.next++
+	}
+	limit := (size + basicBlock - 1) / basicBlock
+	d := fsDiskQuota{
+		version:      fsDquotVersion,
+		flags:        fsProjQuota,
+		fieldmask:    fsDqBSoft | fsDqBHard,
+		id:           id,
+		blkHardlimit: limit,
+		blkSoftlimit: limit,
+	}
+	return q.quotactl(qXSetQLim, id, &d)
+}
+
+func (q *projectQuota) Usage(path string) (uint64, error) {
+	attr, err := getXattr(path)
+	if err != nil {
+		return 0, err
+	}
+	if attr.projid == 0 {
+		return 0, fmt.Errorf("%v has no quota", path)
+	}
+	d, err := q.get(attr.projid)
+	if err != nil {
+		return 0, err
+	}
+	return d.bcount * basicBlock, nil
+}
+
+func (q *projectQuota) get(id uint32) (*fsDiskQuota, error) {
+	var d fsDiskQuota
+	if err := q.quotactl(qXGetQuota, id, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (q *projectQuota) quotactl(cmd int, id uint32, d *fsDiskQuota) error {
+	dev, err := syscall.BytePtrFromString(q.dev)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL,
+		uintptr(cmd<<8|prjQuota),
+		uintptr(unsafe.Pointer(dev)),
+		uintptr(id),
+		uintptr(unsafe.Pointer(d)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getXattr(path string) (*fsxattr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var attr fsxattr
+	if err := ioctl(f, fsIocFsGetXattr, &attr); err != nil {
+		return nil, err
+	}
+	return &attr, nil
+}
+
+func setProject(path string, id uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var attr fsxattr
+	if err := ioctl(f, fsIocFsGetXattr, &attr); err != nil {
+		return err
+	}
+	attr.projid = id
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		attr.xflags |= fsXflagProjInherit
+	}
+	return ioctl(f, fsIocFsSetXattr, &attr)
+}
+
+func ioctl(f *os.File, req uintptr, attr *fsxattr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(attr)))
+	if errno != 0 {
+		return &os.PathError{Op: "ioctl", Path: f.Name(), Err: errno}
+	}
+	return nil
+}
+
+// blockDevice returns the block device mounted at the filesystem holding
+// path.
+func blockDevice(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	major := (st.Dev>>8)&0xfff | (st.Dev>>32)&^0xfff
+	minor := st.Dev&0xff | (st.Dev>>12)&^0xff
+	id := fmt.Sprintf("%d:%d", major, minor)
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != id {
+			continue
+		}
+		for i, field := range fields {
+			if field != "-" || i+2 >= len(fields) {
+				continue
+			}
+			var dev syscall.Stat_t
+			if err := syscall.Stat(fields[i+2], &dev); err != nil ||
+				dev.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+				return "", ErrNotSupported
+			}
+			return fields[i+2], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrNotSupported
+}
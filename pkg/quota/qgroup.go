@@ -0,0 +1,90 @@
+package quota
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// subvolumeInode is the inode number of the root of every btrfs subvolume.
+const subvolumeInode = 256
+
+// qgroupQuota limits the space referenced by btrfs subvolumes with their
+// qgroups.
+type qgroupQuota struct {
+}
+
+func newQgroupQuota(root string) (*qgroupQuota, error) {
+	// Fails unless quotas are enabled on the filesystem.
+	if _, err := btrfs("qgroup", "show", root); err != nil {
+		return nil, ErrNotSupported
+	}
+	return &qgroupQuota{}, nil
+}
+
+func (q *qgroupQuota) String() string {
+	return "qgroup"
+}
+
+// subvolume returns ErrNotSupported unless path is the root of a subvolume,
+// a qgroup limit set on any other directory would limit the subvolume
+// holding it.
+func subvolume(path string) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return err
+	}
+	if st.Ino != subvolumeInode {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+func (q *qgroupQuota) Set(path string, size uint64) error {
+	if err := subvolume(path); err != nil {
+		return err
+	}
+	limit := "none"
+	if size != 0 {
+		limit = strconv.FormatUint(size, 10)
+	}
+	_, err := btrfs("qgroup", "limit", limit, path)
+	return err
+}
+
+func (q *qgroupQuota) Usage(path string) (uint64, error) {
+	if err := subvolume(path); err != nil {
+		return 0, err
+	}
+	out, err := btrfs("qgroup", "show", "-f", "--raw", path)
+	if err != nil {
+		return 0, err
+	}
+	return parseQgroupShow(out)
+}
+
+// parseQgroupShow returns the referenced bytes from the output of
+// btrfs qgroup show -f --raw:
+//
+//	qgroupid         rfer         excl
+//	--------         ----         ----
+//	0/257           16384        16384
+func parseQgroupShow(out string) (uint64, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 3 || !strings.Contains(fields[0], "/") {
+		return 0, fmt.Errorf("Unexpected qgroup output %q", out)
+	}
+	return strconv.ParseUint(fields[1], 10, 64)
+}
+
+func btrfs(args ...string) (string, error) {
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("btrfs %v: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,58 @@
+package quota
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	xfsSuperMagic   = 0x58465342
+	ext4SuperMagic  = 0xEF53
+	btrfsSuperMagic = 0x9123683E
+)
+
+// ErrNotSupported is returned if the filesystem cannot enforce quotas.
+var ErrNotSupported = errors.New("Quotas are not supported on this filesystem")
+
+// Quota limits the space allocated to directory trees in a filesystem.
+type Quota interface {
+	// String name of the quota mechanism.
+	String() string
+	// Set limits the bytes allocated to the tree at path to size. A size
+	// of 0 removes the limit.
+	Set(path string, size uint64) error
+	// Usage returns the bytes allocated to the tree at path, which must
+	// have been passed to Set.
+	Usage(path string) (uint64, error)
+}
+
+// New returns the quotas of the filesystem holding the directory trees
+// under root. XFS and ext4 filesystems mounted with project quotas are
+// supported, ErrNotSupported is returned for any other. The qgroups of
+// btrfs limit whole subvolumes rather than directory trees, see NewQgroup.
+func New(root string) (Quota, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(root, &fs); err != nil {
+		return nil, err
+	}
+	switch uint32(fs.Type) {
+	case xfsSuperMagic, ext4SuperMagic:
+		return newProjectQuota(root)
+	}
+	return nil, ErrNotSupported
+}
+
+// NewQgroup returns the qgroup quotas of the btrfs filesystem holding the
+// subvolumes under root. ErrNotSupported is returned if quotas are not
+// enabled on the filesystem, and by Set and Usage for paths that are not
+// the root of a subvolume.
+func NewQgroup(root string) (Quota, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(root, &fs); err != nil {
+		return nil, err
+	}
+	if uint32(fs.Type) != btrfsSuperMagic {
+		return nil, ErrNotSupported
+	}
+	return newQgroupQuota(root)
+}
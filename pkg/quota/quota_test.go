@@ -0,0 +1,67 @@
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayout(t *testing.T) {
+	// The sizes of the kernel structures.
+	assert.Equal(t, uintptr(28), unsafe.Sizeof(fsxattr{}))
+	assert.Equal(t, uintptr(112), unsafe.Sizeof(fsDiskQuota{}))
+}
+
+func TestParseQgroupShow(t *testing.T) {
+	used, err := parseQgroupShow(`qgroupid         rfer         excl
+--------         ----         ----
+0/257           16384        8192
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(16384), used)
+
+	_, err = parseQgroupShow("ERROR: can't list qgroups: quotas not enabled\n")
+	assert.Error(t, err)
+}
+
+func TestQgroupSubvolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Limiting a plain directory would limit the subvolume holding it.
+	q := &qgroupQuota{}
+	assert.Equal(t, ErrNotSupported, q.Set(dir, 64<<10))
+	_, err = q.Usage(dir)
+	assert.Equal(t, ErrNotSupported, err)
+}
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := New(dir)
+	if err == ErrNotSupported {
+		t.Skipf("Quotas are not enabled on %v", dir)
+	}
+	assert.NoError(t, err, "Failed to get quotas")
+
+	vol, err := ioutil.TempDir(dir, "vol")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(vol+"/file", make([]byte, 8192), 0644))
+	assert.NoError(t, q.Set(vol, 64<<10), "Failed to set %v quota", q)
+	used, err := q.Usage(vol)
+	assert.NoError(t, err)
+	assert.True(t, used >= 8192, "Existing files must be accounted")
+
+	err = ioutil.WriteFile(vol+"/big", make([]byte, 128<<10), 0644)
+	assert.Error(t, err, "Quota must be enforced")
+}
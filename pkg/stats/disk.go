@@ -2,9 +2,10 @@ package stats
 
 import (
 	"bufio"
-	"fmt"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +18,11 @@ const (
 	FrequencyMin = time.Second * 10
 )
 
+var (
+	// ErrNoDevice is returned if there are no statistics for a device.
+	ErrNoDevice = errors.New("No statistics for device")
+)
+
 type DiskStats struct {
 	sync.Mutex
 	stats       map[string]*api.Stats
@@ -41,8 +47,35 @@ func (d *DiskStats) Get(dev string) *api.Stats {
 		d.collect()
 	}
 
-	d.c <- 1
-	return d.stats[dev]
+	// Wake up the collector without blocking if it is not running.
+	select {
+	case d.c <- 1:
+	default:
+	}
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.stats[dev]
+	if !ok {
+		return nil
+	}
+	stats := *s
+	return &stats
+}
+
+// GetDevice returns statistics for the block device at devicePath,
+// e.g. /dev/nbd0. Symlinks such as /dev/sdf -> /dev/xvdf are resolved.
+func (d *DiskStats) GetDevice(devicePath string) (*api.Stats, error) {
+	if devicePath == "" {
+		return nil, ErrNoDevice
+	}
+	if p, err := filepath.EvalSymlinks(devicePath); err == nil {
+		devicePath = p
+	}
+	s := d.Get(filepath.Base(devicePath))
+	if s == nil {
+		return nil, ErrNoDevice
+	}
+	return s, nil
 }
 
 func (d *DiskStats) Collect() {
@@ -92,8 +125,8 @@ func (d *DiskStats) collect() {
 	defer d.Unlock()
 	for _, v := range s {
 		values := strings.Fields(v)
-		if len(values) != 14 {
-			fmt.Printf("len(values) %v is not 14", len(values))
+		// Newer kernels append discard and flush counters.
+		if len(values) < 14 {
 			continue
 		}
 		// See https://www.kernel.org/doc/Documentation/ABI/testing/procfs-diskstats
@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+// FsStats returns the space used on the filesystem mounted at path.
+func FsStats(path string) (*api.Stats, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return nil, err
+	}
+	used := int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize)
+	return &api.Stats{BytesUsed: used}, nil
+}
+
+// DirStats returns the space used by the file tree at path, in the manner
+// of du. Use it for volumes that share a filesystem with other volumes.
+func DirStats(path string) (*api.Stats, error) {
+	used, err := du(path)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Stats{BytesUsed: used}, nil
+}
+
+// du returns the number of bytes allocated to files under path. Hard links
+// are only counted once.
+func du(path string) (int64, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	seen := make(map[inode]bool)
+	var used int64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while walking.
+				return nil
+			}
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			used += info.Size()
+			return nil
+		}
+		if st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		used += st.Blocks * 512
+		return nil
+	})
+	return used, err
+}
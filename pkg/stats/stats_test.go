@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats_test")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty, err := DirStats(dir)
+	assert.NoError(t, err, "Failed in DirStats")
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = 1
+	}
+	file := path.Join(dir, "data")
+	err = ioutil.WriteFile(file, data, 0644)
+	assert.NoError(t, err, "Failed to write test file")
+	err = os.Link(file, path.Join(dir, "link"))
+	assert.NoError(t, err, "Failed to link test file")
+
+	s, err := DirStats(dir)
+	assert.NoError(t, err, "Failed in DirStats")
+	used := s.BytesUsed - empty.BytesUsed
+	assert.True(t, used >= int64(len(data)) && used < 2*int64(len(data)),
+		"Expected %v bytes used with hard link counted once, got %v", len(data), used)
+}
+
+func TestGetDevice(t *testing.T) {
+	d := NewDiskStats(FrequencyMin)
+	_, err := d.GetDevice("/dev/openstorage_no_such_device")
+	assert.Equal(t, ErrNoDevice, err)
+	_, err = d.GetDevice("")
+	assert.Equal(t, ErrNoDevice, err)
+	// Get must not block without a collector running.
+	for i := 0; i < 200; i++ {
+		d.Get("openstorage_no_such_device")
+	}
+}
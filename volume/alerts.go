@@ -0,0 +1,46 @@
+package volume
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+)
+
+// NearFullPercent is the usage, as a percentage of the volume size, at which
+// a volume is reported to be nearly full.
+const NearFullPercent = 90
+
+// CheckUsage raises an alert if used bytes exceed NearFullPercent of the
+// size of volume v.
+func CheckUsage(v *api.Volume, used int64) {
+	if v.Spec == nil || v.Spec.Size == 0 || used <= 0 {
+		return
+	}
+	if uint64(used)*100 < v.Spec.Size*NearFullPercent {
+		return
+	}
+	alerts.Raise(api.AlertWarning, api.ResourceVolume, string(v.ID),
+		fmt.Sprintf("Volume is over %d%% full", NearFullPercent))
+}
+
+// CheckQuota marks volume v Degraded and raises an alert if used bytes
+// exceed its size, which the driver could not enforce. A Degraded volume is
+// marked Up once it is back within its size. It returns true if the status
+// of v changed.
+func CheckQuota(v *api.Volume, used uint64) bool {
+	if v.Spec == nil || v.Spec.Size == 0 {
+		return false
+	}
+	switch {
+	case v.Status == api.Up && used > v.Spec.Size:
+		v.Status = api.Degraded
+		alerts.Raise(api.AlertCritical, api.ResourceVolume, string(v.ID),
+			fmt.Sprintf("Volume uses %d bytes, over its size of %d bytes", used, v.Spec.Size))
+		return true
+	case v.Status == api.Degraded && used <= v.Spec.Size:
+		v.Status = api.Up
+		return true
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package volume
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libopenstorage/openstorage/api"
+)
+
+// OvercommitParam driver parameter, the ratio of the provisioned size of
+// all volumes to the size of the storage pool up to which volumes may be
+// created. Volumes are provisioned without limit if it is not set.
+const OvercommitParam = "overcommit_ratio"
+
+// UsageCheckPeriod is how often the usage of volumes is checked against
+// their size.
+const UsageCheckPeriod = time.Minute
+
+type CapacityNotSupported struct {
+}
+
+func (c *CapacityNotSupported) Capacity() (api.Capacity, error) {
+	return api.Capacity{}, ErrNotSupported
+}
+
+// UsageFunc returns the bytes allocated to volume v.
+type UsageFunc func(v *api.Volume) (uint64, error)
+
+// ThinPool accounts for thin provisioned volumes stored in a filesystem.
+// Drivers embed it to implement Capacity.
+type ThinPool struct {
+	path       string
+	overcommit float64
+	store      *DefaultEnumerator
+	usage      UsageFunc
+	stop       chan struct{}
+}
+
+// NewThinPool returns the pool of the volumes in store, which are stored in
+// the filesystem at path. The overcommit ratio is taken from params.
+func NewThinPool(path string, params DriverParams, store *DefaultEnumerator, usage UsageFunc) (*ThinPool, error) {
+	p := &ThinPool{path: path, store: store, usage: usage}
+	if ratio, ok := params[OvercommitParam]; ok {
+		var err error
+		p.overcommit, err = strconv.ParseFloat(ratio, 64)
+		if err != nil || p.overcommit <= 0 {
+			return nil, fmt.Errorf("Invalid %v %q", OvercommitParam, ratio)
+		}
+	}
+	return p, nil
+}
+
+// pool returns the capacity of the pool without the usage of its volumes.
+func (p *ThinPool) pool() (api.Capacity, []api.Volume, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(p.path, &fs); err != nil {
+		return api.Capacity{}, nil, err
+	}
+	vols, err := p.store.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return api.Capacity{}, nil, err
+	}
+	c := api.Capacity{
+		TotalBytes:      fs.Blocks * uint64(fs.Bsize),
+		FreeBytes:       fs.Bavail * uint64(fs.Bsize),
+		UsedBytes:       (fs.Blocks - fs.Bfree) * uint64(fs.Bsize),
+		OvercommitRatio: p.overcommit,
+	}
+	for _, v := range vols {
+		if v.Spec != nil {
+			c.ProvisionedBytes += v.Spec.Size
+		}
+	}
+	return c, vols, nil
+}
+
+// Capacity returns the capacity of the pool and records the bytes allocated
+// to each volume in its Usage.
+func (p *ThinPool) Capacity() (api.Capacity, error) {
+	c, vols, err := p.pool()
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	p.update(vols, false)
+	return c, nil
+}
+
+// update records the bytes allocated to vols in their Usage. If check is
+// set, volumes using more than their size are marked Degraded.
+func (p *ThinPool) update(vols []api.Volume, check bool) {
+	for i := range vols {
+		used, err := p.usage(&vols[i])
+		if err != nil {
+			logrus.Warnf("Failed to get usage of volume %v: %v", vols[i].ID, err)
+			continue
+		}
+		// The usage of large volumes takes a while to walk, update
+		// the latest record.
+		err = p.store.ModifyVol(vols[i].ID, func(v *api.Volume) bool {
+			changed := used != v.Usage
+			v.Usage = used
+			if check && CheckQuota(v, used) {
+				changed = true
+			}
+			return changed
+		})
+		if err != nil && err != ErrEnoEnt {
+			logrus.Warnf("Failed to update usage of volume %v: %v", vols[i].ID, err)
+		}
+	}
+}
+
+// Watch checks the usage of the volumes in the pool every period until
+// Unwatch is called. Volumes that use more than their size are marked
+// Degraded, for drivers that cannot enforce volume sizes.
+func (p *ThinPool) Watch(period time.Duration) {
+	p.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		t := time.NewTicker(period)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				vols, err := p.store.Enumerate(api.VolumeLocator{}, nil)
+				if err != nil {
+					logrus.Warnf("Failed to enumerate volumes: %v", err)
+					continue
+				}
+				p.update(vols, true)
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop)
+}
+
+// Unwatch stops checking the usage of volumes.
+func (p *ThinPool) Unwatch() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// Provision reserves size bytes of the pool for a new volume. It returns
+// ErrNoSpace if the volume would take the provisioned size of the pool,
+// with the volumes being created, beyond its overcommit ratio. The caller
+// calls the returned function once the volume is recorded or failed to be
+// created.
+func (p *ThinPool) Provision(size uint64) (func(), error) {
+	if p.overcommit == 0 {
+		return func() {}, nil
+	}
+	return p.store.Reserve(p.path, size, func(reserved uint64) error {
+		c, _, err := p.pool()
+		if err != nil {
+			return err
+		}
+		if float64(c.ProvisionedBytes+reserved+size) > p.overcommit*float64(c.TotalBytes) {
+			return ErrNoSpace
+		}
+		return nil
+	})
+}
+
+// CapacityStatus returns the capacity of the pool for the Status of a
+// driver.
+func (p *ThinPool) CapacityStatus() [][2]string {
+	c, _, err := p.pool()
+	if err != nil {
+		return [][2]string{{"Pool error", err.Error()}}
+	}
+	status := [][2]string{
+		{"Pool", p.path},
+		{"Total bytes", strconv.FormatUint(c.TotalBytes, 10)},
+		{"Free bytes", strconv.FormatUint(c.FreeBytes, 10)},
+		{"Used bytes", strconv.FormatUint(c.UsedBytes, 10)},
+		{"Provisioned bytes", strconv.FormatUint(c.ProvisionedBytes, 10)},
+	}
+	if c.OvercommitRatio != 0 {
+		status = append(status, [2]string{"Overcommit ratio", strconv.FormatFloat(c.OvercommitRatio, 'g', -1, 64)})
+	}
+	return status
+}
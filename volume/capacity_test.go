@@ -0,0 +1,108 @@
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThinPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capacity_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewThinPool(dir, DriverParams{OvercommitParam: "none"}, nil, nil)
+	assert.Error(t, err, "Invalid overcommit ratio must fail")
+
+	store := NewDefaultEnumerator("capacity_test", e.kvdb)
+	usage := func(v *api.Volume) (uint64, error) {
+		return v.Spec.Size / 2, nil
+	}
+	p, err := NewThinPool(dir, DriverParams{OvercommitParam: "2"}, store, usage)
+	assert.NoError(t, err, "Failed to create pool")
+
+	c, err := p.Capacity()
+	assert.NoError(t, err, "Failed to get capacity")
+	assert.NotZero(t, c.TotalBytes)
+	assert.Zero(t, c.ProvisionedBytes)
+	assert.Equal(t, 2.0, c.OvercommitRatio)
+
+	// Provision up to twice the size of the pool.
+	vol := &api.Volume{
+		ID:   "thin",
+		Spec: &api.VolumeSpec{Size: c.TotalBytes},
+	}
+	release, err := p.Provision(vol.Spec.Size)
+	assert.NoError(t, err, "Failed in Provision")
+	// The volume being created counts against the pool.
+	_, err = p.Provision(c.TotalBytes + 1)
+	assert.Equal(t, ErrNoSpace, err, "Reserved bytes must be provisioned")
+	assert.NoError(t, store.CreateVol(vol), "Failed in CreateVol")
+	defer store.DeleteVol(vol.ID)
+	release()
+	release, err = p.Provision(c.TotalBytes)
+	assert.NoError(t, err, "Failed in Provision")
+	release()
+	_, err = p.Provision(c.TotalBytes + 1)
+	assert.Equal(t, ErrNoSpace, err)
+
+	c, err = p.Capacity()
+	assert.NoError(t, err, "Failed to get capacity")
+	assert.Equal(t, vol.Spec.Size, c.ProvisionedBytes)
+	v, err := store.GetVol(vol.ID)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, vol.Spec.Size/2, v.Usage, "Usage must be updated")
+}
+
+func TestWatch(t *testing.T) {
+	store := NewDefaultEnumerator("watch_test", e.kvdb)
+	used := make(chan uint64, 1)
+	used <- 2 << 20
+	usage := func(v *api.Volume) (uint64, error) {
+		u := <-used
+		used <- u
+		return u, nil
+	}
+	p, err := NewThinPool(os.TempDir(), DriverParams{}, store, usage)
+	assert.NoError(t, err, "Failed to create pool")
+
+	vol := &api.Volume{
+		ID:     "full",
+		Spec:   &api.VolumeSpec{Size: 1 << 20},
+		Status: api.Up,
+	}
+	assert.NoError(t, store.CreateVol(vol), "Failed in CreateVol")
+	defer store.DeleteVol(vol.ID)
+
+	wait := func(status api.VolumeStatus) *api.Volume {
+		for i := 0; i < 100; i++ {
+			v, err := store.GetVol(vol.ID)
+			assert.NoError(t, err, "Failed in GetVol")
+			if v.Status == status {
+				return v
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Volume is not %v", status)
+		return nil
+	}
+
+	p.Watch(10 * time.Millisecond)
+	defer p.Unwatch()
+	v := wait(api.Degraded)
+	assert.Equal(t, uint64(2<<20), v.Usage)
+	a, err := alerts.Enumerate(api.ResourceVolume, string(vol.ID))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, a.Alerts, "Volume over its size must raise an alert")
+
+	<-used
+	used <- 1 << 20
+	wait(api.Up)
+}
@@ -13,11 +13,15 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/opsworks"
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
 	"github.com/libopenstorage/openstorage/pkg/chaos"
 	"github.com/libopenstorage/openstorage/pkg/device"
+	"github.com/libopenstorage/openstorage/pkg/fs"
+	"github.com/libopenstorage/openstorage/pkg/stats"
 	"github.com/libopenstorage/openstorage/volume"
 	"github.com/portworx/kvdb"
 )
@@ -41,13 +45,107 @@ var (
 // Driver implements VolumeDriver interface
 type Driver struct {
 	*volume.IoNotSupported
+	*volume.RestoreNotSupported
+	*volume.CapacityNotSupported
 	*volume.DefaultEnumerator
 	*device.SingleLetter
 	md        *Metadata
 	ec2       *ec2.EC2
+	modifier  volumeModifier
+	diskStats *stats.DiskStats
 	devPrefix string
 }
 
+// volumeModifier changes the size of an EBS volume.
+type volumeModifier interface {
+	ModifyVolume(volumeID string, sizeGiB int64) error
+	// ModificationState returns the state of the latest modification of
+	// the volume: modifying, optimizing, completed or failed.
+	ModificationState(volumeID string) (string, error)
+}
+
+const (
+	// modificationTimeout bounds the wait for a resized volume to grow.
+	modificationTimeout = 2 * time.Minute
+	// modificationInterval is the interval the modification is polled at.
+	modificationInterval = 2 * time.Second
+)
+
+// ec2Modifier issues ModifyVolume requests. The vendored EC2 client predates
+// the API, so the request is built directly against a newer API version.
+type ec2Modifier struct {
+	ec2 *ec2.EC2
+}
+
+type modifyVolumeInput struct {
+	VolumeId *string `type:"string" required:"true"`
+	Size     *int64  `type:"integer"`
+
+	metadataModifyVolumeInput `json:"-" xml:"-"`
+}
+
+type metadataModifyVolumeInput struct {
+	SDKShapeTraits bool `type:"structure"`
+}
+
+type modifyVolumeOutput struct {
+	metadataModifyVolumeOutput `json:"-" xml:"-"`
+}
+
+type metadataModifyVolumeOutput struct {
+	SDKShapeTraits bool `type:"structure"`
+}
+
+type describeVolumesModificationsInput struct {
+	VolumeIds []*string `locationName:"VolumeId" locationNameList:"VolumeId" type:"list"`
+
+	metadataModifyVolumeInput `json:"-" xml:"-"`
+}
+
+type describeVolumesModificationsOutput struct {
+	VolumesModifications []*volumeModification `locationName:"volumeModificationSet" locationNameList:"item" type:"list"`
+
+	metadataModifyVolumeOutput `json:"-" xml:"-"`
+}
+
+type volumeModification struct {
+	ModificationState *string `locationName:"modificationState" type:"string"`
+
+	metadataModifyVolumeOutput `json:"-" xml:"-"`
+}
+
+func (m *ec2Modifier) ModifyVolume(volumeID string, sizeGiB int64) error {
+	op := &request.Operation{
+		Name:       "ModifyVolume",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	input := &modifyVolumeInput{VolumeId: &volumeID, Size: &sizeGiB}
+	req := m.ec2.NewRequest(op, input, &modifyVolumeOutput{})
+	req.Service.APIVersion = "2016-11-15"
+	return req.Send()
+}
+
+func (m *ec2Modifier) ModificationState(volumeID string) (string, error) {
+	op := &request.Operation{
+		Name:       "DescribeVolumesModifications",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	input := &describeVolumesModificationsInput{VolumeIds: []*string{&volumeID}}
+	output := &describeVolumesModificationsOutput{}
+	req := m.ec2.NewRequest(op, input, output)
+	req.Service.APIVersion = "2016-11-15"
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	if len(output.VolumesModifications) != 1 ||
+		output.VolumesModifications[0].ModificationState == nil {
+		return "", fmt.Errorf("No modification of volume %v", volumeID)
+	}
+	return *output.VolumesModifications[0].ModificationState, nil
+}
+
 // Init aws volume driver metadata.
 func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 	zone, err := metadata("placement/availability-zone")
@@ -84,7 +182,9 @@ func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 		},
 		IoNotSupported:    &volume.IoNotSupported{},
 		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kvdb.Instance()),
+		diskStats:         stats.NewDiskStats(stats.FrequencyMin),
 	}
+	d.modifier = &ec2Modifier{ec2: d.ec2}
 	devPrefix, letters, err := d.freeDevices()
 	if err != nil {
 		return nil, err
@@ -255,7 +355,7 @@ func (d *Driver) Create(
 		Locator:  locator,
 		Ctime:    time.Now(),
 		Spec:     spec,
-		Source:   source,
+		Source:   volume.CloneSource(source),
 		LastScan: time.Now(),
 		Format:   "none",
 		State:    api.VolumeAvailable,
@@ -486,12 +586,31 @@ func (d *Driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.Volu
 	return vols[0].ID, nil
 }
 
+// Stats returns I/O statistics of the volume if it is attached here.
 func (d *Driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
-	return api.Stats{}, volume.ErrNotSupported
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	devicePath, err := d.devicePath(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	s, err := d.diskStats.GetDevice(devicePath)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	if v.AttachPath != "" {
+		if fsStats, err := stats.FsStats(v.AttachPath); err == nil {
+			s.BytesUsed = fsStats.BytesUsed
+			volume.CheckUsage(v, s.BytesUsed)
+		}
+	}
+	return *s, nil
 }
 
 func (d *Driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
-	return api.Alerts{}, volume.ErrNotSupported
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
 }
 
 func (d *Driver) Attach(volumeID api.VolumeID) (path string, err error) {
@@ -581,8 +700,14 @@ func (d *Driver) Mount(volumeID api.VolumeID, mountpath string) error {
 	}
 	err = syscall.Mount(devicePath, mountpath, string(v.Spec.Format), 0, "")
 	if err != nil {
+		alerts.Raise(api.AlertWarning, api.ResourceVolume, string(volumeID),
+			fmt.Sprintf("Failed to mount %v at %v: %v", devicePath, mountpath, err))
 		return err
 	}
+	// Complete resizes that finished while the volume was not mounted.
+	if err := fs.Grow(string(v.Spec.Format), devicePath, mountpath); err != nil {
+		logrus.Warnf("Failed to grow filesystem of %v: %v", volumeID, err)
+	}
 	return nil
 }
 
@@ -596,8 +721,82 @@ func (d *Driver) Shutdown() {
 	logrus.Printf("%s Shutting down", Name)
 }
 
+// Set updates the locator and grows the volume if spec specifies a larger
+// size. Other fields in spec are ignored.
 func (d *Driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
-	return volume.ErrNotSupported
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if spec != nil && spec.Size != 0 {
+		if err = d.resize(v, spec.Size); err != nil {
+			return err
+		}
+	}
+	if locator != nil {
+		v.Locator = *locator
+	}
+	err = d.UpdateVol(v)
+	return err
+}
+
+// resize grows the EBS volume backing v to size bytes and expands the
+// filesystem on it if it is attached to this instance.
+func (d *Driver) resize(v *api.Volume, size uint64) error {
+	if size < v.Spec.Size {
+		return volume.ErrVolShrink
+	}
+	// EBS volumes are sized in GiB, round up.
+	sz := int64((size + (1 << 30) - 1) >> 30)
+	if sz == int64((v.Spec.Size+(1<<30)-1)>>30) {
+		v.Spec.Size = size
+		return nil
+	}
+	if err := d.modifier.ModifyVolume(string(v.ID), sz); err != nil {
+		logrus.Warnf("Failed to resize volume %v: %v", v.ID, err)
+		return err
+	}
+	logrus.Infof("AWS resized volume %v from %v to %vGiB", v.ID, v.Spec.Size, sz)
+	v.Spec.Size = size
+	if err := d.UpdateVol(v); err != nil {
+		return err
+	}
+
+	devicePath, err := d.devicePath(v.ID)
+	if err != nil {
+		// Not attached here, the filesystem is grown when it is mounted.
+		return nil
+	}
+	// The device grows once the modification is optimizing. If it does
+	// not in time, the filesystem is grown on the next mount.
+	if err = d.waitModification(v.ID); err == nil {
+		err = fs.Grow(string(v.Format), devicePath, v.AttachPath)
+	}
+	if err != nil {
+		logrus.Warnf("Filesystem of %v will be grown on the next mount: %v", v.ID, err)
+	}
+	return nil
+}
+
+// waitModification waits for the latest modification of volumeID to be
+// applied to the device.
+func (d *Driver) waitModification(volumeID api.VolumeID) error {
+	for elapsed := time.Duration(0); ; elapsed += modificationInterval {
+		state, err := d.modifier.ModificationState(string(volumeID))
+		if err != nil {
+			return err
+		}
+		switch state {
+		case "optimizing", "completed":
+			return nil
+		case "failed":
+			return fmt.Errorf("Modification of volume %v failed", volumeID)
+		}
+		if elapsed >= modificationTimeout {
+			return fmt.Errorf("Volume %v is still %v", volumeID, state)
+		}
+		time.Sleep(modificationInterval)
+	}
 }
 
 func init() {
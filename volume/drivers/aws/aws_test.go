@@ -3,11 +3,30 @@ package aws
 import (
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/volume"
 	"github.com/libopenstorage/openstorage/volume/drivers/test"
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
 )
 
+type fakeModifier struct {
+	sizes map[string]int64
+}
+
+func (f *fakeModifier) ModifyVolume(volumeID string, sizeGiB int64) error {
+	f.sizes[volumeID] = sizeGiB
+	return nil
+}
+
+func (f *fakeModifier) ModificationState(volumeID string) (string, error) {
+	return "optimizing", nil
+}
+
 func TestAll(t *testing.T) {
 	if _, err := credentials.NewEnvCredentials().Get(); err != nil {
 		t.Skip("No AWS credentials, skipping AWS driver test: ", err)
@@ -24,3 +43,45 @@ func TestAll(t *testing.T) {
 	ctx.Filesystem = "ext4"
 	test.RunShort(t, ctx)
 }
+
+func TestResize(t *testing.T) {
+	kv, err := kvdb.New(mem.Name, "aws_test", []string{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to initialize KVDB: %v", err)
+	}
+	// Requests to EC2 fail fast, the volume is never attached here.
+	region := "us-west-1"
+	maxRetries := 0
+	fake := &fakeModifier{sizes: make(map[string]int64)}
+	d := &Driver{
+		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kv),
+		md:                &Metadata{zone: region + "a", instance: "i-test"},
+		ec2: ec2.New(&aws.Config{
+			Region:      &region,
+			Endpoint:    aws.String("http://127.0.0.1:1"),
+			MaxRetries:  &maxRetries,
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		}),
+		modifier: fake,
+	}
+
+	v := &api.Volume{
+		ID:      api.VolumeID("vol-resize"),
+		Locator: api.VolumeLocator{Name: "resize"},
+		Spec:    &api.VolumeSpec{Size: 1 << 30},
+		Format:  api.FsExt4,
+	}
+	err = d.CreateVol(v)
+	assert.NoError(t, err, "Failed in CreateVol")
+
+	err = d.Set(v.ID, nil, &api.VolumeSpec{Size: 3 << 30})
+	assert.NoError(t, err, "Failed to grow volume")
+	assert.Equal(t, int64(3), fake.sizes[string(v.ID)])
+
+	err = d.Set(v.ID, nil, &api.VolumeSpec{Size: 2 << 30})
+	assert.Equal(t, volume.ErrVolShrink, err)
+
+	got, err := d.GetVol(v.ID)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, uint64(3<<30), got.Spec.Size)
+}
@@ -4,6 +4,7 @@ package btrfs
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"syscall"
 	"time"
@@ -12,9 +13,11 @@ import (
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/daemon/graphdriver/btrfs"
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
 	"github.com/libopenstorage/openstorage/pkg/chaos"
+	"github.com/libopenstorage/openstorage/pkg/quota"
+	"github.com/libopenstorage/openstorage/pkg/stats"
 	"github.com/libopenstorage/openstorage/volume"
-	"github.com/pborman/uuid"
 	"github.com/portworx/kvdb"
 )
 
@@ -34,8 +37,11 @@ type driver struct {
 	*volume.IoNotSupported
 	*volume.DefaultBlockDriver
 	*volume.DefaultEnumerator
+	*volume.ThinPool
 	btrfs graphdriver.Driver
 	root  string
+	// quota enforces volume sizes with qgroups, if quotas are enabled.
+	quota quota.Quota
 }
 
 func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
@@ -49,11 +55,54 @@ func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 		return nil, err
 	}
 	s := volume.NewDefaultEnumerator(Name, kvdb.Instance())
-	return &driver{
+	inst := &driver{
 		btrfs:             d,
 		root:              root,
 		IoNotSupported:    &volume.IoNotSupported{},
-		DefaultEnumerator: s}, nil
+		DefaultEnumerator: s}
+	inst.ThinPool, err = volume.NewThinPool(root, params, s, inst.usage)
+	if err != nil {
+		return nil, err
+	}
+
+	inst.quota, err = quota.NewQgroup(home)
+	if err != nil {
+		logrus.Warnf("Volume sizes are not enforced on %v: %v", home, err)
+		inst.quota = nil
+	}
+	vols, err := s.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vols {
+		inst.setQuota(&vols[i])
+	}
+	inst.Watch(volume.UsageCheckPeriod)
+	return inst, nil
+}
+
+// setQuota limits the subvolume of v to its size.
+func (d *driver) setQuota(v *api.Volume) {
+	if d.quota == nil || v.Spec == nil || v.DevicePath == "" {
+		return
+	}
+	if err := d.quota.Set(v.DevicePath, v.Spec.Size); err != nil {
+		logrus.Warnf("Failed to set quota of volume %v: %v", v.ID, err)
+	}
+}
+
+// usage returns the bytes referenced by the subvolume of v.
+func (d *driver) usage(v *api.Volume) (uint64, error) {
+	if d.quota != nil {
+		if used, err := d.quota.Usage(v.DevicePath); err == nil {
+			return used, nil
+		}
+	}
+	s, err := stats.DirStats(v.DevicePath)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(s.BytesUsed), nil
 }
 
 func (d *driver) String() string {
@@ -62,14 +111,16 @@ func (d *driver) String() string {
 
 // Status diagnostic information
 func (d *driver) Status() [][2]string {
-	return d.btrfs.Status()
+	return append(d.btrfs.Status(), d.CapacityStatus()...)
 }
 
 func (d *driver) Type() api.DriverType {
 	return Type
 }
 
-// Create a new subvolume. The volume spec is not taken into account.
+// Create a new subvolume, or a writable snapshot of the parent subvolume if
+// source specifies one. The size of the volume is enforced if quotas are
+// enabled on the filesystem.
 func (d *driver) Create(locator api.VolumeLocator,
 	source *api.Source,
 	spec *api.VolumeSpec) (api.VolumeID, error) {
@@ -78,15 +129,27 @@ func (d *driver) Create(locator api.VolumeLocator,
 		return api.BadVolumeID, fmt.Errorf("Filesystem format (%v) must be %v",
 			spec.Format, "btrfs")
 	}
+	release, err := d.Provision(spec.Size)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	defer release()
+	parentID := ""
+	if source != nil && source.Parent != api.BadVolumeID {
+		if _, err := d.GetVol(source.Parent); err != nil {
+			return api.BadVolumeID, err
+		}
+		parentID = string(source.Parent)
+	}
 
-	volumeID := uuid.New()
+	volumeID := d.NewVolumeID()
 
 	v := &api.Volume{
-		ID:       api.VolumeID(volumeID),
+		ID:       volumeID,
 		Locator:  locator,
 		Ctime:    time.Now(),
 		Spec:     spec,
-		Source:   source,
+		Source:   volume.CloneSource(source),
 		LastScan: time.Now(),
 		Format:   "btrfs",
 		State:    api.VolumeAvailable,
@@ -96,14 +159,15 @@ func (d *driver) Create(locator api.VolumeLocator,
 	if err != nil {
 		return api.BadVolumeID, err
 	}
-	err = d.btrfs.Create(volumeID, "")
+	err = d.btrfs.Create(string(volumeID), parentID)
 	if err != nil {
 		return api.BadVolumeID, err
 	}
-	v.DevicePath, err = d.btrfs.Get(volumeID, "")
+	v.DevicePath, err = d.btrfs.Get(string(volumeID), "")
 	if err != nil {
 		return v.ID, err
 	}
+	d.setQuota(v)
 	err = d.UpdateVol(v)
 	return v.ID, err
 }
@@ -183,8 +247,8 @@ func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.Volu
 	if len(vols) != 1 {
 		return api.BadVolumeID, fmt.Errorf("Failed to inspect %v len %v", volumeID, len(vols))
 	}
-	snapID := uuid.New()
-	vols[0].ID = api.VolumeID(snapID)
+	snapID := d.NewVolumeID()
+	vols[0].ID = snapID
 	vols[0].Source = &api.Source{Parent: volumeID}
 	vols[0].Locator = locator
 	vols[0].Ctime = time.Now()
@@ -194,25 +258,79 @@ func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.Volu
 		return api.BadVolumeID, err
 	}
 	chaos.Now(koStrayCreate)
-	err = d.btrfs.Create(snapID, string(volumeID))
+	err = d.btrfs.Create(string(snapID), string(volumeID))
 	if err != nil {
 		return api.BadVolumeID, err
 	}
 	return vols[0].ID, nil
 }
 
-// Stats for specified volume.
+// Restore replaces the subvolume with a writable snapshot of snapID. The
+// new subvolume is created alongside the volume and swapped in by rename.
+func (d *driver) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	snap, err := d.GetVol(snapID)
+	if err != nil {
+		return err
+	}
+	if err := volume.CheckRestore(v, snap); err != nil {
+		return err
+	}
+
+	restoreID := string(volumeID) + ".restore"
+	if err := d.btrfs.Create(restoreID, string(snapID)); err != nil {
+		return err
+	}
+	restorePath, err := d.btrfs.Get(restoreID, "")
+	if err != nil {
+		d.btrfs.Remove(restoreID)
+		return err
+	}
+	oldID := string(volumeID) + ".old"
+	oldPath := path.Join(path.Dir(v.DevicePath), oldID)
+	if err := os.Rename(v.DevicePath, oldPath); err != nil {
+		d.btrfs.Remove(restoreID)
+		return err
+	}
+	if err := os.Rename(restorePath, v.DevicePath); err != nil {
+		os.Rename(oldPath, v.DevicePath)
+		d.btrfs.Remove(restoreID)
+		return err
+	}
+	if err := d.btrfs.Remove(oldID); err != nil {
+		logrus.Warnf("Failed to remove subvolume %v: %v", oldID, err)
+	}
+	// The restored subvolume has a qgroup of its own.
+	d.setQuota(v)
+	logrus.Infof("Restored volume %v from snapshot %v", volumeID, snapID)
+	return nil
+}
+
+// Stats returns the space used by the subvolume.
 func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
-	return api.Stats{}, nil
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	s, err := stats.DirStats(v.DevicePath)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	volume.CheckUsage(v, s.BytesUsed)
+	return *s, nil
 }
 
 // Alerts on this volume.
 func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
-	return api.Alerts{}, nil
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
 }
 
 // Shutdown and cleanup.
 func (d *driver) Shutdown() {
+	d.Unwatch()
 }
 
 func init() {
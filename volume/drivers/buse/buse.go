@@ -1,18 +1,25 @@
 package buse
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/cluster"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/pkg/fs"
+	"github.com/libopenstorage/openstorage/pkg/stats"
 	"github.com/libopenstorage/openstorage/volume"
 	"github.com/pborman/uuid"
 	"github.com/portworx/kvdb"
@@ -23,66 +30,104 @@ const (
 	Type          = api.Block
 	BuseDBKey     = "OpenStorageBuseKey"
 	BuseMountPath = "/var/lib/openstorage/buse/"
+	// QueueDepthParam driver parameter, the number of requests served
+	// concurrently on each NBD device.
+	QueueDepthParam = "queue_depth"
+	// BuseFileLabel config label recording the block file of a volume.
+	BuseFileLabel = "buse_file"
+	// BuseTrimLabel config label, "false" stops discarded blocks from
+	// being punched out of the block file.
+	BuseTrimLabel = "buse_trim"
+	// BuseFUALabel config label, "false" disables flush and FUA, so
+	// writes are only as durable as the host page cache.
+	BuseFUALabel = "buse_fua"
+
+	// Defined in <linux/falloc.h>:
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
 )
 
 // Implements the open storage volume interface.
 type driver struct {
-	*volume.IoNotSupported
 	*volume.DefaultEnumerator
-	buseDevices map[string]*buseDev
+	*volume.ThinPool
+	// lock protects buseDevices and nodeID.
+	lock        sync.Mutex
+	buseDevices map[api.VolumeID]*buseDev
+	diskStats   *stats.DiskStats
+	// nodeID is recorded in AttachedOn of attached volumes.
+	nodeID     api.MachineID
+	queueDepth int
 }
 
 // Implements the Device interface.
 type buseDev struct {
 	file string
-	f    *os.File
+	c    *cow
 	nbd  *NBD
 }
 
 func (d *buseDev) ReadAt(b []byte, off int64) (n int, err error) {
-	return d.f.ReadAt(b, off)
+	return d.c.ReadAt(b, off)
 }
 
 func (d *buseDev) WriteAt(b []byte, off int64) (n int, err error) {
-	return d.f.WriteAt(b, off)
+	return d.c.WriteAt(b, off)
 }
 
-func copyFile(source string, dest string) (err error) {
-	sourcefile, err := os.Open(source)
-	if err != nil {
-		return err
-	}
+func (d *buseDev) Sync() error {
+	return d.c.Sync()
+}
 
-	defer sourcefile.Close()
+// Trim punches a hole in the block file, returning the space to the host.
+func (d *buseDev) Trim(off int64, length int64) error {
+	return d.c.Trim(off, length)
+}
 
-	destfile, err := os.Create(dest)
-	if err != nil {
-		return err
+// nbdFlags returns the NBD flags enabled by the config labels of v. Trim
+// and FUA are on unless disabled.
+func nbdFlags(v *api.Volume) uint32 {
+	flags := uint32(NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA | NBD_FLAG_SEND_TRIM)
+	if v.Spec == nil {
+		return flags
 	}
-
-	defer destfile.Close()
-
-	_, err = io.Copy(destfile, sourcefile)
-	if err == nil {
-		sourceinfo, err := os.Stat(source)
-		if err != nil {
-			err = os.Chmod(dest, sourceinfo.Mode())
-		}
-
+	if on, err := strconv.ParseBool(v.Spec.ConfigLabels[BuseTrimLabel]); err == nil && !on {
+		flags &^= NBD_FLAG_SEND_TRIM
 	}
-
-	return
+	if on, err := strconv.ParseBool(v.Spec.ConfigLabels[BuseFUALabel]); err == nil && !on {
+		flags &^= NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA
+	}
+	return flags
 }
 
 func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 	inst := &driver{
-		IoNotSupported:    &volume.IoNotSupported{},
 		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kvdb.Instance()),
+		diskStats:         stats.NewDiskStats(stats.FrequencyMin),
+		queueDepth:        DefaultQueueDepth,
 	}
+	if depth, ok := params[QueueDepthParam]; ok {
+		n, err := strconv.Atoi(depth)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid %v %q", QueueDepthParam, depth)
+		}
+		inst.queueDepth = n
+	}
+	pool, err := volume.NewThinPool(BuseMountPath, params, inst.DefaultEnumerator, layerUsage)
+	if err != nil {
+		return nil, err
+	}
+	inst.ThinPool = pool
 
-	inst.buseDevices = make(map[string]*buseDev)
+	inst.buseDevices = make(map[api.VolumeID]*buseDev)
+	c, err := cluster.Inst()
+	if err == nil {
+		inst.nodeID = api.MachineID(c.NodeID())
+	} else if hostname, err := os.Hostname(); err == nil {
+		inst.nodeID = api.MachineID(hostname)
+	}
 
-	err := os.MkdirAll(BuseMountPath, 0744)
+	err = os.MkdirAll(BuseBasePath, 0744)
 	if err != nil {
 		return nil, err
 	}
@@ -92,17 +137,51 @@ func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 		nil)
 	if err == nil {
 		for _, info := range volumeInfo {
+			// The kvdb is shared by the nodes of a cluster, leave
+			// the volumes attached on other nodes to them.
+			if info.AttachedOn != api.MachineNone && info.AttachedOn != inst.nodeID {
+				continue
+			}
 			if info.Status == "" {
 				info.Status = api.Up
 				inst.UpdateVol(&info)
 			}
+			if info.State != api.VolumeAttached && info.AttachPath == "" {
+				// Free the device of a volume that was connected
+				// before NBD devices were only held while attached,
+				// unless it has been taken since.
+				if info.DevicePath != "" {
+					if mounted, err := Mounted(info.DevicePath); err != nil {
+						logrus.Warnf("Not reclaiming device %v of volume %v: %v",
+							info.DevicePath, info.ID, err)
+					} else if mounted {
+						logrus.Warnf("Not reclaiming device %v of volume %v, it is mounted",
+							info.DevicePath, info.ID)
+					} else if err := Reclaim(info.DevicePath); err != nil {
+						logrus.Warnf("Not reclaiming device %v of volume %v: %v",
+							info.DevicePath, info.ID, err)
+					}
+					info.DevicePath = ""
+					inst.UpdateVol(&info)
+				}
+				continue
+			}
+			// Reconnect attached volumes to NBD devices, the devices
+			// of the previous instance of the driver are gone.
+			inst.lock.Lock()
+			_, err := inst.connect(&info)
+			inst.lock.Unlock()
+			if err != nil {
+				logrus.Warnf("Failed to reconnect volume %v: %v", info.ID, err)
+				alerts.Raise(api.AlertWarning, api.ResourceVolume, string(info.ID),
+					fmt.Sprintf("Failed to reconnect NBD device: %v", err))
+			}
 		}
 	} else {
 		logrus.Println("Could not enumerate Volumes, ", err)
 	}
 
-	c, err := cluster.Inst()
-	if err != nil {
+	if c == nil {
 		logrus.Println("BUSE initializing in single node mode")
 	} else {
 		logrus.Println("BUSE initializing in clustered mode")
@@ -127,79 +206,321 @@ func (d *driver) Type() api.DriverType {
 
 // Status diagnostic information
 func (d *driver) Status() [][2]string {
-	return [][2]string{}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([][2]string{
+		{"NBD devices", strconv.Itoa(len(d.buseDevices))},
+	}, d.CapacityStatus()...)
 }
 
-func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
-	volumeID := uuid.New()
-	volumeID = strings.TrimSuffix(volumeID, "\n")
+// Capacity of the filesystem holding the block files. The usage of a
+// volume is the size of its top layer, bases shared with snapshots and
+// clones are not accounted to it.
+func (d *driver) Capacity() (api.Capacity, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.ThinPool.Capacity()
+}
 
-	if spec.Size == 0 {
-		return api.BadVolumeID, fmt.Errorf("Volume size cannot be zero", "buse")
+// layerUsage returns the bytes allocated to the top layer of v.
+func layerUsage(v *api.Volume) (uint64, error) {
+	file := blockFilePath(v)
+	var usage uint64
+	for _, f := range []string{file, file + mapSuffix} {
+		var st syscall.Stat_t
+		if err := syscall.Stat(f, &st); err != nil {
+			if os.IsNotExist(err) && f != file {
+				continue
+			}
+			return 0, err
+		}
+		usage += uint64(st.Blocks) * 512
 	}
+	return usage, nil
+}
 
-	if spec.Format == "" {
-		return api.BadVolumeID, fmt.Errorf("Missing volume format", "buse")
+// blockFilePath returns the block file backing v.
+func blockFilePath(v *api.Volume) string {
+	if v.Spec != nil {
+		if file, ok := v.Spec.ConfigLabels[BuseFileLabel]; ok {
+			return file
+		}
 	}
+	return path.Join(BuseMountPath, string(v.ID))
+}
 
-	// Create a file on the local buse path with this UUID.
-	buseFile := path.Join(BuseMountPath, string(volumeID))
-	f, err := os.Create(buseFile)
+// setBases records the base layers of v.
+func setBases(v *api.Volume, bases []string) {
+	if len(bases) == 0 {
+		delete(v.Spec.ConfigLabels, BuseBasesLabel)
+		return
+	}
+	v.Spec.ConfigLabels[BuseBasesLabel] = strings.Join(bases, ",")
+}
+
+// layers returns the layers of v, those of its NBD device if it is
+// connected. The caller must hold d.lock and call done when finished with
+// them.
+func (d *driver) layers(v *api.Volume) (c *cow, done func(), err error) {
+	if bd, ok := d.buseDevices[v.ID]; ok {
+		return bd.c, func() {}, nil
+	}
+	c, err = openCow(blockFilePath(v), volumeBases(v.Spec.ConfigLabels[BuseBasesLabel]), int64(v.Spec.Size))
 	if err != nil {
-		logrus.Println(err)
-		return api.BadVolumeID, err
+		return nil, nil, err
 	}
+	return c, func() { c.close() }, nil
+}
 
-	err = f.Truncate(int64(spec.Size))
+// freeze turns the top layer of v into a base to be shared with a new
+// snapshot or clone and returns the bases of v. The caller must hold d.lock.
+func (d *driver) freeze(v *api.Volume) ([]string, error) {
+	c, done, err := d.layers(v)
 	if err != nil {
-		logrus.Println(err)
-		return api.BadVolumeID, err
+		return nil, err
+	}
+	defer done()
+	frozen, err := c.freeze(path.Join(BuseBasePath, uuid.New()))
+	if err != nil {
+		return nil, err
 	}
+	bases := c.bases()
+	if frozen {
+		logrus.Infof("BUSE froze base %s of volume %v", bases[0], v.ID)
+		setBases(v, bases)
+		if err := d.UpdateVol(v); err != nil {
+			// The record still has the chain before the freeze, merge
+			// the base back into the top layer.
+			setBases(v, bases[1:])
+			if base, merr := c.merge(); merr != nil {
+				logrus.Warnf("Failed to merge base %s back into volume %v: %v", bases[0], v.ID, merr)
+			} else {
+				removeLayer(base)
+			}
+			return nil, err
+		}
+	}
+	return bases, nil
+}
 
-	bd := &buseDev{
-		file: buseFile,
-		f:    f}
+// collect merges bases used by a single volume into its top layer and
+// removes bases no volume uses. The caller must hold d.lock.
+func (d *driver) collect() {
+	vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		logrus.Warnf("Failed to enumerate volumes: %v", err)
+		return
+	}
+	refs := make(map[string]int)
+	for _, v := range vols {
+		for _, base := range volumeBases(v.Spec.ConfigLabels[BuseBasesLabel]) {
+			refs[base]++
+		}
+	}
 
-	nbd := Create(bd, int64(spec.Size))
-	bd.nbd = nbd
+	// A base used by one volume is at the top of its chain, the bases
+	// above it are used by the same volumes.
+	for i := range vols {
+		v := &vols[i]
+		bases := volumeBases(v.Spec.ConfigLabels[BuseBasesLabel])
+		n := 0
+		for n < len(bases) && refs[bases[n]] == 1 {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if err := d.flatten(v, n); err != nil {
+			logrus.Warnf("Failed to merge bases of volume %v: %v", v.ID, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(BuseBasePath)
+	if err != nil {
+		logrus.Warnf("Failed to list bases: %v", err)
+		return
+	}
+	for _, fi := range files {
+		base := path.Join(BuseBasePath, fi.Name())
+		if !strings.HasSuffix(base, mapSuffix) && refs[base] == 0 {
+			logrus.Infof("BUSE removing unused base %s", base)
+			removeLayer(base)
+		}
+	}
+}
+
+// flatten merges the n bases right below the top layer of v into it. The
+// caller must hold d.lock.
+func (d *driver) flatten(v *api.Volume, n int) error {
+	c, done, err := d.layers(v)
+	if err != nil {
+		return err
+	}
+	defer done()
+	for i := 0; i < n; i++ {
+		base, err := c.merge()
+		if err != nil {
+			return err
+		}
+		setBases(v, c.bases())
+		if err := d.UpdateVol(v); err != nil {
+			return err
+		}
+		removeLayer(base)
+		logrus.Infof("BUSE merged base %s into volume %v", base, v.ID)
+	}
+	return nil
+}
+
+// connect opens the block file of v and connects it to an NBD device,
+// preferring the device v was last connected to, and records the device in
+// v. It is a no-op if v is already connected. The caller must hold d.lock.
+func (d *driver) connect(v *api.Volume) (*buseDev, error) {
+	if bd, ok := d.buseDevices[v.ID]; ok {
+		if bd.nbd.IsConnected() {
+			return bd, nil
+		}
+		bd.c.close()
+		delete(d.buseDevices, v.ID)
+	}
 
+	file := blockFilePath(v)
+	c, err := openCow(file, volumeBases(v.Spec.ConfigLabels[BuseBasesLabel]), int64(v.Spec.Size))
+	if err != nil {
+		return nil, err
+	}
+	bd := &buseDev{
+		file: file,
+		c:    c}
+
+	volumeID := v.ID
+	bd.nbd = Create(bd, int64(v.Spec.Size))
+	bd.nbd.SetFlags(nbdFlags(v))
+	bd.nbd.SetQueueDepth(d.queueDepth)
+	bd.nbd.OnError(func(err error) {
+		alerts.Raise(api.AlertCritical, api.ResourceVolume, string(volumeID),
+			fmt.Sprintf("NBD device disconnected: %v", err))
+	})
+
+	if v.DevicePath != "" {
+		if err := Reclaim(v.DevicePath); err != nil {
+			logrus.Warnf("Cannot reuse device %v: %v", v.DevicePath, err)
+		}
+	}
 	logrus.Infof("Connecting to NBD...")
-	dev, err := bd.nbd.Connect()
+	dev, err := bd.nbd.ConnectDevice(v.DevicePath)
 	if err != nil {
-		logrus.Println(err)
-		return api.BadVolumeID, err
+		c.close()
+		return nil, err
 	}
+	if v.AttachPath != "" && dev != v.DevicePath {
+		// The filesystem is mounted from a device that is gone.
+		logrus.Warnf("Unmounting stale mount of %v at %v", v.DevicePath, v.AttachPath)
+		syscall.Unmount(v.AttachPath, syscall.MNT_DETACH)
+		v.AttachPath = ""
+	}
+	logrus.Infof("BUSE mapped NBD device %s (size=%v) to block file %s", dev, v.Spec.Size, file)
+
+	v.DevicePath = dev
+	d.buseDevices[v.ID] = bd
+	return bd, d.UpdateVol(v)
+}
+
+// device returns the connected device of volumeID, if any.
+func (d *driver) device(volumeID api.VolumeID) (*buseDev, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	bd, ok := d.buseDevices[volumeID]
+	return bd, ok
+}
 
-	logrus.Infof("Formatting %s with %v", dev, spec.Format)
-	cmd := "/sbin/mkfs." + string(spec.Format)
-	o, err := exec.Command(cmd, dev).Output()
+func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	return d.create(locator, volume.CloneSource(source), spec)
+}
+
+// create creates a volume recording source as given, snapshots are created
+// with their parent as source.
+func (d *driver) create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	volumeID := d.NewVolumeID()
+	buseFile := path.Join(BuseMountPath, string(volumeID))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var parent *api.Volume
+	if source != nil && source.Parent != api.BadVolumeID {
+		var err error
+		parent, err = d.GetVol(source.Parent)
+		if err == nil {
+			err = volume.CloneSpec(parent, spec)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
+
+	if spec.Size == 0 {
+		return api.BadVolumeID, errors.New("Volume size cannot be zero")
+	}
+
+	if spec.Format == "" {
+		return api.BadVolumeID, errors.New("Missing volume format")
+	}
+
+	release, err := d.Provision(spec.Size)
 	if err != nil {
-		logrus.Warnf("Failed to run command %v %v: %v", cmd, dev, o)
 		return api.BadVolumeID, err
 	}
+	defer release()
+
+	// A clone shares the layers of its parent, which hold the parent's
+	// filesystem if it was ever attached.
+	var bases []string
+	if parent != nil {
+		if bases, err = d.freeze(parent); err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
 
-	logrus.Infof("BUSE mapped NBD device %s (size=%v) to block file %s", dev, spec.Size, buseFile)
+	// Create a layer on the local buse path with this UUID.
+	if err := createLayer(buseFile, int64(spec.Size)); err != nil {
+		logrus.Println(err)
+		removeLayer(buseFile)
+		return api.BadVolumeID, err
+	}
 
+	if spec.ConfigLabels == nil {
+		spec.ConfigLabels = make(api.Labels)
+	}
+	spec.ConfigLabels[BuseFileLabel] = buseFile
+	// The filesystem is laid out on first attach, a clone already has
+	// its parent's.
+	var format api.Filesystem
+	if parent != nil {
+		format = parent.Format
+	}
 	v := &api.Volume{
-		ID:         api.VolumeID(volumeID),
-		Source:     source,
-		Locator:    locator,
-		Ctime:      time.Now(),
-		Spec:       spec,
-		LastScan:   time.Now(),
-		Format:     spec.Format,
-		State:      api.VolumeAvailable,
-		Status:     api.Up,
-		DevicePath: dev,
+		ID:       volumeID,
+		Source:   source,
+		Locator:  locator,
+		Ctime:    time.Now(),
+		Spec:     spec,
+		LastScan: time.Now(),
+		Format:   format,
+		State:    api.VolumeDetached,
+		Status:   api.Up,
 	}
-
-	d.buseDevices[dev] = bd
-
+	setBases(v, bases)
 	err = d.CreateVol(v)
 	if err != nil {
+		removeLayer(buseFile)
 		return api.BadVolumeID, err
 	}
-	return v.ID, err
+
+	logrus.Infof("BUSE created volume %v with block file %s", volumeID, buseFile)
+	return v.ID, nil
 }
 
 func (d *driver) Delete(volumeID api.VolumeID) error {
@@ -209,17 +530,15 @@ func (d *driver) Delete(volumeID api.VolumeID) error {
 		return err
 	}
 
-	bd, ok := d.buseDevices[v.DevicePath]
-	if !ok {
-		err = fmt.Errorf("Cannot locate a BUSE device for %s", v.DevicePath)
-		logrus.Println(err)
-		return err
+	// Close the NBD connection and clean up the buse block file.
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if bd, ok := d.buseDevices[volumeID]; ok {
+		bd.nbd.Disconnect()
+		bd.c.close()
+		delete(d.buseDevices, volumeID)
 	}
-
-	// Clean up buse block file and close the NBD connection.
-	os.Remove(bd.file)
-	bd.f.Close()
-	bd.nbd.Disconnect()
+	removeLayer(blockFilePath(v))
 
 	logrus.Infof("BUSE deleted volume %v at NBD device %s", volumeID, v.DevicePath)
 
@@ -229,6 +548,8 @@ func (d *driver) Delete(volumeID api.VolumeID) error {
 		return err
 	}
 
+	// Flatten the chains of volumes that were sharing bases with it.
+	d.collect()
 	return nil
 }
 
@@ -237,10 +558,15 @@ func (d *driver) Mount(volumeID api.VolumeID, mountpath string) error {
 	if err != nil {
 		return fmt.Errorf("Failed to locate volume %q", string(volumeID))
 	}
+	if _, ok := d.device(volumeID); !ok {
+		return volume.ErrVolDetached
+	}
 	err = syscall.Mount(v.DevicePath, mountpath, string(v.Spec.Format), 0, "")
 	if err != nil {
 		logrus.Errorf("Mounting %s on %s failed because of %v", v.DevicePath, mountpath, err)
-		return fmt.Errorf("Failed to mount %v at %v: %v", v.DevicePath, mountpath, err)
+		err = fmt.Errorf("Failed to mount %v at %v: %v", v.DevicePath, mountpath, err)
+		alerts.Raise(api.AlertWarning, api.ResourceVolume, string(volumeID), err.Error())
+		return err
 	}
 
 	logrus.Infof("BUSE mounted NBD device %s at %s", v.DevicePath, mountpath)
@@ -273,33 +599,87 @@ func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.Volu
 	volIDs[0] = volumeID
 	vols, err := d.Inspect(volIDs)
 	if err != nil {
-		return api.BadVolumeID, nil
+		return api.BadVolumeID, err
+	}
+	if len(vols) != 1 {
+		return api.BadVolumeID, volume.ErrEnoEnt
 	}
 
+	// A snapshot is a clone sharing the frozen layers of the volume.
 	source := &api.Source{Parent: volumeID}
-	newVolumeID, err := d.Create(locator, source, vols[0].Spec)
+	return d.create(locator, source, vols[0].Spec)
+}
+
+// Restore drops the contents of the volume's top layer and shares the
+// layers of snapID below it.
+func (d *driver) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
 	if err != nil {
-		return api.BadVolumeID, nil
+		return err
 	}
-
-	// BUSE does not support snapshots, so just copy the block files.
-	err = copyFile(BuseMountPath+string(volumeID), BuseMountPath+string(newVolumeID))
+	snap, err := d.GetVol(snapID)
 	if err != nil {
-		d.Delete(newVolumeID)
-		return api.BadVolumeID, nil
+		return err
+	}
+	if err := volume.CheckRestore(v, snap); err != nil {
+		return err
 	}
 
-	return newVolumeID, nil
+	bases, err := d.freeze(snap)
+	if err != nil {
+		return err
+	}
+	c, done, err := d.layers(v)
+	if err != nil {
+		return err
+	}
+	err = c.reset(bases)
+	done()
+	if err != nil {
+		return err
+	}
+	setBases(v, bases)
+	if err := d.UpdateVol(v); err != nil {
+		return err
+	}
+	// Drop blocks of the old contents cached by the kernel.
+	if bd, ok := d.buseDevices[volumeID]; ok {
+		if err := bd.nbd.FlushBuffers(); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("BUSE restored volume %v from snapshot %v", volumeID, snapID)
+	d.collect()
+	return nil
 }
 
+// Set updates the locator and grows the volume if spec specifies a larger
+// size. Other fields in spec are ignored.
 func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
-	if spec != nil {
-		return volume.ErrNotSupported
-	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	v, err := d.GetVol(volumeID)
 	if err != nil {
 		return err
 	}
+	if spec != nil && spec.Size != 0 {
+		if err = d.resize(v, spec.Size); err != nil {
+			return err
+		}
+	}
+	if spec != nil {
+		// Trim and FUA take effect when the volume is next attached.
+		for _, label := range []string{BuseTrimLabel, BuseFUALabel} {
+			if value, ok := spec.ConfigLabels[label]; ok {
+				if v.Spec.ConfigLabels == nil {
+					v.Spec.ConfigLabels = make(api.Labels)
+				}
+				v.Spec.ConfigLabels[label] = value
+			}
+		}
+	}
 	if locator != nil {
 		v.Locator = *locator
 	}
@@ -307,22 +687,195 @@ func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *ap
 	return err
 }
 
+// resize grows the block file backing v to size bytes, updates the size of
+// the NBD device and expands the filesystem on it. The caller must hold
+// d.lock.
+func (d *driver) resize(v *api.Volume, size uint64) error {
+	if size < v.Spec.Size {
+		return volume.ErrVolShrink
+	}
+	if size == v.Spec.Size {
+		return nil
+	}
+
+	bd, ok := d.buseDevices[v.ID]
+	c, done, err := d.layers(v)
+	if err == nil {
+		err = c.resize(int64(size))
+		done()
+	}
+	if err == nil && ok {
+		err = bd.nbd.Resize(int64(size))
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("BUSE resized volume %v from %v to %v", v.ID, v.Spec.Size, size)
+	v.Spec.Size = size
+	if err := d.UpdateVol(v); err != nil {
+		return err
+	}
+
+	if ok {
+		if err := fs.Grow(string(v.Format), v.DevicePath, v.AttachPath); err != nil {
+			logrus.Warnf("Failed to grow filesystem on %v: %v", v.DevicePath, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Read sz bytes at offset from the layers of the volume.
+func (d *driver) Read(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := volume.CheckIO(v, buf, sz, offset); err != nil {
+		return 0, err
+	}
+	c, done, err := d.layers(v)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	n, err := c.ReadAt(buf[:sz], offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return int64(n), err
+}
+
+// Write sz bytes at offset to the top layer of the volume. Blocks cached
+// for the NBD device are invalidated so that the write is visible through
+// it.
+func (d *driver) Write(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := volume.CheckIO(v, buf, sz, offset); err != nil {
+		return 0, err
+	}
+	c, done, err := d.layers(v)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	n, err := c.WriteAt(buf[:sz], offset)
+	if err != nil {
+		return int64(n), err
+	}
+	if bd, ok := d.buseDevices[volumeID]; ok {
+		err = bd.nbd.FlushBuffers()
+	}
+	return int64(n), err
+}
+
+// Flush the top layer of the volume to stable storage.
+func (d *driver) Flush(volumeID api.VolumeID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	c, done, err := d.layers(v)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return c.Sync()
+}
+
+// Attach connects the volume to an NBD device if it is not connected and
+// returns the device path. The filesystem is created on first attach.
 func (d *driver) Attach(volumeID api.VolumeID) (string, error) {
-	// Nothing to do on attach.
-	return path.Join(BuseMountPath, string(volumeID)), nil
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.connect(v); err != nil {
+		return "", err
+	}
+
+	if v.Format == "" {
+		if v.Spec.Format != api.FsNone {
+			logrus.Infof("Formatting %s with %v", v.DevicePath, v.Spec.Format)
+			cmd := "/sbin/mkfs." + string(v.Spec.Format)
+			o, err := exec.Command(cmd, v.DevicePath).Output()
+			if err != nil {
+				logrus.Warnf("Failed to run command %v %v: %v", cmd, v.DevicePath, o)
+				return "", err
+			}
+		}
+		v.Format = v.Spec.Format
+	}
+
+	v.State = api.VolumeAttached
+	v.AttachedOn = d.nodeID
+	if err := d.UpdateVol(v); err != nil {
+		return "", err
+	}
+	return v.DevicePath, nil
 }
 
+// Detach disconnects the volume from its NBD device, freeing the device.
 func (d *driver) Detach(volumeID api.VolumeID) error {
-	// Nothing to do on detach.
-	return nil
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	bd, ok := d.buseDevices[volumeID]
+	if !ok {
+		return volume.ErrVolDetached
+	}
+	bd.nbd.Disconnect()
+	bd.c.close()
+	delete(d.buseDevices, volumeID)
+	logrus.Infof("BUSE disconnected NBD device %s from volume %v", v.DevicePath, volumeID)
+
+	v.DevicePath = ""
+	v.State = api.VolumeDetached
+	v.AttachedOn = api.MachineNone
+	return d.UpdateVol(v)
 }
 
+// Stats returns I/O statistics of the NBD device backing the volume.
 func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
-	return api.Stats{}, volume.ErrNotSupported
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	if _, ok := d.device(volumeID); !ok {
+		return api.Stats{}, volume.ErrVolDetached
+	}
+	s, err := d.diskStats.GetDevice(v.DevicePath)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	if v.AttachPath != "" {
+		if fsStats, err := stats.FsStats(v.AttachPath); err == nil {
+			s.BytesUsed = fsStats.BytesUsed
+			volume.CheckUsage(v, s.BytesUsed)
+		}
+	}
+	return *s, nil
 }
 
 func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
-	return api.Alerts{}, volume.ErrNotSupported
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
 }
 
 func (d *driver) Shutdown() {
@@ -330,15 +883,25 @@ func (d *driver) Shutdown() {
 	syscall.Unmount(BuseMountPath, 0)
 }
 
+// setNode records the cluster node ID of this node.
+func (d *driver) setNode(self *api.Node) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.nodeID = api.MachineID(self.Id)
+}
+
 func (d *driver) ClusterInit(self *api.Node, db *cluster.Database) error {
+	d.setNode(self)
 	return nil
 }
 
 func (d *driver) Init(self *api.Node, db *cluster.Database) error {
+	d.setNode(self)
 	return nil
 }
 
 func (d *driver) Join(self *api.Node, db *cluster.Database) error {
+	d.setNode(self)
 	return nil
 }
 
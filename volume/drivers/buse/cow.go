@@ -0,0 +1,611 @@
+package buse
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+// A buse volume is a chain of layers. The top layer is the block file of
+// the volume and takes all writes. The layers below it are read-only bases
+// frozen by snapshots and shared with them. Every layer has a map file with
+// a bit for each block present in the layer. A block is read from the
+// first layer that has it, blocks in no layer read as zeros.
+
+const (
+	// BuseBasesLabel config label recording the base layers of a volume,
+	// top first, separated by commas.
+	BuseBasesLabel = "buse_bases"
+	// BuseBasePath directory of the base layers.
+	BuseBasePath = BuseMountPath + "bases/"
+
+	cowBlockSize = 4096
+	mapSuffix    = ".map"
+	// mapPageSize granularity at which the map file is written.
+	mapPageSize = 4096
+	// mergeBlocks number of blocks merged while I/O is held off.
+	mergeBlocks = 256
+	// blockLockStripes number of locks the blocks are spread over.
+	blockLockStripes = 64
+)
+
+// layer is a block file and the map of the blocks present in it.
+type layer struct {
+	path string
+	f    *os.File
+	m    *os.File
+	// lock protects bits, count and dirty.
+	lock sync.Mutex
+	// full is set for a block file without a map, such as that of a
+	// volume created before volumes were layered. It has every block.
+	full  bool
+	bits  []byte
+	count int64
+	// dirty map pages not yet written to the map file.
+	dirty map[int64]bool
+}
+
+func mapSize(size int64) int64 {
+	blocks := (size + cowBlockSize - 1) / cowBlockSize
+	return (blocks + 7) / 8
+}
+
+// createLayer creates an empty layer of size bytes at path.
+func createLayer(path string, size int64) error {
+	for _, file := range []string{path, path + mapSuffix} {
+		f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		if file == path {
+			err = f.Truncate(size)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLayer removes the block and map files of the layer at path.
+func removeLayer(path string) {
+	os.Remove(path)
+	os.Remove(path + mapSuffix)
+}
+
+func openLayer(path string, size int64) (*layer, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	l := &layer{path: path, f: f, dirty: make(map[int64]bool)}
+	l.m, err = os.OpenFile(path+mapSuffix, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		l.full = true
+		return l, nil
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.bits, err = ioutil.ReadAll(l.m)
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	if n := mapSize(size); int64(len(l.bits)) < n {
+		l.bits = append(l.bits, make([]byte, n-int64(len(l.bits)))...)
+	}
+	for _, b := range l.bits {
+		for ; b != 0; b &= b - 1 {
+			l.count++
+		}
+	}
+	return l, nil
+}
+
+// has returns true if block is present in the layer.
+func (l *layer) has(block int64) bool {
+	if l.full {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	i := block / 8
+	return i < int64(len(l.bits)) && l.bits[i]&(1<<uint(block%8)) != 0
+}
+
+// set marks blocks first to last present in the layer.
+func (l *layer) set(first int64, last int64) {
+	if l.full {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for block := first; block <= last; block++ {
+		i := block / 8
+		if i >= int64(len(l.bits)) {
+			return
+		}
+		if bit := byte(1 << uint(block%8)); l.bits[i]&bit == 0 {
+			l.bits[i] |= bit
+			l.count++
+			l.dirty[i/mapPageSize] = true
+		}
+	}
+}
+
+// empty returns true if no block was written to the layer.
+func (l *layer) empty() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return !l.full && l.count == 0
+}
+
+// flush syncs the block file and then writes the dirty pages of the map,
+// so that the map never covers blocks that are not on disk.
+func (l *layer) flush() error {
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	if l.full {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.dirty) == 0 {
+		return nil
+	}
+	for page := range l.dirty {
+		start := page * mapPageSize
+		end := start + mapPageSize
+		if end > int64(len(l.bits)) {
+			end = int64(len(l.bits))
+		}
+		if _, err := l.m.WriteAt(l.bits[start:end], start); err != nil {
+			return err
+		}
+		delete(l.dirty, page)
+	}
+	return l.m.Sync()
+}
+
+// resize grows the block file and map to size bytes.
+func (l *layer) resize(size int64) error {
+	if err := l.f.Truncate(size); err != nil {
+		return err
+	}
+	if l.full {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if n := mapSize(size); int64(len(l.bits)) < n {
+		l.bits = append(l.bits, make([]byte, n-int64(len(l.bits)))...)
+	}
+	return nil
+}
+
+// clear drops all blocks of the layer.
+func (l *layer) clear(size int64) error {
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if err := l.f.Truncate(size); err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.full {
+		m, err := os.OpenFile(l.path+mapSuffix, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		l.m = m
+		l.full = false
+	}
+	l.bits = make([]byte, mapSize(size))
+	l.count = 0
+	for page := int64(0); page*mapPageSize < int64(len(l.bits)); page++ {
+		l.dirty[page] = true
+	}
+	return nil
+}
+
+func (l *layer) close() error {
+	if l.m != nil {
+		l.m.Close()
+	}
+	return l.f.Close()
+}
+
+// cow is the chain of layers of a volume. It implements the Device
+// interface.
+type cow struct {
+	// lock is held for reading by I/O and for writing while the chain
+	// changes.
+	lock sync.RWMutex
+	size int64
+	// layers top first.
+	layers []*layer
+	// blockLocks serialize the writes to the blocks spread over them, so
+	// that a block copied up does not overwrite data written to it.
+	blockLocks [blockLockStripes]sync.Mutex
+}
+
+// openCow opens the layers top and bases of a volume of size bytes.
+func openCow(top string, bases []string, size int64) (*cow, error) {
+	c := &cow{size: size}
+	for _, path := range append([]string{top}, bases...) {
+		l, err := openLayer(path, size)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.layers = append(c.layers, l)
+	}
+	return c, nil
+}
+
+// bases returns the paths of the layers below the top.
+func (c *cow) bases() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	bases := make([]string, 0, len(c.layers)-1)
+	for _, l := range c.layers[1:] {
+		bases = append(bases, l.path)
+	}
+	return bases
+}
+
+// find returns the first layer at or below the layer at index from that has
+// block, or nil.
+func (c *cow) find(block int64, from int) *layer {
+	for _, l := range c.layers[from:] {
+		if l.has(block) {
+			return l
+		}
+	}
+	return nil
+}
+
+// readAt reads b at off from l, a nil layer or blocks past the end of its
+// file read as zeros.
+func readAt(l *layer, b []byte, off int64) error {
+	n := 0
+	if l != nil {
+		var err error
+		n, err = l.f.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	for i := range b[n:] {
+		b[n+i] = 0
+	}
+	return nil
+}
+
+func (c *cow) ReadAt(b []byte, off int64) (int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	n := int64(len(b))
+	if off+n > c.size {
+		n = c.size - off
+	}
+	// Read runs of blocks from the same layer at once.
+	for pos := off; pos < off+n; {
+		block := pos / cowBlockSize
+		l := c.find(block, 0)
+		end := (block + 1) * cowBlockSize
+		for ; end < off+n && c.find(end/cowBlockSize, 0) == l; end += cowBlockSize {
+		}
+		if end > off+n {
+			end = off + n
+		}
+		if err := readAt(l, b[pos-off:end-off], pos); err != nil {
+			return int(pos - off), err
+		}
+		pos = end
+	}
+	if n < int64(len(b)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+func (c *cow) WriteAt(b []byte, off int64) (int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeAt(b, off)
+}
+
+// lockBlocks locks blocks first to last against other writes and returns
+// the function unlocking them. The locks are taken in order, so that writes
+// of overlapping ranges do not deadlock.
+func (c *cow) lockBlocks(first int64, last int64) func() {
+	var stripes [blockLockStripes]bool
+	for block := first; block <= last && block < first+blockLockStripes; block++ {
+		stripes[block%blockLockStripes] = true
+	}
+	for i, locked := range stripes {
+		if locked {
+			c.blockLocks[i].Lock()
+		}
+	}
+	return func() {
+		for i, locked := range stripes {
+			if locked {
+				c.blockLocks[i].Unlock()
+			}
+		}
+	}
+}
+
+// writeAt writes b at off to the top layer, copying up blocks partially
+// covered by b. The caller must hold c.lock.
+func (c *cow) writeAt(b []byte, off int64) (int, error) {
+	end := off + int64(len(b))
+	if off < 0 || end > c.size {
+		return 0, volume.ErrVolBounds
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	first := off / cowBlockSize
+	last := (end - 1) / cowBlockSize
+	unlock := c.lockBlocks(first, last)
+	defer unlock()
+	if off%cowBlockSize != 0 {
+		if err := c.copyUp(first); err != nil {
+			return 0, err
+		}
+	}
+	if end%cowBlockSize != 0 {
+		if err := c.copyUp(last); err != nil {
+			return 0, err
+		}
+	}
+	top := c.layers[0]
+	n, err := top.f.WriteAt(b, off)
+	if err != nil {
+		return n, err
+	}
+	top.set(first, last)
+	return n, nil
+}
+
+// copyUp copies block from the layers below into the top layer if the top
+// layer does not have it. The caller must hold c.lock and the lock of block.
+func (c *cow) copyUp(block int64) error {
+	top := c.layers[0]
+	if top.has(block) {
+		return nil
+	}
+	buf := make([]byte, cowBlockSize)
+	off := block * cowBlockSize
+	if off+int64(len(buf)) > c.size {
+		buf = buf[:c.size-off]
+	}
+	if err := readAt(c.find(block, 1), buf, off); err != nil {
+		return err
+	}
+	if _, err := top.f.WriteAt(buf, off); err != nil {
+		return err
+	}
+	top.set(block, block)
+	return nil
+}
+
+// Sync commits the top layer to stable storage.
+func (c *cow) Sync() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.layers[0].flush()
+}
+
+// Trim punches out whole blocks of the range from the top layer, they read
+// as zeros. Partial blocks are zeroed. Ranges starting past the end of the
+// volume are out of bounds.
+func (c *cow) Trim(off int64, length int64) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if off < 0 || length < 0 || off > c.size {
+		return volume.ErrVolBounds
+	}
+	end := off + length
+	if end > c.size {
+		end = c.size
+	}
+	first := (off + cowBlockSize - 1) / cowBlockSize
+	last := end / cowBlockSize
+	if first >= last {
+		_, err := c.writeAt(make([]byte, end-off), off)
+		return err
+	}
+	if head := first * cowBlockSize; off < head {
+		if _, err := c.writeAt(make([]byte, head-off), off); err != nil {
+			return err
+		}
+	}
+	if tail := last * cowBlockSize; tail < end {
+		if _, err := c.writeAt(make([]byte, end-tail), tail); err != nil {
+			return err
+		}
+	}
+	unlock := c.lockBlocks(first, last-1)
+	defer unlock()
+	top := c.layers[0]
+	err := syscall.Fallocate(int(top.f.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,
+		first*cowBlockSize, (last-first)*cowBlockSize)
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: top.path, Err: err}
+	}
+	// Hide the blocks of the layers below.
+	if len(c.layers) > 1 {
+		top.set(first, last-1)
+	}
+	return nil
+}
+
+// freeze turns the top layer into a read-only base at path base and starts
+// an empty top layer. Nothing is done if the top layer is empty, the
+// volume's bases are its contents. It returns true if a layer was frozen.
+func (c *cow) freeze(base string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	top := c.layers[0]
+	if top.empty() {
+		return false, nil
+	}
+	if err := top.flush(); err != nil {
+		return false, err
+	}
+	path := top.path
+	if err := os.Rename(path, base); err != nil {
+		return false, err
+	}
+	if !top.full {
+		if err := os.Rename(path+mapSuffix, base+mapSuffix); err != nil {
+			os.Rename(base, path)
+			return false, err
+		}
+	}
+	err := createLayer(path, c.size)
+	var nt *layer
+	if err == nil {
+		nt, err = openLayer(path, c.size)
+	}
+	if err != nil {
+		removeLayer(path)
+		os.Rename(base, path)
+		if !top.full {
+			os.Rename(base+mapSuffix, path+mapSuffix)
+		}
+		return false, err
+	}
+	top.path = base
+	c.layers = append([]*layer{nt}, c.layers...)
+	return true, nil
+}
+
+// reset drops the contents of the top layer and replaces the bases.
+func (c *cow) reset(bases []string) error {
+	layers := make([]*layer, 0, len(bases))
+	for _, path := range bases {
+		l, err := openLayer(path, c.size)
+		if err != nil {
+			for _, l := range layers {
+				l.close()
+			}
+			return err
+		}
+		layers = append(layers, l)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	top := c.layers[0]
+	if err := top.clear(c.size); err != nil {
+		for _, l := range layers {
+			l.close()
+		}
+		return err
+	}
+	for _, l := range c.layers[1:] {
+		l.close()
+	}
+	c.layers = append([]*layer{top}, layers...)
+	return top.flush()
+}
+
+// merge copies the blocks of the base right below the top layer that the
+// top layer does not have into it and drops the base from the chain. I/O
+// is held off for mergeBlocks blocks at a time. It returns the path of the
+// merged base.
+func (c *cow) merge() (string, error) {
+	buf := make([]byte, cowBlockSize)
+	zero := make([]byte, cowBlockSize)
+	blocks := (c.size + cowBlockSize - 1) / cowBlockSize
+	for start := int64(0); start < blocks; start += mergeBlocks {
+		c.lock.Lock()
+		top, base := c.layers[0], c.layers[1]
+		for block := start; block < start+mergeBlocks && block < blocks; block++ {
+			if !base.has(block) || top.has(block) {
+				continue
+			}
+			off := block * cowBlockSize
+			b := buf
+			if off+int64(len(b)) > c.size {
+				b = b[:c.size-off]
+			}
+			if err := readAt(base, b, off); err != nil {
+				c.lock.Unlock()
+				return "", err
+			}
+			// Zeros need not be copied if no layer below has the block.
+			if bytes.Equal(b, zero[:len(b)]) && c.find(block, 2) == nil {
+				continue
+			}
+			if _, err := top.f.WriteAt(b, off); err != nil {
+				c.lock.Unlock()
+				return "", err
+			}
+			top.set(block, block)
+		}
+		c.lock.Unlock()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	top, base := c.layers[0], c.layers[1]
+	if err := top.flush(); err != nil {
+		return "", err
+	}
+	c.layers = append([]*layer{top}, c.layers[2:]...)
+	base.close()
+	return base.path, nil
+}
+
+// resize grows the volume to size bytes.
+func (c *cow) resize(size int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.layers[0].resize(size); err != nil {
+		return err
+	}
+	c.size = size
+	return nil
+}
+
+// close flushes the top layer and closes all layers.
+func (c *cow) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var err error
+	if len(c.layers) > 0 {
+		err = c.layers[0].flush()
+	}
+	for _, l := range c.layers {
+		l.close()
+	}
+	c.layers = nil
+	return err
+}
+
+// volumeBases parses the value of BuseBasesLabel.
+func volumeBases(label string) []string {
+	if label == "" {
+		return nil
+	}
+	return strings.Split(label, ",")
+}
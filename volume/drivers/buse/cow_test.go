@@ -0,0 +1,199 @@
+package buse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+const cowSize = 2 << 20
+
+func cowSetup(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cow_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func newCow(t *testing.T, top string, bases ...string) *cow {
+	if err := createLayer(top, cowSize); err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	c, err := openCow(top, bases, cowSize)
+	if err != nil {
+		t.Fatalf("Failed to open layers: %v", err)
+	}
+	return c
+}
+
+func readCow(t *testing.T, c *cow, off int64, n int) []byte {
+	b := make([]byte, n)
+	_, err := c.ReadAt(b, off)
+	assert.NoError(t, err, "Failed to read")
+	return b
+}
+
+func TestCowSnapshot(t *testing.T) {
+	dir := cowSetup(t)
+	defer os.RemoveAll(dir)
+
+	vol := newCow(t, filepath.Join(dir, "vol"))
+	defer vol.close()
+	frozen, err := vol.freeze(filepath.Join(dir, "empty"))
+	assert.NoError(t, err)
+	assert.False(t, frozen, "Empty layer must not be frozen")
+
+	_, err = vol.WriteAt(bytes.Repeat([]byte("a"), 2*cowBlockSize), 0)
+	assert.NoError(t, err, "Failed to write")
+	base := filepath.Join(dir, "base")
+	frozen, err = vol.freeze(base)
+	assert.NoError(t, err, "Failed to freeze")
+	assert.True(t, frozen)
+	assert.Equal(t, []string{base}, vol.bases())
+
+	snap := newCow(t, filepath.Join(dir, "snap"), vol.bases()...)
+	defer snap.close()
+
+	_, err = vol.WriteAt([]byte("b"), 0)
+	assert.NoError(t, err, "Failed to write")
+	assert.Equal(t, "baaa", string(readCow(t, vol, 0, 4)))
+	assert.Equal(t, "aaaa", string(readCow(t, snap, 0, 4)))
+	// The partially written block was copied up.
+	assert.Equal(t, bytes.Repeat([]byte("a"), cowBlockSize-1), readCow(t, vol, 1, cowBlockSize-1))
+	// Blocks in no layer read as zeros.
+	assert.Equal(t, make([]byte, 4), readCow(t, vol, 3*cowBlockSize, 4))
+
+	// Only the block written after the snapshot is in the top layer.
+	fi, err := os.Stat(base + mapSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(mapSize(cowSize)), fi.Size())
+	assert.True(t, vol.layers[0].has(0))
+	assert.False(t, vol.layers[0].has(1))
+
+	// Reopening the layers preserves their contents.
+	assert.NoError(t, vol.close())
+	vol, err = openCow(filepath.Join(dir, "vol"), []string{base}, cowSize)
+	assert.NoError(t, err, "Failed to reopen")
+	defer vol.close()
+	assert.Equal(t, "baaa", string(readCow(t, vol, 0, 4)))
+	assert.Equal(t, "aaaa", string(readCow(t, vol, cowBlockSize, 4)))
+}
+
+func TestCowMerge(t *testing.T) {
+	dir := cowSetup(t)
+	defer os.RemoveAll(dir)
+
+	vol := newCow(t, filepath.Join(dir, "vol"))
+	defer vol.close()
+	_, err := vol.WriteAt([]byte("base"), 0)
+	assert.NoError(t, err)
+	_, err = vol.WriteAt([]byte("base"), 300*cowBlockSize)
+	assert.NoError(t, err)
+	_, err = vol.freeze(filepath.Join(dir, "base"))
+	assert.NoError(t, err)
+	_, err = vol.WriteAt([]byte("top"), 0)
+	assert.NoError(t, err)
+
+	merged, err := vol.merge()
+	assert.NoError(t, err, "Failed to merge")
+	assert.Equal(t, filepath.Join(dir, "base"), merged)
+	assert.Empty(t, vol.bases())
+	removeLayer(merged)
+
+	assert.Equal(t, "tope", string(readCow(t, vol, 0, 4)))
+	assert.Equal(t, "base", string(readCow(t, vol, 300*cowBlockSize, 4)))
+}
+
+func TestCowTrim(t *testing.T) {
+	dir := cowSetup(t)
+	defer os.RemoveAll(dir)
+
+	vol := newCow(t, filepath.Join(dir, "vol"))
+	defer vol.close()
+	_, err := vol.WriteAt(bytes.Repeat([]byte("a"), 3*cowBlockSize), 0)
+	assert.NoError(t, err)
+	_, err = vol.freeze(filepath.Join(dir, "base"))
+	assert.NoError(t, err)
+
+	// Trim the second block and the first half of the third.
+	assert.NoError(t, vol.Trim(cowBlockSize, cowBlockSize+cowBlockSize/2))
+	b := readCow(t, vol, 0, 3*cowBlockSize)
+	assert.Equal(t, bytes.Repeat([]byte("a"), cowBlockSize), b[:cowBlockSize])
+	assert.Equal(t, make([]byte, cowBlockSize+cowBlockSize/2), b[cowBlockSize:5*cowBlockSize/2])
+	assert.Equal(t, bytes.Repeat([]byte("a"), cowBlockSize/2), b[5*cowBlockSize/2:])
+
+	assert.Equal(t, volume.ErrVolBounds, vol.Trim(cowSize+cowBlockSize, cowBlockSize),
+		"Trims past the end of the volume must fail")
+}
+
+func TestCowConcurrentWrites(t *testing.T) {
+	dir := cowSetup(t)
+	defer os.RemoveAll(dir)
+
+	vol := newCow(t, filepath.Join(dir, "vol"))
+	defer vol.close()
+	_, err := vol.WriteAt(bytes.Repeat([]byte("a"), cowSize), 0)
+	assert.NoError(t, err, "Failed to write")
+	_, err = vol.freeze(filepath.Join(dir, "base"))
+	assert.NoError(t, err, "Failed to freeze")
+
+	// Partial writes copy the base up while whole blocks are written.
+	var wg sync.WaitGroup
+	for off := int64(0); off < cowSize; off += cowBlockSize {
+		wg.Add(2)
+		go func(off int64) {
+			defer wg.Done()
+			vol.WriteAt(bytes.Repeat([]byte("b"), cowBlockSize), off)
+		}(off)
+		go func(off int64) {
+			defer wg.Done()
+			vol.WriteAt([]byte("c"), off+1)
+		}(off)
+	}
+	wg.Wait()
+	for off := int64(0); off < cowSize; off += cowBlockSize {
+		b := readCow(t, vol, off, cowBlockSize)
+		if bytes.IndexByte(b, 'a') >= 0 {
+			t.Fatalf("Base data copied up over the write of block %v", off/cowBlockSize)
+		}
+	}
+}
+
+func TestCowUnlayered(t *testing.T) {
+	dir := cowSetup(t)
+	defer os.RemoveAll(dir)
+
+	// A block file without a map has every block.
+	file := filepath.Join(dir, "vol")
+	data := bytes.Repeat([]byte("old"), cowBlockSize)
+	assert.NoError(t, ioutil.WriteFile(file, data, 0644))
+	assert.NoError(t, os.Truncate(file, cowSize))
+	vol, err := openCow(file, nil, cowSize)
+	assert.NoError(t, err)
+	defer vol.close()
+
+	_, err = vol.freeze(filepath.Join(dir, "base"))
+	assert.NoError(t, err, "Failed to freeze")
+	_, err = vol.WriteAt([]byte("new"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "newold", string(readCow(t, vol, 0, 6)))
+	assert.Equal(t, data[cowBlockSize:], readCow(t, vol, cowBlockSize, len(data)-cowBlockSize))
+
+	// Restore the base.
+	assert.NoError(t, vol.reset([]string{filepath.Join(dir, "base")}))
+	assert.Equal(t, "oldold", string(readCow(t, vol, 0, 6)))
+
+	assert.NoError(t, vol.resize(2*cowSize))
+	assert.Equal(t, make([]byte, 4), readCow(t, vol, 2*cowSize-4, 4))
+	_, err = vol.WriteAt([]byte("end"), 2*cowSize-3)
+	assert.NoError(t, err)
+	assert.Equal(t, "end", string(readCow(t, vol, 2*cowSize-3, 3)))
+}
@@ -8,8 +8,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -18,7 +23,8 @@ import (
 
 const (
 	// Defined in <linux/fs.h>:
-	BLKROSET = 4701
+	BLKROSET  = 4701
+	BLKFLSBUF = 4705
 	// Defined in <linux/nbd.h>:
 	NBD_SET_SOCK        = 43776
 	NBD_SET_BLKSIZE     = 43777
@@ -37,6 +43,10 @@ const (
 	NBD_CMD_DISC  = 2
 	NBD_CMD_FLUSH = 3
 	NBD_CMD_TRIM  = 4
+	// The command is in the low bits of the type field, flags in the
+	// high bits.
+	NBD_CMD_MASK_COMMAND = 0x0000ffff
+	NBD_CMD_FLAG_FUA     = (1 << 16)
 	// values for flags field
 	NBD_FLAG_HAS_FLAGS  = (1 << 0) // nbd-server supports flags
 	NBD_FLAG_READ_ONLY  = (1 << 1) // device is read-only
@@ -49,6 +59,12 @@ const (
 	NBD_REQUEST_MAGIC = 0x25609513
 	NBD_REPLY_MAGIC   = 0x67446698
 	// Do *not* use magics: 0x12560953 0x96744668.
+
+	// DefaultQueueDepth number of requests served concurrently.
+	DefaultQueueDepth = 16
+	// Requests up to bufferSize, including the reply header, are served
+	// from pooled buffers.
+	bufferSize = 1<<20 + 16
 )
 
 // ioctl() helper function
@@ -66,6 +82,18 @@ type Device interface {
 	WriteAt(b []byte, off int64) (n int, err error)
 }
 
+// Syncer is implemented by devices that can commit writes to stable
+// storage. Flush and FUA are only advertised for such devices.
+type Syncer interface {
+	Sync() error
+}
+
+// Trimmer is implemented by devices that can discard a range of blocks.
+// TRIM is only advertised for such devices.
+type Trimmer interface {
+	Trim(off int64, length int64) error
+}
+
 type request struct {
 	magic  uint32
 	typus  uint32
@@ -86,7 +114,15 @@ type NBD struct {
 	deviceFile *os.File
 	size       int64
 	socket     int
+	flags      uint32
 	mutex      *sync.Mutex
+	closed     bool
+	serving    bool
+	onError    func(err error)
+	queueDepth int
+	// replyMutex serializes replies on the socket.
+	replyMutex sync.Mutex
+	buffers    sync.Pool
 }
 
 func Create(device Device, size int64) *NBD {
@@ -96,11 +132,42 @@ func Create(device Device, size int64) *NBD {
 			size:       size,
 			deviceFile: nil,
 			socket:     0,
-			mutex:      &sync.Mutex{}}
+			flags:      NBD_FLAG_HAS_FLAGS,
+			mutex:      &sync.Mutex{},
+			queueDepth: DefaultQueueDepth,
+			buffers: sync.Pool{New: func() interface{} {
+				return make([]byte, bufferSize)
+			}}}
 	}
 	return nil
 }
 
+// SetQueueDepth sets the number of requests served concurrently once the
+// NBD is connected.
+func (nbd *NBD) SetQueueDepth(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	nbd.queueDepth = depth
+}
+
+// SetFlags sets the NBD_FLAG_* transmission flags advertised to the kernel
+// when the NBD is connected. Flags the device cannot serve are dropped, and
+// flush is advertised with FUA as the kernel only sends FUA writes to
+// devices with a write cache.
+func (nbd *NBD) SetFlags(flags uint32) {
+	if _, ok := nbd.device.(Syncer); !ok {
+		flags &^= NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA
+	}
+	if _, ok := nbd.device.(Trimmer); !ok {
+		flags &^= NBD_FLAG_SEND_TRIM
+	}
+	if flags&NBD_FLAG_SEND_FUA != 0 {
+		flags |= NBD_FLAG_SEND_FLUSH
+	}
+	nbd.flags = flags | NBD_FLAG_HAS_FLAGS
+}
+
 // Return true if connected.
 func (nbd *NBD) IsConnected() bool {
 	return nbd.deviceFile != nil && nbd.socket > 0
@@ -122,43 +189,89 @@ func (nbd *NBD) Size(size int64) (err error) {
 	return err
 }
 
+// Resize a connected NBD to size bytes.
+func (nbd *NBD) Resize(size int64) (err error) {
+	nbd.mutex.Lock()
+	defer nbd.mutex.Unlock()
+	if !nbd.IsConnected() {
+		nbd.size = size
+		return nil
+	}
+	if err = ioctl(nbd.deviceFile.Fd(), NBD_SET_SIZE, uintptr(size)); err != nil {
+		return &os.PathError{Op: "ioctl NBD_SET_SIZE", Path: nbd.deviceFile.Name(), Err: err}
+	}
+	nbd.size = size
+	return nil
+}
+
+// FlushBuffers invalidates blocks of a connected NBD cached by the kernel,
+// so that changes made directly to the backing device become visible.
+func (nbd *NBD) FlushBuffers() error {
+	nbd.mutex.Lock()
+	defer nbd.mutex.Unlock()
+	if !nbd.IsConnected() {
+		return nil
+	}
+	if err := ioctl(nbd.deviceFile.Fd(), BLKFLSBUF, 0); err != nil {
+		return &os.PathError{Op: "ioctl BLKFLSBUF", Path: nbd.deviceFile.Name(), Err: err}
+	}
+	return nil
+}
+
+// OnError registers fn to be called if the NBD connection fails.
+func (nbd *NBD) OnError(fn func(err error)) {
+	nbd.onError = fn
+}
+
+// fail reports an unexpected failure of the NBD connection and disconnects.
+func (nbd *NBD) fail(err error) {
+	logrus.Error(err)
+	if nbd.onError != nil {
+		nbd.onError(err)
+	}
+	nbd.Disconnect()
+}
+
 // Connect the network block device.
 func (nbd *NBD) Connect() (dev string, err error) {
+	return nbd.ConnectDevice("")
+}
+
+// ConnectDevice connects the network block device, using the device at
+// preferred if it is free.
+func (nbd *NBD) ConnectDevice(preferred string) (dev string, err error) {
 	pair, err := syscall.Socketpair(syscall.SOCK_STREAM, syscall.AF_UNIX, 0)
 	if err != nil {
 		return "", err
 	}
 
-	// Find free NBD device.
-	for i := 0; ; i++ {
-		dev = fmt.Sprintf("/dev/nbd%d", i)
-		if _, err = os.Stat(dev); os.IsNotExist(err) {
-			dev = ""
-			return "", errors.New("No more NBD devices left.")
-		}
-		if _, err = os.Stat(fmt.Sprintf("/sys/block/nbd%d/pid", i)); !os.IsNotExist(err) {
-			continue // Busy.
-		}
-
-		logrus.Infof("Attempting to open device %v", dev)
-		if nbd.deviceFile, err = os.Open(dev); err == nil {
-			// Possible candidate.
-			ioctl(nbd.deviceFile.Fd(), BLKROSET, 0)
-			if err := ioctl(nbd.deviceFile.Fd(), NBD_SET_SOCK, uintptr(pair[0])); err == nil {
-				nbd.socket = pair[1]
+	if preferred == "" || !nbd.open(preferred, pair) {
+		// Find free NBD device.
+		for i := 0; ; i++ {
+			dev = fmt.Sprintf("/dev/nbd%d", i)
+			if _, err = os.Stat(dev); os.IsNotExist(err) {
+				dev = ""
+				syscall.Close(pair[0])
+				syscall.Close(pair[1])
+				return "", errors.New("No more NBD devices left.")
+			}
+			if nbd.open(dev, pair) {
 				break // Success.
 			}
 		}
+	} else {
+		dev = preferred
 	}
 
 	// Setup.
 	if err = nbd.Size(nbd.size); err != nil {
 		// Already set by nbd.Size().
-	} else if err = ioctl(nbd.deviceFile.Fd(), NBD_SET_FLAGS, 1); err != nil {
+	} else if err = ioctl(nbd.deviceFile.Fd(), NBD_SET_FLAGS, uintptr(nbd.flags)); err != nil {
 		err = &os.PathError{nbd.deviceFile.Name(), "ioctl NBD_SET_FLAGS", err}
 	} else {
 		go nbd.connect()
-		go nbd.handle()
+		nbd.serving = true
+		go nbd.handle(nbd.socket)
 	}
 
 	nbd.devicePath = dev
@@ -166,6 +279,76 @@ func (nbd *NBD) Connect() (dev string, err error) {
 	return dev, err
 }
 
+// open attaches the kernel end of the socket pair to dev if dev is free.
+func (nbd *NBD) open(dev string, pair [2]int) bool {
+	if _, err := os.Stat(path.Join("/sys/block", path.Base(dev), "pid")); !os.IsNotExist(err) {
+		return false // Busy.
+	}
+
+	logrus.Infof("Attempting to open device %v", dev)
+	f, err := os.Open(dev)
+	if err != nil {
+		return false
+	}
+	// Possible candidate.
+	ioctl(f.Fd(), BLKROSET, 0)
+	if err := ioctl(f.Fd(), NBD_SET_SOCK, uintptr(pair[0])); err != nil {
+		f.Close()
+		return false
+	}
+	nbd.deviceFile = f
+	nbd.socket = pair[1]
+	return true
+}
+
+// Mounted returns true if a filesystem is mounted from dev.
+func Mounted(dev string) (bool, error) {
+	b, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == dev {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reclaim frees the NBD device dev if it was left connected by a process
+// that no longer exists, such as a previous instance of this daemon.
+func Reclaim(dev string) error {
+	b, err := ioutil.ReadFile(path.Join("/sys/block", path.Base(dev), "pid"))
+	if os.IsNotExist(err) {
+		return nil // Free.
+	} else if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return err
+	}
+	if pid == os.Getpid() {
+		return fmt.Errorf("Device %v is in use", dev)
+	}
+	if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+		return fmt.Errorf("Device %v is in use by process %v", dev, pid)
+	}
+
+	logrus.Infof("Reclaiming stale device %v of process %v", dev, pid)
+	f, err := os.Open(dev)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ioctl(f.Fd(), NBD_DISCONNECT, 0)
+	ioctl(f.Fd(), NBD_CLEAR_QUE, 0)
+	if err = ioctl(f.Fd(), NBD_CLEAR_SOCK, 0); err != nil {
+		return &os.PathError{Op: "ioctl NBD_CLEAR_SOCK", Path: dev, Err: err}
+	}
+	return nil
+}
+
 func (nbd *NBD) Disconnect() {
 	nbd.mutex.Lock()
 	if nbd.IsConnected() {
@@ -174,15 +357,26 @@ func (nbd *NBD) Disconnect() {
 		ioctl(nbd.deviceFile.Fd(), NBD_CLEAR_SOCK, 0)
 		nbd.deviceFile.Close()
 		nbd.deviceFile = nil
+		nbd.closed = true
 
 		dummy := make([]byte, 1)
 		syscall.Write(nbd.socket, dummy)
-		syscall.Close(nbd.socket)
+		if !nbd.serving {
+			// Otherwise closed by handle once no worker can reply on it.
+			syscall.Close(nbd.socket)
+		}
 		nbd.socket = 0
 	}
 	nbd.mutex.Unlock()
 }
 
+// isClosed returns true once the NBD was disconnected.
+func (nbd *NBD) isClosed() bool {
+	nbd.mutex.Lock()
+	defer nbd.mutex.Unlock()
+	return nbd.closed
+}
+
 func (nbd *NBD) connect() {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -194,68 +388,197 @@ func (nbd *NBD) connect() {
 }
 
 // Handle block requests.
-func (nbd *NBD) handle() {
-	buf := make([]byte, 2<<19)
-	var x request
+func (nbd *NBD) handle(sock int) {
+	defer syscall.Close(sock)
+	err := nbd.serve(sock)
+	if err != nil && !nbd.isClosed() {
+		nbd.fail(fmt.Errorf("Error serving device %s: %v", nbd.devicePath, err))
+		return
+	}
+	logrus.Infof("Disconnecting device %s", nbd.devicePath)
+	nbd.Disconnect()
+}
+
+// job is a request dispatched to a worker. buf holds the reply header
+// followed by the data of the request.
+type job struct {
+	request
+	buf []byte
+}
+
+func (j *job) data() []byte {
+	return j.buf[16 : 16+j.len]
+}
 
+// serve reads requests from sock and dispatches them to queueDepth workers
+// until the kernel disconnects. Replies are sent in order of completion.
+// A flush is only started once the requests before it have completed.
+func (nbd *NBD) serve(sock int) error {
+	jobs := make(chan *job, nbd.queueDepth)
+	var inflight, workers sync.WaitGroup
+	for i := 0; i < nbd.queueDepth; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				nbd.do(sock, j)
+				inflight.Done()
+			}
+		}()
+	}
+	defer func() {
+		inflight.Wait()
+		close(jobs)
+		workers.Wait()
+	}()
+
+	header := make([]byte, 28)
 	for {
-		bytes, err := syscall.Read(nbd.socket, buf[0:28])
-		if nbd.deviceFile == nil {
-			logrus.Infof("Disconnecting device %s", nbd.devicePath)
-			return
+		if err := nbd.read(sock, header); err != nil {
+			return err
 		}
-
-		if bytes < 0 || err != nil {
-			logrus.Errorf("Error reading from device %s", nbd.devicePath)
-			nbd.Disconnect()
-			return
+		j := &job{request: request{
+			magic:  binary.BigEndian.Uint32(header),
+			typus:  binary.BigEndian.Uint32(header[4:8]),
+			handle: binary.BigEndian.Uint64(header[8:16]),
+			from:   binary.BigEndian.Uint64(header[16:24]),
+			len:    binary.BigEndian.Uint32(header[24:28]),
+		}}
+		if j.magic != NBD_REQUEST_MAGIC && j.magic != NBD_REPLY_MAGIC {
+			return fmt.Errorf("Invalid packet command recieved on device %s", nbd.devicePath)
 		}
 
-		x.magic = binary.BigEndian.Uint32(buf)
-		x.typus = binary.BigEndian.Uint32(buf[4:8])
-		x.handle = binary.BigEndian.Uint64(buf[8:16])
-		x.from = binary.BigEndian.Uint64(buf[16:24])
-		x.len = binary.BigEndian.Uint32(buf[24:28])
-
-		switch x.magic {
-		case NBD_REPLY_MAGIC:
-			fallthrough
-		case NBD_REQUEST_MAGIC:
-			switch x.typus {
-			case NBD_CMD_READ:
-				nbd.device.ReadAt(buf[16:16+x.len], int64(x.from))
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 0)
-				syscall.Write(nbd.socket, buf[0:16+x.len])
-			case NBD_CMD_WRITE:
-				n, _ := syscall.Read(nbd.socket, buf[28:28+x.len])
-				for uint32(n) < x.len {
-					m, _ := syscall.Read(nbd.socket, buf[28+n:28+x.len])
-					n += m
-				}
-				nbd.device.WriteAt(buf[28:28+x.len], int64(x.from))
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 0)
-				syscall.Write(nbd.socket, buf[0:16])
-			case NBD_CMD_DISC:
-				logrus.Infof("Disconnecting device %s", nbd.devicePath)
-				nbd.Disconnect()
-				return
-			case NBD_CMD_FLUSH:
-				fallthrough
-			case NBD_CMD_TRIM:
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 1)
-				syscall.Write(nbd.socket, buf[0:16])
-			default:
-				logrus.Errorf("Unknown command recieved on device %s", nbd.devicePath)
-				nbd.Disconnect()
-				return
+		switch j.typus & NBD_CMD_MASK_COMMAND {
+		case NBD_CMD_READ:
+			j.buf = nbd.buffer(j.len)
+		case NBD_CMD_WRITE:
+			j.buf = nbd.buffer(j.len)
+			if err := nbd.read(sock, j.data()); err != nil {
+				return err
 			}
+		case NBD_CMD_TRIM:
+			j.buf = nbd.buffer(0)
+		case NBD_CMD_FLUSH:
+			// A flush must cover every write that was completed
+			// before it was sent.
+			inflight.Wait()
+			j.buf = nbd.buffer(0)
+		case NBD_CMD_DISC:
+			return nil
 		default:
-			logrus.Errorf("Invalid packet command recieved on device %s", nbd.devicePath)
-			nbd.Disconnect()
-			return
+			return fmt.Errorf("Unknown command recieved on device %s", nbd.devicePath)
+		}
+		inflight.Add(1)
+		jobs <- j
+	}
+}
+
+// do performs the request j against the device and replies to it.
+func (nbd *NBD) do(sock int, j *job) {
+	var err error
+	reply := j.buf[0:16]
+	switch j.typus & NBD_CMD_MASK_COMMAND {
+	case NBD_CMD_READ:
+		var n int
+		n, err = nbd.device.ReadAt(j.data(), int64(j.from))
+		if err == io.EOF {
+			// Past the end of the backing file reads as zeros.
+			for i := range j.data()[n:] {
+				j.data()[n+i] = 0
+			}
+			err = nil
+		}
+		if err == nil {
+			reply = j.buf[0 : 16+j.len]
+		}
+	case NBD_CMD_WRITE:
+		_, err = nbd.device.WriteAt(j.data(), int64(j.from))
+		if err == nil && j.typus&NBD_CMD_FLAG_FUA != 0 {
+			err = nbd.sync()
 		}
+	case NBD_CMD_FLUSH:
+		err = nbd.sync()
+	case NBD_CMD_TRIM:
+		err = nbd.trim(int64(j.from), int64(j.len))
+	}
+
+	var errno uint32
+	if err != nil {
+		logrus.Warnf("Request failed on device %s: %v", nbd.devicePath, err)
+		errno = uint32(syscall.EIO)
+	}
+	binary.BigEndian.PutUint32(reply[0:4], NBD_REPLY_MAGIC)
+	binary.BigEndian.PutUint32(reply[4:8], errno)
+	binary.BigEndian.PutUint64(reply[8:16], j.handle)
+
+	nbd.replyMutex.Lock()
+	err = nbd.write(sock, reply)
+	nbd.replyMutex.Unlock()
+	nbd.release(j.buf)
+	if err != nil && !nbd.isClosed() {
+		logrus.Warnf("Failed to reply on device %s: %v", nbd.devicePath, err)
+	}
+}
+
+// buffer returns a buffer for the reply header and size bytes of data.
+func (nbd *NBD) buffer(size uint32) []byte {
+	if size > bufferSize-16 {
+		return make([]byte, 16+size)
+	}
+	return nbd.buffers.Get().([]byte)
+}
+
+func (nbd *NBD) release(buf []byte) {
+	if len(buf) == bufferSize {
+		nbd.buffers.Put(buf)
+	}
+}
+
+// read fills buf from sock. A short read after the NBD was disconnected is
+// reported as io.EOF.
+func (nbd *NBD) read(sock int, buf []byte) error {
+	for n := 0; n < len(buf); {
+		m, err := syscall.Read(sock, buf[n:])
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if m <= 0 || nbd.isClosed() {
+			return io.EOF
+		}
+		n += m
+	}
+	return nil
+}
+
+// write writes all of buf to sock.
+func (nbd *NBD) write(sock int, buf []byte) error {
+	for n := 0; n < len(buf); {
+		m, err := syscall.Write(sock, buf[n:])
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+		n += m
+	}
+	return nil
+}
+
+// sync commits the writes to the device to stable storage.
+func (nbd *NBD) sync() error {
+	s, ok := nbd.device.(Syncer)
+	if !ok {
+		return syscall.EOPNOTSUPP
+	}
+	return s.Sync()
+}
+
+// trim discards length bytes of the device at off.
+func (nbd *NBD) trim(off int64, length int64) error {
+	t, ok := nbd.device.(Trimmer)
+	if !ok {
+		return syscall.EOPNOTSUPP
 	}
+	return t.Trim(off, length)
 }
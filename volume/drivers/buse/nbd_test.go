@@ -0,0 +1,173 @@
+package buse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSize = 64 << 20
+
+// client reads and writes the kernel end of the socket.
+var client = Create(nil, 0)
+
+// slowDevice adds a fixed latency to every I/O, as a disk would.
+type slowDevice struct {
+	*os.File
+	latency time.Duration
+}
+
+func (d *slowDevice) ReadAt(b []byte, off int64) (int, error) {
+	time.Sleep(d.latency)
+	return d.File.ReadAt(b, off)
+}
+
+func (d *slowDevice) WriteAt(b []byte, off int64) (int, error) {
+	time.Sleep(d.latency)
+	return d.File.WriteAt(b, off)
+}
+
+// serveFile serves a file backed NBD on one end of a socket pair and
+// returns the other end, as the kernel would see it.
+func serveFile(t testing.TB, latency time.Duration, depth int) (int, *os.File, func()) {
+	f, err := ioutil.TempFile("", "nbd_test")
+	if err != nil {
+		t.Fatalf("Failed to create block file: %v", err)
+	}
+	if err := f.Truncate(testSize); err != nil {
+		t.Fatalf("Failed to size block file: %v", err)
+	}
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Failed to create socket pair: %v", err)
+	}
+
+	nbd := Create(&slowDevice{File: f, latency: latency}, testSize)
+	nbd.SetQueueDepth(depth)
+	done := make(chan error)
+	go func() {
+		done <- nbd.serve(pair[1])
+	}()
+	return pair[0], f, func() {
+		syscall.Shutdown(pair[0], syscall.SHUT_WR)
+		<-done
+		syscall.Close(pair[0])
+		syscall.Close(pair[1])
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func send(t testing.TB, sock int, cmd uint32, handle uint64, from uint64, data []byte, size uint32) {
+	buf := make([]byte, 28+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], NBD_REQUEST_MAGIC)
+	binary.BigEndian.PutUint32(buf[4:8], cmd)
+	binary.BigEndian.PutUint64(buf[8:16], handle)
+	binary.BigEndian.PutUint64(buf[16:24], from)
+	binary.BigEndian.PutUint32(buf[24:28], size)
+	copy(buf[28:], data)
+	if err := client.write(sock, buf); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+}
+
+// receive reads a reply with size bytes of data and returns its handle,
+// error and data.
+func receive(t testing.TB, sock int, size uint32) (uint64, uint32, []byte) {
+	buf := make([]byte, 16+size)
+	if err := client.read(sock, buf[0:16]); err != nil {
+		t.Fatalf("Failed to receive reply: %v", err)
+	}
+	if magic := binary.BigEndian.Uint32(buf[0:4]); magic != NBD_REPLY_MAGIC {
+		t.Fatalf("Invalid reply magic %x", magic)
+	}
+	errno := binary.BigEndian.Uint32(buf[4:8])
+	if errno == 0 && size > 0 {
+		if err := client.read(sock, buf[16:]); err != nil {
+			t.Fatalf("Failed to receive data: %v", err)
+		}
+	}
+	return binary.BigEndian.Uint64(buf[8:16]), errno, buf[16:]
+}
+
+func TestServe(t *testing.T) {
+	sock, f, stop := serveFile(t, 0, 4)
+	defer stop()
+
+	data := []byte("buse")
+	send(t, sock, NBD_CMD_WRITE|NBD_CMD_FLAG_FUA, 1, 4096, data, uint32(len(data)))
+	handle, errno, _ := receive(t, sock, 0)
+	assert.Equal(t, uint64(1), handle)
+	assert.Equal(t, uint32(0), errno)
+
+	send(t, sock, NBD_CMD_FLUSH, 2, 0, nil, 0)
+	handle, errno, _ = receive(t, sock, 0)
+	assert.Equal(t, uint64(2), handle)
+	assert.Equal(t, uint32(0), errno)
+
+	send(t, sock, NBD_CMD_READ, 3, 4096, nil, uint32(len(data)))
+	handle, errno, b := receive(t, sock, uint32(len(data)))
+	assert.Equal(t, uint64(3), handle)
+	assert.Equal(t, uint32(0), errno)
+	assert.Equal(t, data, b)
+
+	// os.File cannot discard blocks.
+	send(t, sock, NBD_CMD_TRIM, 4, 0, nil, 4096)
+	handle, errno, _ = receive(t, sock, 0)
+	assert.Equal(t, uint64(4), handle)
+	assert.Equal(t, uint32(syscall.EIO), errno)
+
+	b = make([]byte, len(data))
+	_, err := f.ReadAt(b, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestSetFlags(t *testing.T) {
+	nbd := Create(&slowDevice{}, testSize)
+	nbd.SetFlags(NBD_FLAG_SEND_FUA | NBD_FLAG_SEND_TRIM)
+	assert.Equal(t, uint32(NBD_FLAG_HAS_FLAGS|NBD_FLAG_SEND_FLUSH|NBD_FLAG_SEND_FUA), nbd.flags,
+		"Trim is not supported by os.File, FUA requires flush")
+
+	nbd = Create(&buseDev{}, testSize)
+	nbd.SetFlags(NBD_FLAG_SEND_TRIM)
+	assert.Equal(t, uint32(NBD_FLAG_HAS_FLAGS|NBD_FLAG_SEND_TRIM), nbd.flags)
+}
+
+// BenchmarkServe measures random 4K reads from a file with the latency of
+// a fast disk, with up to 32 requests outstanding as the kernel would send.
+func BenchmarkServe(b *testing.B) {
+	for _, depth := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			sock, _, stop := serveFile(b, 100*time.Microsecond, depth)
+			defer stop()
+
+			const size = 4096
+			outstanding := make(chan struct{}, 32)
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < b.N; i++ {
+					receive(b, sock, size)
+					<-outstanding
+				}
+				close(done)
+			}()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				outstanding <- struct{}{}
+				from := uint64(rand.Int63n(testSize/size)) * size
+				send(b, sock, NBD_CMD_READ, uint64(i), from, nil, size)
+			}
+			<-done
+		})
+	}
+}
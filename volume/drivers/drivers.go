@@ -5,9 +5,12 @@ import (
 	"github.com/libopenstorage/openstorage/volume/drivers/aws"
 	"github.com/libopenstorage/openstorage/volume/drivers/btrfs"
 	"github.com/libopenstorage/openstorage/volume/drivers/buse"
+	"github.com/libopenstorage/openstorage/volume/drivers/loop"
+	"github.com/libopenstorage/openstorage/volume/drivers/lvm"
 	"github.com/libopenstorage/openstorage/volume/drivers/nfs"
 	"github.com/libopenstorage/openstorage/volume/drivers/pwx"
 	"github.com/libopenstorage/openstorage/volume/drivers/vfs"
+	"github.com/libopenstorage/openstorage/volume/drivers/zfs"
 )
 
 // Driver is the description of a supported OST driver. New Drivers are added to
@@ -32,5 +35,11 @@ var (
 		{DriverType: vfs.Type, Name: vfs.Name},
 		// BUSE driver provisions storage from local volumes and implements block in user space.
 		{DriverType: buse.Type, Name: buse.Name},
+		// Loop driver provisions storage from local files attached to loop devices.
+		{DriverType: loop.Type, Name: loop.Name},
+		// LVM driver provisions storage from thin pools of a local volume group.
+		{DriverType: lvm.Type, Name: lvm.Name},
+		// ZFS driver provisions storage from zfs datasets and zvols.
+		{DriverType: zfs.Type, Name: zfs.Name},
 	}
 )
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"bazil.org/fuse"
@@ -12,7 +11,6 @@ import (
 
 	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/volume"
-	"github.com/pborman/uuid"
 	"github.com/portworx/kvdb"
 )
 
@@ -24,6 +22,8 @@ type volumeDriver struct {
 	*volume.DefaultBlockDriver
 	*volume.DefaultEnumerator
 	*volume.SnapshotNotSupported
+	*volume.RestoreNotSupported
+	*volume.CapacityNotSupported
 }
 
 func newVolumeDriver(
@@ -42,6 +42,8 @@ func newVolumeDriver(
 			kvdb.Instance(),
 		),
 		&volume.SnapshotNotSupported{},
+		&volume.RestoreNotSupported{},
+		&volume.CapacityNotSupported{},
 	}
 }
 
@@ -58,13 +60,16 @@ func (v *volumeDriver) Create(
 	source *api.Source,
 	spec *api.VolumeSpec,
 ) (api.VolumeID, error) {
-	volumeID := strings.TrimSpace(string(uuid.New()))
-	dirPath := filepath.Join(v.baseDirPath, volumeID)
+	if source != nil && source.Parent != api.BadVolumeID {
+		return api.BadVolumeID, volume.ErrNotSupported
+	}
+	volumeID := v.NewVolumeID()
+	dirPath := filepath.Join(v.baseDirPath, string(volumeID))
 	if err := os.MkdirAll(dirPath, 0777); err != nil {
 		return api.BadVolumeID, err
 	}
 	volume := &api.Volume{
-		ID:         api.VolumeID(volumeID),
+		ID:         volumeID,
 		Locator:    volumeLocator,
 		Ctime:      time.Now(),
 		Spec:       spec,
@@ -0,0 +1,558 @@
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/pkg/fs"
+	"github.com/libopenstorage/openstorage/pkg/fscopy"
+	"github.com/libopenstorage/openstorage/pkg/mount"
+	"github.com/libopenstorage/openstorage/pkg/stats"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/kvdb"
+)
+
+const (
+	Name          = "loop"
+	Type          = api.Block
+	LoopMountPath = "/var/lib/openstorage/loop/"
+	LoopDevPrefix = "/dev/loop"
+)
+
+// Implements the open storage volume interface with sparse files attached
+// to loop devices.
+type driver struct {
+	*volume.DefaultEnumerator
+	*volume.ThinPool
+	// lock serializes attaching and detaching loop devices.
+	lock      sync.Mutex
+	mounter   mount.Manager
+	diskStats *stats.DiskStats
+	// nodeID is recorded in AttachedOn of attached volumes.
+	nodeID api.MachineID
+}
+
+func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
+	if err := os.MkdirAll(LoopMountPath, 0744); err != nil {
+		return nil, err
+	}
+	mounter, err := mount.New(mount.DeviceMount, LoopDevPrefix)
+	if err != nil {
+		return nil, err
+	}
+	inst := &driver{
+		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kvdb.Instance()),
+		mounter:           mounter,
+		diskStats:         stats.NewDiskStats(stats.FrequencyMin),
+	}
+	inst.ThinPool, err = volume.NewThinPool(LoopMountPath, params, inst.DefaultEnumerator, fileUsage)
+	if err != nil {
+		return nil, err
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		inst.nodeID = api.MachineID(hostname)
+	}
+
+	vols, err := inst.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vols {
+		// The kvdb may be shared with other nodes, only reattach the
+		// volumes that were attached here.
+		if vols[i].State != api.VolumeAttached || vols[i].AttachedOn != inst.nodeID {
+			continue
+		}
+		// Loop devices survive restarts of the driver but not of the host.
+		if _, err := inst.attach(&vols[i]); err != nil {
+			logrus.Warnf("Failed to reattach volume %v: %v", vols[i].ID, err)
+			alerts.Raise(api.AlertWarning, api.ResourceVolume, string(vols[i].ID),
+				fmt.Sprintf("Failed to reattach loop device: %v", err))
+		}
+	}
+
+	logrus.Println("Loop driver initialized with files at: ", LoopMountPath)
+	return inst, nil
+}
+
+func (d *driver) String() string {
+	return Name
+}
+
+func (d *driver) Type() api.DriverType {
+	return Type
+}
+
+// Status diagnostic information
+func (d *driver) Status() [][2]string {
+	return append([][2]string{
+		{"Loop devices", strconv.Itoa(loopDevices(LoopMountPath))},
+	}, d.CapacityStatus()...)
+}
+
+// blockFile returns the sparse file backing volumeID.
+func blockFile(volumeID api.VolumeID) string {
+	return path.Join(LoopMountPath, string(volumeID))
+}
+
+// fileUsage returns the bytes allocated to the file backing v.
+func fileUsage(v *api.Volume) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(blockFile(v.ID), &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Blocks) * 512, nil
+}
+
+// attach binds the file of v to a loop device, unless it is bound already,
+// and records the device in v. The caller must hold d.lock.
+func (d *driver) attach(v *api.Volume) (string, error) {
+	file := blockFile(v.ID)
+	dev, ok := findLoop(file)
+	if !ok {
+		var err error
+		if dev, err = attachLoop(file); err != nil {
+			return "", err
+		}
+		logrus.Infof("Loop attached %s (size=%v) to file %s", dev, v.Spec.Size, file)
+	}
+	if v.DevicePath != dev {
+		v.DevicePath = dev
+		return dev, d.UpdateVol(v)
+	}
+	return dev, nil
+}
+
+// device returns the loop device of volumeID, if it is attached.
+func (d *driver) device(volumeID api.VolumeID) (string, bool) {
+	return findLoop(blockFile(volumeID))
+}
+
+func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	return d.create(locator, volume.CloneSource(source), spec)
+}
+
+// create creates a volume recording source as given, snapshots are created
+// with their parent as source.
+func (d *driver) create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	var parent *api.Volume
+	if source != nil && source.Parent != api.BadVolumeID {
+		var err error
+		parent, err = d.GetVol(source.Parent)
+		if err == nil {
+			err = volume.CloneSpec(parent, spec)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
+
+	if spec.Size == 0 {
+		return api.BadVolumeID, errors.New("Volume size cannot be zero")
+	}
+
+	if spec.Format == "" {
+		return api.BadVolumeID, errors.New("Missing volume format")
+	}
+
+	release, err := d.Provision(spec.Size)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	defer release()
+
+	volumeID := d.NewVolumeID()
+	file := blockFile(volumeID)
+	var format api.Filesystem
+	if parent != nil {
+		// Blocks written through an attached parent are cached by the
+		// loop device until synced.
+		if dev, ok := d.device(parent.ID); ok {
+			if err := syncDevice(dev); err != nil {
+				return api.BadVolumeID, err
+			}
+		}
+		// Copies share blocks with the parent where the filesystem
+		// supports reflinks.
+		if err := fscopy.File(blockFile(parent.ID), file, nil); err != nil {
+			logrus.Warnf("Failed to clone %v: %v", parent.ID, err)
+			os.Remove(file)
+			return api.BadVolumeID, err
+		}
+		format = parent.Format
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err == nil {
+		err = f.Truncate(int64(spec.Size))
+		f.Close()
+	}
+	if err != nil {
+		logrus.Println(err)
+		os.Remove(file)
+		return api.BadVolumeID, err
+	}
+
+	v := &api.Volume{
+		ID:       volumeID,
+		Source:   source,
+		Locator:  locator,
+		Ctime:    time.Now(),
+		Spec:     spec,
+		LastScan: time.Now(),
+		Format:   format,
+		State:    api.VolumeDetached,
+		Status:   api.Up,
+	}
+	err = d.CreateVol(v)
+	if err != nil {
+		os.Remove(file)
+		return api.BadVolumeID, err
+	}
+	return v.ID, nil
+}
+
+func (d *driver) Delete(volumeID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		logrus.Println(err)
+		return err
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if dev, ok := d.device(volumeID); ok {
+		if err := detachLoop(dev); err != nil {
+			return err
+		}
+	}
+	os.Remove(blockFile(volumeID))
+	logrus.Infof("Loop deleted volume %v", volumeID)
+
+	err = d.DeleteVol(volumeID)
+	if err != nil {
+		logrus.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (d *driver) Mount(volumeID api.VolumeID, mountpath string) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return fmt.Errorf("Failed to locate volume %q", string(volumeID))
+	}
+	dev, ok := d.device(volumeID)
+	if !ok {
+		return volume.ErrVolDetached
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dev, &st); err != nil {
+		return err
+	}
+	minor := int(st.Rdev&0xff | (st.Rdev>>12)&^0xff)
+	err = d.mounter.Mount(minor, dev, mountpath, string(v.Format), 0, "")
+	if err != nil {
+		logrus.Errorf("Mounting %s on %s failed because of %v", dev, mountpath, err)
+		err = fmt.Errorf("Failed to mount %v at %v: %v", dev, mountpath, err)
+		alerts.Raise(api.AlertWarning, api.ResourceVolume, string(volumeID), err.Error())
+		return err
+	}
+
+	logrus.Infof("Loop mounted %s at %s", dev, mountpath)
+
+	v.AttachPath = mountpath
+	return d.UpdateVol(v)
+}
+
+func (d *driver) Unmount(volumeID api.VolumeID, mountpath string) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if v.AttachPath == "" {
+		return fmt.Errorf("Device %v not mounted", volumeID)
+	}
+	err = d.mounter.Unmount(v.DevicePath, v.AttachPath)
+	if err != nil {
+		return err
+	}
+	v.AttachPath = ""
+	return d.UpdateVol(v)
+}
+
+// Snapshot copies the file of the volume, sharing its blocks where the
+// filesystem supports reflinks. Snapshots of mounted volumes are crash
+// consistent.
+func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.VolumeLocator) (api.VolumeID, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	source := &api.Source{Parent: volumeID}
+	return d.create(locator, source, v.Spec)
+}
+
+// Restore replaces the contents of the detached volume with those of
+// snapID.
+func (d *driver) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	snap, err := d.GetVol(snapID)
+	if err != nil {
+		return err
+	}
+	if err := volume.CheckRestore(v, snap); err != nil {
+		return err
+	}
+	if _, ok := d.device(volumeID); ok {
+		return volume.ErrVolAttached
+	}
+	// The contents are copied aside and swapped in by rename, so that a
+	// failed copy leaves the volume as it was.
+	restoreFile := blockFile(volumeID) + ".restore"
+	err = fscopy.File(blockFile(snapID), restoreFile, nil)
+	if err == nil && snap.Spec.Size < v.Spec.Size {
+		err = os.Truncate(restoreFile, int64(v.Spec.Size))
+	}
+	if err == nil {
+		err = os.Rename(restoreFile, blockFile(volumeID))
+	}
+	if err != nil {
+		os.Remove(restoreFile)
+		return err
+	}
+	v.Format = snap.Format
+	logrus.Infof("Loop restored volume %v from snapshot %v", volumeID, snapID)
+	return d.UpdateVol(v)
+}
+
+// Set updates the locator and grows the volume if spec specifies a larger
+// size. Other fields in spec are ignored.
+func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if spec != nil && spec.Size != 0 {
+		if err = d.resize(v, spec.Size); err != nil {
+			return err
+		}
+	}
+	if locator != nil {
+		v.Locator = *locator
+	}
+	return d.UpdateVol(v)
+}
+
+// resize grows the file backing v to size bytes, updates the size of the
+// loop device and expands the filesystem on it. The caller must hold
+// d.lock.
+func (d *driver) resize(v *api.Volume, size uint64) error {
+	if size < v.Spec.Size {
+		return volume.ErrVolShrink
+	}
+	if size == v.Spec.Size {
+		return nil
+	}
+	if err := os.Truncate(blockFile(v.ID), int64(size)); err != nil {
+		return err
+	}
+	dev, ok := d.device(v.ID)
+	if ok {
+		if err := setCapacity(dev); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Loop resized volume %v from %v to %v", v.ID, v.Spec.Size, size)
+	v.Spec.Size = size
+	if err := d.UpdateVol(v); err != nil {
+		return err
+	}
+
+	if ok {
+		if err := fs.Grow(string(v.Format), dev, v.AttachPath); err != nil {
+			logrus.Warnf("Failed to grow filesystem on %v: %v", dev, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// open returns the loop device of the volume if it is attached, so that
+// I/O is coherent with the device, or else its file.
+func (d *driver) open(volumeID api.VolumeID) (*os.File, error) {
+	if dev, ok := d.device(volumeID); ok {
+		return os.OpenFile(dev, os.O_RDWR, 0)
+	}
+	return os.OpenFile(blockFile(volumeID), os.O_RDWR, 0)
+}
+
+// Read sz bytes at offset from the volume.
+func (d *driver) Read(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := volume.CheckIO(v, buf, sz, offset); err != nil {
+		return 0, err
+	}
+	f, err := d.open(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(buf[:sz], offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return int64(n), err
+}
+
+// Write sz bytes at offset to the volume.
+func (d *driver) Write(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := volume.CheckIO(v, buf, sz, offset); err != nil {
+		return 0, err
+	}
+	f, err := d.open(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.WriteAt(buf[:sz], offset)
+	return int64(n), err
+}
+
+// Flush writes to the volume to stable storage.
+func (d *driver) Flush(volumeID api.VolumeID) error {
+	if _, err := d.GetVol(volumeID); err != nil {
+		return err
+	}
+	f, err := d.open(volumeID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Attach binds the volume to a loop device if it is not bound and returns
+// the device path. The filesystem is created on first attach.
+func (d *driver) Attach(volumeID api.VolumeID) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return "", err
+	}
+	dev, err := d.attach(v)
+	if err != nil {
+		return "", err
+	}
+
+	if v.Format == "" {
+		if v.Spec.Format != api.FsNone {
+			logrus.Infof("Formatting %s with %v", dev, v.Spec.Format)
+			cmd := "/sbin/mkfs." + string(v.Spec.Format)
+			o, err := exec.Command(cmd, dev).CombinedOutput()
+			if err != nil {
+				logrus.Warnf("Failed to run command %v %v: %s", cmd, dev, o)
+				return "", err
+			}
+		}
+		v.Format = v.Spec.Format
+	}
+
+	v.State = api.VolumeAttached
+	v.AttachedOn = d.nodeID
+	if err := d.UpdateVol(v); err != nil {
+		return "", err
+	}
+	return dev, nil
+}
+
+// Detach unbinds the volume from its loop device, freeing the device.
+func (d *driver) Detach(volumeID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	dev, ok := d.device(volumeID)
+	if !ok {
+		return volume.ErrVolDetached
+	}
+	if err := detachLoop(dev); err != nil {
+		return err
+	}
+	logrus.Infof("Loop detached %s from volume %v", dev, volumeID)
+
+	v.DevicePath = ""
+	v.State = api.VolumeDetached
+	v.AttachedOn = api.MachineNone
+	return d.UpdateVol(v)
+}
+
+// Stats returns I/O statistics of the loop device backing the volume.
+func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	dev, ok := d.device(volumeID)
+	if !ok {
+		return api.Stats{}, volume.ErrVolDetached
+	}
+	s, err := d.diskStats.GetDevice(dev)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	if v.AttachPath != "" {
+		if fsStats, err := stats.FsStats(v.AttachPath); err == nil {
+			s.BytesUsed = fsStats.BytesUsed
+			volume.CheckUsage(v, s.BytesUsed)
+		}
+	}
+	return *s, nil
+}
+
+func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
+}
+
+func (d *driver) Shutdown() {
+	logrus.Printf("%s Shutting down", Name)
+}
+
+func init() {
+	// Register ourselves as an openstorage volume driver.
+	volume.Register(Name, Init)
+}
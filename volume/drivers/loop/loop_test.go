@@ -0,0 +1,55 @@
+package loop
+
+import (
+	"os"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/libopenstorage/openstorage/volume/drivers/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAll(t *testing.T) {
+	_, err := volume.New(Name, volume.DriverParams{})
+	if err != nil {
+		t.Fatalf("Failed to initialize Driver: %v", err)
+	}
+	d, err := volume.Get(Name)
+	if err != nil {
+		t.Fatalf("Failed to initialize Volume Driver: %v", err)
+	}
+	ctx := test.NewContext(d)
+	ctx.Filesystem = string(api.FsExt4)
+
+	test.Run(t, ctx)
+}
+
+func TestResize(t *testing.T) {
+	d, err := volume.Get(Name)
+	if err != nil {
+		if d, err = volume.New(Name, volume.DriverParams{}); err != nil {
+			t.Fatalf("Failed to initialize Driver: %v", err)
+		}
+	}
+
+	id, err := d.Create(api.VolumeLocator{Name: "resize"}, nil,
+		&api.VolumeSpec{Size: 16 << 20, Format: api.FsExt4})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	dev, err := d.Attach(id)
+	assert.NoError(t, err, "Failed in Attach")
+	defer d.Detach(id)
+
+	err = d.Set(id, nil, &api.VolumeSpec{Size: 32 << 20})
+	assert.NoError(t, err, "Failed to grow volume")
+	f, err := os.Open(dev)
+	assert.NoError(t, err, "Failed to open device")
+	defer f.Close()
+	size, err := f.Seek(0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(32<<20), size, "Loop device was not resized")
+
+	err = d.Set(id, nil, &api.VolumeSpec{Size: 16 << 20})
+	assert.Equal(t, volume.ErrVolShrink, err)
+}
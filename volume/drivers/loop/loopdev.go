@@ -0,0 +1,195 @@
+package loop
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// Defined in <linux/loop.h>:
+	LOOP_SET_FD       = 0x4C00
+	LOOP_CLR_FD       = 0x4C01
+	LOOP_SET_STATUS64 = 0x4C04
+	LOOP_SET_CAPACITY = 0x4C07
+	LOOP_CONFIGURE    = 0x4C0A
+	LOOP_CTL_GET_FREE = 0x4C82
+	LO_NAME_SIZE      = 64
+
+	loopControl = "/dev/loop-control"
+	// attachRetries is the number of free devices tried, other processes
+	// may take a device between finding it free and binding it.
+	attachRetries = 8
+)
+
+// loopInfo64 is struct loop_info64 from <linux/loop.h>.
+type loopInfo64 struct {
+	device         uint64
+	inode          uint64
+	rdevice        uint64
+	offset         uint64
+	sizelimit      uint64
+	number         uint32
+	encryptType    uint32
+	encryptKeySize uint32
+	flags          uint32
+	fileName       [LO_NAME_SIZE]byte
+	cryptName      [LO_NAME_SIZE]byte
+	encryptKey     [32]byte
+	init           [2]uint64
+}
+
+// loopConfig is struct loop_config from <linux/loop.h>.
+type loopConfig struct {
+	fd        uint32
+	blockSize uint32
+	info      loopInfo64
+	reserved  [8]uint64
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// attachLoop binds file to a free loop device and returns the device path.
+func attachLoop(file string) (string, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	ctl, err := os.OpenFile(loopControl, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close()
+
+	for i := 0; i < attachRetries; i++ {
+		n, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ctl.Fd(), LOOP_CTL_GET_FREE, 0)
+		if errno != 0 {
+			return "", &os.PathError{Op: "ioctl LOOP_CTL_GET_FREE", Path: loopControl, Err: errno}
+		}
+		dev := fmt.Sprintf("/dev/loop%d", n)
+		err := bind(dev, f)
+		if err == syscall.EBUSY {
+			continue
+		}
+		if err != nil {
+			return "", &os.PathError{Op: "attach", Path: dev, Err: err}
+		}
+		return dev, nil
+	}
+	return "", fmt.Errorf("No free loop device for %v", file)
+}
+
+// bind binds the loop device dev to f.
+func bind(dev string, f *os.File) error {
+	loop, err := openDevice(dev)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	config := loopConfig{fd: uint32(f.Fd())}
+	copy(config.info.fileName[:LO_NAME_SIZE-1], f.Name())
+	err = ioctl(loop.Fd(), LOOP_CONFIGURE, uintptr(unsafe.Pointer(&config)))
+	if err != syscall.EINVAL && err != syscall.ENOTTY {
+		return err
+	}
+	// Kernels before 5.8 bind and configure the device in two steps.
+	if err := ioctl(loop.Fd(), LOOP_SET_FD, f.Fd()); err != nil {
+		return err
+	}
+	err = ioctl(loop.Fd(), LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&config.info)))
+	if err != nil {
+		ioctl(loop.Fd(), LOOP_CLR_FD, 0)
+	}
+	return err
+}
+
+// openDevice opens the loop device dev, which udev may still be creating.
+func openDevice(dev string) (*os.File, error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(dev, os.O_RDWR, 0)
+		if err == nil || !os.IsNotExist(err) || i == 10 {
+			return f, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// detachLoop unbinds the loop device dev from its file.
+func detachLoop(dev string) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ioctl(f.Fd(), LOOP_CLR_FD, 0); err != nil && err != syscall.ENXIO {
+		return &os.PathError{Op: "ioctl LOOP_CLR_FD", Path: dev, Err: err}
+	}
+	return nil
+}
+
+// findLoop returns the loop device bound to file, if any. Loop devices
+// outlive the driver, so attached volumes are found again on restart.
+func findLoop(file string) (string, bool) {
+	devs, _ := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	for _, backing := range devs {
+		b, err := ioutil.ReadFile(backing)
+		if err != nil || strings.TrimSpace(string(b)) != file {
+			continue
+		}
+		return "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(backing))), true
+	}
+	return "", false
+}
+
+// loopDevices returns the number of loop devices bound to files in dir.
+func loopDevices(dir string) int {
+	n := 0
+	devs, _ := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	for _, backing := range devs {
+		b, err := ioutil.ReadFile(backing)
+		if err == nil && strings.HasPrefix(string(b), dir) {
+			n++
+		}
+	}
+	return n
+}
+
+// setCapacity updates the size of the loop device dev to that of its file.
+func setCapacity(dev string) error {
+	return devIoctl(dev, LOOP_SET_CAPACITY, "LOOP_SET_CAPACITY")
+}
+
+func devIoctl(dev string, req uintptr, name string) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ioctl(f.Fd(), req, 0); err != nil {
+		return &os.PathError{Op: "ioctl " + name, Path: dev, Err: err}
+	}
+	return nil
+}
+
+// syncDevice writes blocks written through dev to its file.
+func syncDevice(dev string) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,32 @@
+package lvm
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Executor runs lvm commands.
+type Executor interface {
+	// Run runs lvm with args and returns its standard output.
+	Run(args ...string) (string, error)
+}
+
+// lvmExecutor runs the lvm binary.
+type lvmExecutor struct {
+}
+
+func (e *lvmExecutor) Run(args ...string) (string, error) {
+	cmd := exec.Command("lvm", args...)
+	// Numbers are reported with a decimal point.
+	cmd.Env = []string{"LC_ALL=C"}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("lvm %v: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,625 @@
+package lvm
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/pkg/fs"
+	"github.com/libopenstorage/openstorage/pkg/stats"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/kvdb"
+)
+
+const (
+	Name = "lvm"
+	Type = api.Block
+	// VolumeGroupParam driver parameter, the volume group holding the
+	// thin pools.
+	VolumeGroupParam = "vg"
+	// PoolParam driver parameter, the thin pool volumes are created in.
+	PoolParam = "pool"
+	// CosPoolsParam driver parameter, comma separated cos=pool pairs,
+	// e.g. 3=slowpool,9=fastpool. A volume is created in the pool of the
+	// highest Cos not above its own, or in the default pool.
+	CosPoolsParam = "cos_pools"
+	// LvmTag tags the logical volumes of the driver.
+	LvmTag = "openstorage"
+)
+
+// cosPool is the thin pool of volumes of cos or above.
+type cosPool struct {
+	cos  api.VolumeCos
+	pool string
+}
+
+// lv is a logical volume reported by lvs.
+type lv struct {
+	name string
+	// size in bytes, the virtual size of thin volumes.
+	size uint64
+	// used bytes of thin volumes and pools.
+	used uint64
+}
+
+// Implements the open storage volume interface with thin logical volumes.
+type driver struct {
+	*volume.IoNotSupported
+	*volume.DefaultEnumerator
+	// lock serializes activation and restores.
+	lock      sync.Mutex
+	lvm       Executor
+	vg        string
+	pool      string
+	cosPools  []cosPool
+	// overcommit is the ratio of the provisioned size of the volumes of
+	// each pool to its size, 0 if volumes are provisioned without limit.
+	overcommit float64
+	diskStats  *stats.DiskStats
+}
+
+func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
+	return newDriver(params, &lvmExecutor{})
+}
+
+func newDriver(params volume.DriverParams, lvm Executor) (*driver, error) {
+	vg, ok := params[VolumeGroupParam]
+	if !ok {
+		return nil, fmt.Errorf("Volume group should be specified with key %q", VolumeGroupParam)
+	}
+	pool, ok := params[PoolParam]
+	if !ok {
+		return nil, fmt.Errorf("Thin pool should be specified with key %q", PoolParam)
+	}
+	cosPools, err := parseCosPools(params[CosPoolsParam])
+	if err != nil {
+		return nil, err
+	}
+	overcommit := 0.0
+	if ratio, ok := params[volume.OvercommitParam]; ok {
+		overcommit, err = strconv.ParseFloat(ratio, 64)
+		if err != nil || overcommit <= 0 {
+			return nil, fmt.Errorf("Invalid %v %q", volume.OvercommitParam, ratio)
+		}
+	}
+	inst := &driver{
+		IoNotSupported:    &volume.IoNotSupported{},
+		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kvdb.Instance()),
+		lvm:               lvm,
+		vg:                vg,
+		pool:              pool,
+		cosPools:          cosPools,
+		overcommit:        overcommit,
+		diskStats:         stats.NewDiskStats(stats.FrequencyMin),
+	}
+	lvs, err := inst.lvs()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range inst.pools() {
+		if _, ok := lvs[p]; !ok {
+			return nil, fmt.Errorf("Thin pool %v/%v does not exist", vg, p)
+		}
+	}
+	logrus.Infof("LVM driver initialized with thin pools %v in %v", inst.pools(), vg)
+	return inst, nil
+}
+
+// parseCosPools parses the value of CosPoolsParam, the pools are returned
+// in decreasing order of Cos.
+func parseCosPools(value string) ([]cosPool, error) {
+	var pools []cosPool
+	if value == "" {
+		return pools, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid %v %q", CosPoolsParam, pair)
+		}
+		cos, err := strconv.Atoi(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v %q", CosPoolsParam, pair)
+		}
+		pools = append(pools, cosPool{cos: api.VolumeCos(cos), pool: strings.TrimSpace(kv[1])})
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].cos > pools[j].cos })
+	return pools, nil
+}
+
+// pools returns the names of the thin pools of the driver.
+func (d *driver) pools() []string {
+	pools := []string{d.pool}
+	for _, p := range d.cosPools {
+		pools = append(pools, p.pool)
+	}
+	return pools
+}
+
+// poolFor returns the thin pool of volumes of class of service cos.
+func (d *driver) poolFor(cos api.VolumeCos) string {
+	for _, p := range d.cosPools {
+		if cos >= p.cos {
+			return p.pool
+		}
+	}
+	return d.pool
+}
+
+// lvName returns the name of the logical volume of name in the volume group.
+func (d *driver) lvName(name string) string {
+	return d.vg + "/" + name
+}
+
+// devicePath returns the device of the logical volume of volumeID.
+func (d *driver) devicePath(volumeID api.VolumeID) string {
+	return path.Join("/dev", d.vg, string(volumeID))
+}
+
+// lvs returns the logical volumes in the volume group by name.
+func (d *driver) lvs() (map[string]lv, error) {
+	out, err := d.lvm.Run("lvs", "--noheadings", "--nosuffix", "--units", "b",
+		"--separator", ",", "-o", "lv_name,lv_size,data_percent", d.vg)
+	if err != nil {
+		return nil, err
+	}
+	lvs := make(map[string]lv)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size of logical volume %v: %q", fields[0], fields[1])
+		}
+		l := lv{name: fields[0], size: size}
+		if fields[2] != "" {
+			percent, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid data percent of logical volume %v: %q", fields[0], fields[2])
+			}
+			l.used = uint64(float64(size) * percent / 100)
+		}
+		lvs[l.name] = l
+	}
+	return lvs, nil
+}
+
+func (d *driver) String() string {
+	return Name
+}
+
+func (d *driver) Type() api.DriverType {
+	return Type
+}
+
+// Status reports the usage of the thin pools.
+func (d *driver) Status() [][2]string {
+	lvs, err := d.lvs()
+	if err != nil {
+		return [][2]string{{"Error", err.Error()}}
+	}
+	status := [][2]string{{"Volume group", d.vg}}
+	for _, p := range d.pools() {
+		pool := lvs[p]
+		status = append(status, [2]string{"Pool " + p,
+			fmt.Sprintf("%d of %d bytes used", pool.used, pool.size)})
+	}
+	return status
+}
+
+// Capacity of the thin pools. The usage of each volume is recorded in its
+// Usage.
+func (d *driver) Capacity() (api.Capacity, error) {
+	lvs, err := d.lvs()
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	c := api.Capacity{OvercommitRatio: d.overcommit}
+	for _, p := range d.pools() {
+		c.TotalBytes += lvs[p].size
+		c.UsedBytes += lvs[p].used
+	}
+	c.FreeBytes = c.TotalBytes - c.UsedBytes
+
+	vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	for i := range vols {
+		v := &vols[i]
+		if v.Spec != nil {
+			c.ProvisionedBytes += v.Spec.Size
+		}
+		l, ok := lvs[string(v.ID)]
+		if !ok || l.used == v.Usage {
+			continue
+		}
+		err := d.ModifyVol(v.ID, func(v *api.Volume) bool {
+			v.Usage = l.used
+			return true
+		})
+		if err != nil {
+			logrus.Warnf("Failed to update usage of volume %v: %v", v.ID, err)
+		}
+	}
+	return c, nil
+}
+
+// provision reserves size bytes of pool for a new volume. It returns
+// ErrNoSpace if the volume would take the provisioned size of the pool,
+// with the volumes being created, beyond the overcommit ratio. The caller
+// calls the returned function once the volume is recorded or failed to be
+// created.
+func (d *driver) provision(pool string, size uint64) (func(), error) {
+	if d.overcommit == 0 {
+		return func() {}, nil
+	}
+	return d.Reserve(pool, size, func(reserved uint64) error {
+		lvs, err := d.lvs()
+		if err != nil {
+			return err
+		}
+		vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+		if err != nil {
+			return err
+		}
+		provisioned := reserved + size
+		for _, v := range vols {
+			// Snapshots share the pool of their parent, whose Cos
+			// they inherit.
+			if v.Spec != nil && d.poolFor(v.Spec.Cos) == pool {
+				provisioned += v.Spec.Size
+			}
+		}
+		if float64(provisioned) > d.overcommit*float64(lvs[pool].size) {
+			return volume.ErrNoSpace
+		}
+		return nil
+	})
+}
+
+// Create a thin volume in the pool of the Cos of spec, or a thin snapshot
+// of the parent volume if source specifies one.
+func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	return d.create(locator, volume.CloneSource(source), spec)
+}
+
+// create creates a volume recording source as given, snapshots are created
+// with their parent as source.
+func (d *driver) create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	var parent *api.Volume
+	if source != nil && source.Parent != api.BadVolumeID {
+		var err error
+		parent, err = d.GetVol(source.Parent)
+		if err == nil {
+			err = volume.CloneSpec(parent, spec)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
+
+	if spec.Size == 0 {
+		return api.BadVolumeID, errors.New("Volume size cannot be zero")
+	}
+
+	if spec.Format == "" {
+		return api.BadVolumeID, errors.New("Missing volume format")
+	}
+
+	pool := d.poolFor(spec.Cos)
+	if parent != nil {
+		pool = d.poolFor(parent.Spec.Cos)
+	}
+	release, err := d.provision(pool, spec.Size)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	defer release()
+
+	volumeID := d.NewVolumeID()
+	name := string(volumeID)
+	var format api.Filesystem
+	if parent != nil {
+		// Snapshots are skipped on activation unless told otherwise.
+		_, err := d.lvm.Run("lvcreate", "--snapshot", "--setactivationskip", "n",
+			"--addtag", LvmTag, "--name", name, d.lvName(string(parent.ID)))
+		if err != nil {
+			return api.BadVolumeID, err
+		}
+		if spec.Size > parent.Spec.Size {
+			_, err := d.lvm.Run("lvextend", "--size", fmt.Sprintf("%db", spec.Size), d.lvName(name))
+			if err != nil {
+				d.lvm.Run("lvremove", "--force", d.lvName(name))
+				return api.BadVolumeID, err
+			}
+		}
+		format = parent.Format
+	} else {
+		_, err := d.lvm.Run("lvcreate", "--thin", "--virtualsize", fmt.Sprintf("%db", spec.Size),
+			"--activate", "n", "--addtag", LvmTag, "--name", name, d.lvName(pool))
+		if err != nil {
+			return api.BadVolumeID, err
+		}
+	}
+
+	v := &api.Volume{
+		ID:       volumeID,
+		Source:   source,
+		Locator:  locator,
+		Ctime:    time.Now(),
+		Spec:     spec,
+		LastScan: time.Now(),
+		Format:   format,
+		State:    api.VolumeDetached,
+		Status:   api.Up,
+	}
+	if err := d.CreateVol(v); err != nil {
+		d.lvm.Run("lvremove", "--force", d.lvName(name))
+		return api.BadVolumeID, err
+	}
+	return v.ID, nil
+}
+
+func (d *driver) Delete(volumeID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		logrus.Println(err)
+		return err
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+	if _, err := d.lvm.Run("lvremove", "--force", d.lvName(string(volumeID))); err != nil {
+		return err
+	}
+	logrus.Infof("LVM deleted volume %v", volumeID)
+
+	err = d.DeleteVol(volumeID)
+	if err != nil {
+		logrus.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (d *driver) Mount(volumeID api.VolumeID, mountpath string) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return fmt.Errorf("Failed to locate volume %q", string(volumeID))
+	}
+	if v.State != api.VolumeAttached {
+		return volume.ErrVolDetached
+	}
+	err = syscall.Mount(v.DevicePath, mountpath, string(v.Format), 0, "")
+	if err != nil {
+		logrus.Errorf("Mounting %s on %s failed because of %v", v.DevicePath, mountpath, err)
+		err = fmt.Errorf("Failed to mount %v at %v: %v", v.DevicePath, mountpath, err)
+		alerts.Raise(api.AlertWarning, api.ResourceVolume, string(volumeID), err.Error())
+		return err
+	}
+
+	logrus.Infof("LVM mounted %s at %s", v.DevicePath, mountpath)
+
+	v.AttachPath = mountpath
+	return d.UpdateVol(v)
+}
+
+func (d *driver) Unmount(volumeID api.VolumeID, mountpath string) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if v.AttachPath == "" {
+		return fmt.Errorf("Device %v not mounted", volumeID)
+	}
+	err = syscall.Unmount(v.AttachPath, 0)
+	if err != nil {
+		return err
+	}
+	v.AttachPath = ""
+	return d.UpdateVol(v)
+}
+
+// Snapshot creates a thin snapshot of the volume. Snapshots of mounted
+// volumes are crash consistent.
+func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.VolumeLocator) (api.VolumeID, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	source := &api.Source{Parent: volumeID}
+	return d.create(locator, source, v.Spec)
+}
+
+// Restore replaces the logical volume of the detached volume with a thin
+// snapshot of snapID.
+func (d *driver) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	snap, err := d.GetVol(snapID)
+	if err != nil {
+		return err
+	}
+	if err := volume.CheckRestore(v, snap); err != nil {
+		return err
+	}
+	if v.State == api.VolumeAttached {
+		return volume.ErrVolAttached
+	}
+
+	name := string(volumeID)
+	restore := name + ".restore"
+	_, err = d.lvm.Run("lvcreate", "--snapshot", "--setactivationskip", "n",
+		"--addtag", LvmTag, "--name", restore, d.lvName(string(snapID)))
+	if err != nil {
+		return err
+	}
+	if snap.Spec.Size < v.Spec.Size {
+		_, err = d.lvm.Run("lvextend", "--size", fmt.Sprintf("%db", v.Spec.Size), d.lvName(restore))
+	}
+	// Swap the snapshot in by renaming, the volume is removed only once
+	// it is replaced.
+	old := name + ".old"
+	if err == nil {
+		_, err = d.lvm.Run("lvrename", d.vg, name, old)
+	}
+	if err != nil {
+		d.lvm.Run("lvremove", "--force", d.lvName(restore))
+		return err
+	}
+	if _, err := d.lvm.Run("lvrename", d.vg, restore, name); err != nil {
+		d.lvm.Run("lvrename", d.vg, old, name)
+		d.lvm.Run("lvremove", "--force", d.lvName(restore))
+		return err
+	}
+	if _, err := d.lvm.Run("lvremove", "--force", d.lvName(old)); err != nil {
+		logrus.Warnf("Failed to remove replaced volume %v: %v", old, err)
+	}
+	v.Format = snap.Format
+	logrus.Infof("LVM restored volume %v from snapshot %v", volumeID, snapID)
+	return d.UpdateVol(v)
+}
+
+// Set updates the locator and grows the volume if spec specifies a larger
+// size. Other fields in spec are ignored.
+func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if spec != nil && spec.Size != 0 && spec.Size != v.Spec.Size {
+		if spec.Size < v.Spec.Size {
+			return volume.ErrVolShrink
+		}
+		_, err := d.lvm.Run("lvextend", "--size", fmt.Sprintf("%db", spec.Size), d.lvName(string(volumeID)))
+		if err != nil {
+			return err
+		}
+		logrus.Infof("LVM resized volume %v from %v to %v", volumeID, v.Spec.Size, spec.Size)
+		v.Spec.Size = spec.Size
+		if v.State == api.VolumeAttached {
+			if err := fs.Grow(string(v.Format), v.DevicePath, v.AttachPath); err != nil {
+				logrus.Warnf("Failed to grow filesystem on %v: %v", v.DevicePath, err)
+				return err
+			}
+		}
+	}
+	if locator != nil {
+		v.Locator = *locator
+	}
+	return d.UpdateVol(v)
+}
+
+// Attach activates the logical volume and returns its device path. The
+// filesystem is created on first attach.
+func (d *driver) Attach(volumeID api.VolumeID) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return "", err
+	}
+	_, err = d.lvm.Run("lvchange", "--activate", "y", "--ignoreactivationskip",
+		d.lvName(string(volumeID)))
+	if err != nil {
+		return "", err
+	}
+	v.DevicePath = d.devicePath(volumeID)
+
+	if v.Format == "" {
+		if v.Spec.Format != api.FsNone {
+			logrus.Infof("Formatting %s with %v", v.DevicePath, v.Spec.Format)
+			cmd := "/sbin/mkfs." + string(v.Spec.Format)
+			o, err := exec.Command(cmd, v.DevicePath).CombinedOutput()
+			if err != nil {
+				logrus.Warnf("Failed to run command %v %v: %s", cmd, v.DevicePath, o)
+				return "", err
+			}
+		}
+		v.Format = v.Spec.Format
+	}
+
+	v.State = api.VolumeAttached
+	if err := d.UpdateVol(v); err != nil {
+		return "", err
+	}
+	return v.DevicePath, nil
+}
+
+// Detach deactivates the logical volume.
+func (d *driver) Detach(volumeID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+	if v.State != api.VolumeAttached {
+		return volume.ErrVolDetached
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, err := d.lvm.Run("lvchange", "--activate", "n", d.lvName(string(volumeID))); err != nil {
+		return err
+	}
+
+	v.DevicePath = ""
+	v.State = api.VolumeDetached
+	return d.UpdateVol(v)
+}
+
+// Stats returns I/O statistics of the device of the volume.
+func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	if v.State != api.VolumeAttached {
+		return api.Stats{}, volume.ErrVolDetached
+	}
+	s, err := d.diskStats.GetDevice(v.DevicePath)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	if v.AttachPath != "" {
+		if fsStats, err := stats.FsStats(v.AttachPath); err == nil {
+			s.BytesUsed = fsStats.BytesUsed
+			volume.CheckUsage(v, s.BytesUsed)
+		}
+	}
+	return *s, nil
+}
+
+func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
+}
+
+func (d *driver) Shutdown() {
+	logrus.Printf("%s Shutting down", Name)
+}
+
+func init() {
+	// Register ourselves as an openstorage volume driver.
+	volume.Register(Name, Init)
+}
@@ -0,0 +1,317 @@
+package lvm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLV is a logical volume of fakeLvm.
+type fakeLV struct {
+	size   uint64
+	used   uint64
+	pool   string
+	active bool
+}
+
+// fakeLvm simulates the lvm commands of the driver on a single volume group.
+type fakeLvm struct {
+	vg       string
+	lvs      map[string]*fakeLV
+	commands []string
+	// fail fails the commands starting with it.
+	fail string
+}
+
+func newFakeLvm(vg string, pools ...string) *fakeLvm {
+	f := &fakeLvm{vg: vg, lvs: make(map[string]*fakeLV)}
+	for _, p := range pools {
+		f.lvs[p] = &fakeLV{size: 1 << 30, active: true}
+	}
+	return f
+}
+
+// flags returns the values of the options in args and the positional
+// arguments.
+func flags(args []string) (map[string]string, []string) {
+	opts := make(map[string]string)
+	var pos []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--thin", "--snapshot", "--force", "--noheadings", "--nosuffix", "--ignoreactivationskip":
+			opts[args[i]] = ""
+		default:
+			if strings.HasPrefix(args[i], "-") && i+1 < len(args) {
+				opts[args[i]] = args[i+1]
+				i++
+			} else {
+				pos = append(pos, args[i])
+			}
+		}
+	}
+	return opts, pos
+}
+
+func (f *fakeLvm) lookup(name string) (string, *fakeLV, error) {
+	n := strings.TrimPrefix(name, f.vg+"/")
+	if l, ok := f.lvs[n]; ok {
+		return n, l, nil
+	}
+	return n, nil, fmt.Errorf("Failed to find logical volume %q", name)
+}
+
+func parseSize(s string) uint64 {
+	size, _ := strconv.ParseUint(strings.TrimSuffix(s, "b"), 10, 64)
+	return size
+}
+
+func (f *fakeLvm) Run(args ...string) (string, error) {
+	f.commands = append(f.commands, strings.Join(args, " "))
+	if f.fail != "" && strings.HasPrefix(strings.Join(args, " "), f.fail) {
+		return "", fmt.Errorf("Failed to run %v", args[0])
+	}
+	opts, pos := flags(args[1:])
+	switch args[0] {
+	case "lvs":
+		var names []string
+		for name := range f.lvs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := ""
+		for _, name := range names {
+			l := f.lvs[name]
+			out += fmt.Sprintf("  %s,%d,%.2f\n", name, l.size, float64(l.used)*100/float64(l.size))
+		}
+		return out, nil
+	case "lvcreate":
+		name := opts["--name"]
+		if _, ok := f.lvs[name]; ok {
+			return "", fmt.Errorf("Logical volume %q already exists", name)
+		}
+		if _, ok := opts["--snapshot"]; ok {
+			_, origin, err := f.lookup(pos[0])
+			if err != nil {
+				return "", err
+			}
+			snap := *origin
+			snap.active = false
+			f.lvs[name] = &snap
+		} else {
+			pool, _, err := f.lookup(pos[0])
+			if err != nil {
+				return "", err
+			}
+			f.lvs[name] = &fakeLV{size: parseSize(opts["--virtualsize"]), pool: pool}
+		}
+	case "lvextend":
+		_, l, err := f.lookup(pos[0])
+		if err != nil {
+			return "", err
+		}
+		l.size = parseSize(opts["--size"])
+	case "lvremove":
+		name, _, err := f.lookup(pos[0])
+		if err != nil {
+			return "", err
+		}
+		delete(f.lvs, name)
+	case "lvrename":
+		_, l, err := f.lookup(pos[1])
+		if err != nil {
+			return "", err
+		}
+		delete(f.lvs, pos[1])
+		f.lvs[pos[2]] = l
+	case "lvchange":
+		_, l, err := f.lookup(pos[0])
+		if err != nil {
+			return "", err
+		}
+		l.active = opts["--activate"] == "y"
+	default:
+		return "", fmt.Errorf("Unknown command %v", args[0])
+	}
+	return "", nil
+}
+
+func newTestDriver(t *testing.T, params volume.DriverParams, pools ...string) (*driver, *fakeLvm) {
+	f := newFakeLvm("vg0", pools...)
+	d, err := newDriver(params, f)
+	if err != nil {
+		t.Fatalf("Failed to initialize Driver: %v", err)
+	}
+	return d, f
+}
+
+func TestInit(t *testing.T) {
+	f := newFakeLvm("vg0", "thin")
+	_, err := newDriver(volume.DriverParams{VolumeGroupParam: "vg0"}, f)
+	assert.Error(t, err, "Missing pool must fail")
+	_, err = newDriver(volume.DriverParams{VolumeGroupParam: "vg0", PoolParam: "none"}, f)
+	assert.Error(t, err, "Unknown pool must fail")
+	_, err = newDriver(volume.DriverParams{VolumeGroupParam: "vg0", PoolParam: "thin",
+		CosPoolsParam: "high"}, f)
+	assert.Error(t, err, "Invalid cos pools must fail")
+	_, err = newDriver(volume.DriverParams{VolumeGroupParam: "vg0", PoolParam: "thin",
+		volume.OvercommitParam: "0"}, f)
+	assert.Error(t, err, "Invalid overcommit ratio must fail")
+}
+
+func TestCreateCos(t *testing.T) {
+	d, f := newTestDriver(t, volume.DriverParams{
+		VolumeGroupParam: "vg0",
+		PoolParam:        "thin",
+		CosPoolsParam:    "9=fast,3=slow",
+	}, "thin", "fast", "slow")
+
+	for cos, pool := range map[api.VolumeCos]string{
+		0:  "thin",
+		3:  "slow",
+		5:  "slow",
+		9:  "fast",
+		10: "fast",
+	} {
+		id, err := d.Create(api.VolumeLocator{Name: "cos"}, nil,
+			&api.VolumeSpec{Size: 1 << 20, Format: api.FsNone, Cos: cos})
+		assert.NoError(t, err, "Failed in Create")
+		assert.Equal(t, pool, f.lvs[string(id)].pool, "Wrong pool for cos %v", cos)
+		assert.Equal(t, uint64(1<<20), f.lvs[string(id)].size)
+		assert.NoError(t, d.Delete(id), "Failed in Delete")
+		assert.NotContains(t, f.lvs, string(id))
+	}
+}
+
+func TestAttachDetach(t *testing.T) {
+	d, f := newTestDriver(t, volume.DriverParams{VolumeGroupParam: "vg0", PoolParam: "thin"}, "thin")
+
+	id, err := d.Create(api.VolumeLocator{Name: "attach"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	assert.False(t, f.lvs[string(id)].active, "Volume must be created inactive")
+
+	dev, err := d.Attach(id)
+	assert.NoError(t, err, "Failed in Attach")
+	assert.Equal(t, "/dev/vg0/"+string(id), dev)
+	assert.True(t, f.lvs[string(id)].active, "Volume must be activated on attach")
+
+	assert.NoError(t, d.Set(id, nil, &api.VolumeSpec{Size: 2 << 20}), "Failed to grow volume")
+	assert.Equal(t, uint64(2<<20), f.lvs[string(id)].size)
+	assert.Equal(t, volume.ErrVolShrink, d.Set(id, nil, &api.VolumeSpec{Size: 1 << 20}))
+
+	assert.NoError(t, d.Detach(id), "Failed in Detach")
+	assert.False(t, f.lvs[string(id)].active, "Volume must be deactivated on detach")
+	assert.Equal(t, volume.ErrVolDetached, d.Detach(id))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	d, f := newTestDriver(t, volume.DriverParams{VolumeGroupParam: "vg0", PoolParam: "thin"}, "thin")
+
+	id, err := d.Create(api.VolumeLocator{Name: "origin"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	f.lvs[string(id)].used = 1 << 19
+
+	snapID, err := d.Snapshot(id, true, api.VolumeLocator{Name: "snap"})
+	assert.NoError(t, err, "Failed in Snapshot")
+	defer d.Delete(snapID)
+	assert.Contains(t, f.commands, fmt.Sprintf("lvcreate --snapshot --setactivationskip n "+
+		"--addtag %v --name %v vg0/%v", LvmTag, snapID, id))
+	assert.Equal(t, uint64(1<<19), f.lvs[string(snapID)].used)
+
+	f.lvs[string(id)].used = 1 << 20
+	_, err = d.Attach(id)
+	assert.NoError(t, err, "Failed in Attach")
+	assert.Equal(t, volume.ErrVolAttached, d.Restore(id, snapID))
+	assert.NoError(t, d.Detach(id), "Failed in Detach")
+
+	// The volume is left as it was if the snapshot cannot be swapped in.
+	f.fail = fmt.Sprintf("lvrename vg0 %v.restore", id)
+	assert.Error(t, d.Restore(id, snapID), "Restore must fail")
+	f.fail = ""
+	assert.Equal(t, uint64(1<<20), f.lvs[string(id)].used, "Volume was not rolled back")
+	assert.NotContains(t, f.lvs, string(id)+".restore")
+	assert.NotContains(t, f.lvs, string(id)+".old")
+
+	assert.NoError(t, d.Restore(id, snapID), "Failed in Restore")
+	assert.Equal(t, uint64(1<<19), f.lvs[string(id)].used, "Volume was not restored")
+	assert.NotContains(t, f.lvs, string(id)+".restore")
+	assert.NotContains(t, f.lvs, string(id)+".old")
+	assert.Equal(t, volume.ErrNotSnapshot, d.Restore(snapID, id))
+}
+
+func TestOvercommit(t *testing.T) {
+	d, _ := newTestDriver(t, volume.DriverParams{
+		VolumeGroupParam:       "vg0",
+		PoolParam:              "thin",
+		CosPoolsParam:          "9=fast",
+		volume.OvercommitParam: "2",
+	}, "thin", "fast")
+
+	// Provision up to twice the size of each pool.
+	id, err := d.Create(api.VolumeLocator{Name: "big"}, nil,
+		&api.VolumeSpec{Size: 2 << 30, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	_, err = d.Create(api.VolumeLocator{Name: "over"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsNone})
+	assert.Equal(t, volume.ErrNoSpace, err, "Pool must not be overcommitted")
+	_, err = d.Snapshot(id, true, api.VolumeLocator{Name: "snap"})
+	assert.Equal(t, volume.ErrNoSpace, err, "Snapshots are provisioned in the pool of their parent")
+
+	fast, err := d.Create(api.VolumeLocator{Name: "fast"}, nil,
+		&api.VolumeSpec{Size: 1 << 30, Format: api.FsNone, Cos: 9})
+	assert.NoError(t, err, "Pools must be provisioned separately")
+	defer d.Delete(fast)
+
+	c, err := d.Capacity()
+	assert.NoError(t, err, "Failed to get capacity")
+	assert.Equal(t, 2.0, c.OvercommitRatio)
+}
+
+func TestCapacity(t *testing.T) {
+	d, f := newTestDriver(t, volume.DriverParams{
+		VolumeGroupParam: "vg0",
+		PoolParam:        "thin",
+		CosPoolsParam:    "9=fast",
+	}, "thin", "fast")
+
+	id, err := d.Create(api.VolumeLocator{Name: "capacity"}, nil,
+		&api.VolumeSpec{Size: 4 << 30, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	f.lvs[string(id)].used = 1 << 28
+	f.lvs["thin"].used = 1 << 28
+
+	c, err := d.Capacity()
+	assert.NoError(t, err, "Failed to get capacity")
+	assert.Equal(t, uint64(2<<30), c.TotalBytes)
+	assert.Equal(t, uint64(1<<28), c.UsedBytes)
+	assert.Equal(t, c.TotalBytes-c.UsedBytes, c.FreeBytes)
+	assert.Equal(t, uint64(4<<30), c.ProvisionedBytes)
+	v, err := d.GetVol(id)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, uint64(1<<28), v.Usage, "Usage must be updated")
+
+	status := d.Status()
+	assert.Contains(t, status, [2]string{"Pool thin", fmt.Sprintf("%d of %d bytes used", 1<<28, 1<<30)})
+	assert.Contains(t, status, [2]string{"Pool fast", fmt.Sprintf("%d of %d bytes used", 0, 1<<30)})
+}
+
+func init() {
+	kv, err := kvdb.New(mem.Name, "lvm_test", []string{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	kvdb.SetInstance(kv)
+}
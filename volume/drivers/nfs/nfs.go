@@ -6,17 +6,19 @@ import (
 	"io"
 	"os"
 	"path"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/config"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/pkg/fscopy"
 	"github.com/libopenstorage/openstorage/pkg/mount"
+	"github.com/libopenstorage/openstorage/pkg/quota"
 	"github.com/libopenstorage/openstorage/pkg/seed"
+	"github.com/libopenstorage/openstorage/pkg/stats"
 	"github.com/libopenstorage/openstorage/volume"
-	"github.com/pborman/uuid"
 	"github.com/portworx/kvdb"
 )
 
@@ -30,80 +32,14 @@ const (
 
 // Implements the open storage volume interface.
 type driver struct {
-	*volume.IoNotSupported
 	*volume.DefaultEnumerator
+	*volume.ThinPool
 	nfsServer string
 	nfsPath   string
 	mounter   mount.Manager
-}
-
-func copyFile(source string, dest string) (err error) {
-	sourcefile, err := os.Open(source)
-	if err != nil {
-		return err
-	}
-
-	defer sourcefile.Close()
-
-	destfile, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-
-	defer destfile.Close()
-
-	_, err = io.Copy(destfile, sourcefile)
-	if err == nil {
-		sourceinfo, err := os.Stat(source)
-		if err != nil {
-			err = os.Chmod(dest, sourceinfo.Mode())
-		}
-
-	}
-
-	return
-}
-
-func copyDir(source string, dest string) (err error) {
-	// get properties of source dir
-	sourceinfo, err := os.Stat(source)
-	if err != nil {
-		return err
-	}
-
-	// create dest dir
-
-	err = os.MkdirAll(dest, sourceinfo.Mode())
-	if err != nil {
-		return err
-	}
-
-	directory, _ := os.Open(source)
-
-	objects, err := directory.Readdir(-1)
-
-	for _, obj := range objects {
-
-		sourcefilepointer := source + "/" + obj.Name()
-
-		destinationfilepointer := dest + "/" + obj.Name()
-
-		if obj.IsDir() {
-			// create sub-directories - recursively
-			err = copyDir(sourcefilepointer, destinationfilepointer)
-			if err != nil {
-				fmt.Println(err)
-			}
-		} else {
-			// perform copy
-			err = copyFile(sourcefilepointer, destinationfilepointer)
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
-
-	}
-	return
+	// quota enforces volume sizes, if the exported filesystem is local
+	// and supports it.
+	quota quota.Quota
 }
 
 func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
@@ -127,13 +63,17 @@ func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 	}
 
 	inst := &driver{
-		IoNotSupported:    &volume.IoNotSupported{},
 		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kvdb.Instance()),
 		nfsServer:         server,
 		nfsPath:           path,
 		mounter:           mounter,
 	}
 
+	inst.ThinPool, err = volume.NewThinPool(nfsMountPath, params, inst.DefaultEnumerator, inst.usage)
+	if err != nil {
+		return nil, err
+	}
+
 	err = os.MkdirAll(nfsMountPath, 0744)
 	if err != nil {
 		return nil, err
@@ -160,6 +100,14 @@ func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 		}
 	}
 
+	inst.quota, err = quota.New(nfsMountPath)
+	if err != nil {
+		logrus.Warnf("Volume sizes are not enforced on %v: %v", nfsMountPath, err)
+		inst.quota = nil
+	} else {
+		logrus.Infof("Enforcing volume sizes with %v quotas", inst.quota)
+	}
+
 	volumeInfo, err := inst.DefaultEnumerator.Enumerate(api.VolumeLocator{}, nil)
 	if err == nil {
 		for _, info := range volumeInfo {
@@ -167,10 +115,12 @@ func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
 				info.Status = api.Up
 				inst.UpdateVol(&info)
 			}
+			inst.setQuota(&info)
 		}
 	} else {
 		logrus.Println("Could not enumerate Volumes, ", err)
 	}
+	inst.Watch(volume.UsageCheckPeriod)
 
 	logrus.Println("NFS initialized and driver mounted at: ", nfsMountPath)
 	return inst, nil
@@ -186,7 +136,40 @@ func (d *driver) Type() api.DriverType {
 
 // Status diagnostic information
 func (d *driver) Status() [][2]string {
-	return [][2]string{}
+	return d.CapacityStatus()
+}
+
+// setQuota limits the files of v to its size.
+func (d *driver) setQuota(v *api.Volume) {
+	if d.quota == nil || v.Spec == nil {
+		return
+	}
+	if err := d.quota.Set(path.Join(nfsMountPath, string(v.ID)), v.Spec.Size); err != nil {
+		logrus.Warnf("Failed to set quota of volume %v: %v", v.ID, err)
+	}
+}
+
+// usage returns the bytes allocated to the files and block file of v.
+func (d *driver) usage(v *api.Volume) (uint64, error) {
+	volPath := path.Join(nfsMountPath, string(v.ID))
+	used, err := uint64(0), quota.ErrNotSupported
+	if d.quota != nil {
+		used, err = d.quota.Usage(volPath)
+	}
+	if err != nil {
+		s, err := stats.DirStats(volPath)
+		if err != nil {
+			return 0, err
+		}
+		used = uint64(s.BytesUsed)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path.Join(nfsMountPath, string(v.ID)+nfsBlockFile), &st); err != nil {
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return used + uint64(st.Blocks)*512, nil
 }
 
 //
@@ -194,48 +177,81 @@ func (d *driver) Status() [][2]string {
 //
 
 func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
-	volumeID := uuid.New()
-	volumeID = strings.TrimSuffix(volumeID, "\n")
+	return d.create(locator, volume.CloneSource(source), spec)
+}
+
+// create creates a volume recording source as given, snapshots are created
+// with their parent as source.
+func (d *driver) create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	if source != nil && source.Parent != api.BadVolumeID {
+		parent, err := d.GetVol(source.Parent)
+		if err == nil {
+			err = volume.CloneSpec(parent, spec)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
+	release, err := d.Provision(spec.Size)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	defer release()
+
+	volumeID := d.NewVolumeID()
 
 	// Create a directory on the NFS server with this UUID.
-	volPath := path.Join(nfsMountPath, volumeID)
-	err := os.MkdirAll(volPath, 0744)
+	volPath := path.Join(nfsMountPath, string(volumeID))
+	err = os.MkdirAll(volPath, 0744)
 	if err != nil {
 		logrus.Println(err)
 		return api.BadVolumeID, err
 	}
+	blockFile := path.Join(nfsMountPath, string(volumeID)+nfsBlockFile)
+	// fail removes the files of the volume if it cannot be created.
+	fail := func(err error) (api.VolumeID, error) {
+		os.RemoveAll(volPath)
+		os.Remove(blockFile)
+		return api.BadVolumeID, err
+	}
 	if source != nil {
-		if len(source.Seed) != 0 {
+		if source.Parent != api.BadVolumeID {
+			if err = d.clone(source.Parent, volumeID); err != nil {
+				logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+				return fail(err)
+			}
+		} else if len(source.Seed) != 0 {
 			seed, err := seed.New(source.Seed, spec.ConfigLabels)
 			if err != nil {
 				logrus.Warnf("Failed to initailize seed from %q : %v",
 					source.Seed, err)
-				return api.BadVolumeID, err
+				return fail(err)
 			}
 			err = seed.Load(path.Join(volPath, config.DataDir))
 			if err != nil {
 				logrus.Warnf("Failed to  seed from %q to %q: %v",
 					source.Seed, nfsMountPath, err)
-				return api.BadVolumeID, err
+				return fail(err)
 			}
 		}
 	}
 
-	f, err := os.Create(path.Join(nfsMountPath, string(volumeID)+nfsBlockFile))
+	f, err := os.OpenFile(blockFile, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		logrus.Println(err)
-		return api.BadVolumeID, err
+		return fail(err)
 	}
 	defer f.Close()
 
 	err = f.Truncate(int64(spec.Size))
 	if err != nil {
 		logrus.Println(err)
-		return api.BadVolumeID, err
+		return fail(err)
 	}
 
 	v := &api.Volume{
-		ID:         api.VolumeID(volumeID),
+		ID:         volumeID,
 		Source:     source,
 		Locator:    locator,
 		Ctime:      time.Now(),
@@ -244,16 +260,28 @@ func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api
 		Format:     "nfs",
 		State:      api.VolumeAvailable,
 		Status:     api.Up,
-		DevicePath: path.Join(nfsMountPath, string(volumeID)+nfsBlockFile),
+		DevicePath: blockFile,
 	}
+	d.setQuota(v)
 
 	err = d.CreateVol(v)
 	if err != nil {
-		return api.BadVolumeID, err
+		return fail(err)
 	}
 	return v.ID, err
 }
 
+// clone copies the files and block file of parentID into the new volume
+// volumeID.
+func (d *driver) clone(parentID api.VolumeID, volumeID api.VolumeID) error {
+	err := fscopy.Dir(path.Join(nfsMountPath, string(parentID)), path.Join(nfsMountPath, string(volumeID)), nil)
+	if err != nil {
+		return err
+	}
+	return fscopy.File(path.Join(nfsMountPath, string(parentID)+nfsBlockFile),
+		path.Join(nfsMountPath, string(volumeID)+nfsBlockFile), nil)
+}
+
 func (d *driver) Delete(volumeID api.VolumeID) error {
 	v, err := d.GetVol(volumeID)
 	if err != nil {
@@ -291,6 +319,8 @@ func (d *driver) Mount(volumeID api.VolumeID, mountpath string) error {
 		if err != nil {
 			logrus.Printf("Cannot mount %s at %s because %+v",
 				path.Join(nfsMountPath, string(volumeID)), mountpath, err)
+			alerts.Raise(api.AlertWarning, api.ResourceVolume, string(volumeID),
+				fmt.Sprintf("Failed to mount at %v: %v", mountpath, err))
 			return err
 		}
 	}
@@ -323,22 +353,132 @@ func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.Volu
 	volIDs[0] = volumeID
 	vols, err := d.Inspect(volIDs)
 	if err != nil {
-		return api.BadVolumeID, nil
+		return api.BadVolumeID, err
+	}
+	if len(vols) != 1 {
+		return api.BadVolumeID, volume.ErrEnoEnt
 	}
+
+	// NFS does not support snapshots, so just clone the files.
 	source := &api.Source{Parent: volumeID}
-	newVolumeID, err := d.Create(locator, source, vols[0].Spec)
+	return d.create(locator, source, vols[0].Spec)
+}
+
+// Restore copies the files of snapID back into the volume. The snapshot is
+// copied alongside the volume directory and swapped in by rename so that a
+// failed copy leaves the volume untouched.
+func (d *driver) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
 	if err != nil {
-		return api.BadVolumeID, nil
+		return err
+	}
+	snap, err := d.GetVol(snapID)
+	if err != nil {
+		return err
+	}
+	if err := volume.CheckRestore(v, snap); err != nil {
+		return err
 	}
 
-	// NFS does not support snapshots, so just copy the files.
-	err = copyDir(nfsMountPath+string(volumeID), nfsMountPath+string(newVolumeID))
+	// Stage the directory and block file of the snapshot, then swap them
+	// in, so that a failure leaves the volume as it was.
+	volPath := path.Join(nfsMountPath, string(volumeID))
+	restorePath := volPath + ".restore"
+	oldPath := volPath + ".old"
+	blockFile := volPath + nfsBlockFile
+	restoreBlockFile := restorePath + nfsBlockFile
+	cleanup := func() {
+		os.RemoveAll(restorePath)
+		os.Remove(restoreBlockFile)
+	}
+	cleanup()
+	err = fscopy.Dir(path.Join(nfsMountPath, string(snapID)), restorePath, nil)
+	if err == nil {
+		err = fscopy.File(path.Join(nfsMountPath, string(snapID)+nfsBlockFile), restoreBlockFile, nil)
+	}
+	if err == nil {
+		err = os.Truncate(restoreBlockFile, int64(v.Spec.Size))
+	}
 	if err != nil {
-		d.Delete(newVolumeID)
-		return api.BadVolumeID, nil
+		cleanup()
+		return err
+	}
+	if err := os.Rename(volPath, oldPath); err != nil {
+		cleanup()
+		return err
+	}
+	if err := os.Rename(restorePath, volPath); err != nil {
+		os.Rename(oldPath, volPath)
+		cleanup()
+		return err
 	}
+	if err := os.Rename(restoreBlockFile, blockFile); err != nil {
+		os.RemoveAll(volPath)
+		os.Rename(oldPath, volPath)
+		cleanup()
+		return err
+	}
+	// The restored tree is not in the project of the volume yet, the
+	// limit of the old tree is removed with it.
+	d.setQuota(v)
+	if d.quota != nil {
+		d.quota.Set(oldPath, 0)
+	}
+	os.RemoveAll(oldPath)
+	logrus.Infof("NFS restored volume %v from snapshot %v", volumeID, snapID)
+	return nil
+}
+
+// Read sz bytes at offset from the volume's block file.
+func (d *driver) Read(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := volume.CheckIO(v, buf, sz, offset); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path.Join(nfsMountPath, string(volumeID)+nfsBlockFile))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(buf[:sz], offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return int64(n), err
+}
+
+// Write sz bytes at offset to the volume's block file.
+func (d *driver) Write(volumeID api.VolumeID, buf []byte, sz uint64, offset int64) (int64, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := volume.CheckIO(v, buf, sz, offset); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path.Join(nfsMountPath, string(volumeID)+nfsBlockFile), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.WriteAt(buf[:sz], offset)
+	return int64(n), err
+}
 
-	return newVolumeID, nil
+// Flush the volume's block file to stable storage.
+func (d *driver) Flush(volumeID api.VolumeID) error {
+	if _, err := d.GetVol(volumeID); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(nfsMountPath, string(volumeID)+nfsBlockFile), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 func (d *driver) Attach(volumeID api.VolumeID) (string, error) {
@@ -349,14 +489,25 @@ func (d *driver) Detach(volumeID api.VolumeID) error {
 	return nil
 }
 
+// Set updates the locator and grows the volume if spec specifies a larger
+// size. Other fields in spec are ignored.
 func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
-	if spec != nil {
-		return volume.ErrNotSupported
-	}
 	v, err := d.GetVol(volumeID)
 	if err != nil {
 		return err
 	}
+	if spec != nil && spec.Size != 0 && spec.Size != v.Spec.Size {
+		if spec.Size < v.Spec.Size {
+			return volume.ErrVolShrink
+		}
+		blockFile := path.Join(nfsMountPath, string(volumeID)+nfsBlockFile)
+		if err = os.Truncate(blockFile, int64(spec.Size)); err != nil {
+			return err
+		}
+		logrus.Infof("NFS resized volume %v from %v to %v", volumeID, v.Spec.Size, spec.Size)
+		v.Spec.Size = spec.Size
+		d.setQuota(v)
+	}
 	if locator != nil {
 		v.Locator = *locator
 	}
@@ -364,16 +515,28 @@ func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *ap
 	return err
 }
 
+// Stats returns the space used by the volume directory. There are no I/O
+// statistics for individual NFS volumes.
 func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
-	return api.Stats{}, volume.ErrNotSupported
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	s, err := stats.DirStats(path.Join(nfsMountPath, string(volumeID)))
+	if err != nil {
+		return api.Stats{}, err
+	}
+	volume.CheckUsage(v, s.BytesUsed)
+	return *s, nil
 }
 
 func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
-	return api.Alerts{}, volume.ErrNotSupported
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
 }
 
 func (d *driver) Shutdown() {
 	logrus.Printf("%s Shutting down", Name)
+	d.Unwatch()
 	syscall.Unmount(nfsMountPath, 0)
 }
 
@@ -1,11 +1,16 @@
 package nfs
 
 import (
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/quota"
 	"github.com/libopenstorage/openstorage/volume"
 	"github.com/libopenstorage/openstorage/volume/drivers/test"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -29,5 +34,121 @@ func TestAll(t *testing.T) {
 	ctx := test.NewContext(d)
 	ctx.Filesystem = "nfs"
 
+	test.RunClone(t, ctx)
 	test.RunShort(t, ctx)
 }
+
+func TestResize(t *testing.T) {
+	err := os.MkdirAll(testPath, 0744)
+	if err != nil {
+		t.Fatalf("Failed to create test path: %v", err)
+	}
+	d, err := volume.Get(Name)
+	if err != nil {
+		if d, err = volume.New(Name, volume.DriverParams{"path": testPath}); err != nil {
+			t.Fatalf("Failed to initialize Driver: %v", err)
+		}
+	}
+
+	id, err := d.Create(api.VolumeLocator{Name: "resize"}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+
+	err = d.Set(id, nil, &api.VolumeSpec{Size: 4 << 20})
+	assert.NoError(t, err, "Failed to grow volume")
+	fi, err := os.Stat(path.Join(nfsMountPath, string(id)+nfsBlockFile))
+	assert.NoError(t, err, "Failed to stat block file")
+	assert.Equal(t, int64(4<<20), fi.Size())
+
+	err = d.Set(id, nil, &api.VolumeSpec{Size: 2 << 20})
+	assert.Equal(t, volume.ErrVolShrink, err)
+}
+
+// fakeQuota records the limits set on directory trees.
+type fakeQuota struct {
+	limits map[string]uint64
+}
+
+func (q *fakeQuota) String() string {
+	return "fake"
+}
+
+func (q *fakeQuota) Set(path string, size uint64) error {
+	q.limits[path] = size
+	return nil
+}
+
+func (q *fakeQuota) Usage(path string) (uint64, error) {
+	return 0, quota.ErrNotSupported
+}
+
+func TestRestore(t *testing.T) {
+	err := os.MkdirAll(testPath, 0744)
+	if err != nil {
+		t.Fatalf("Failed to create test path: %v", err)
+	}
+	d, err := volume.Get(Name)
+	if err != nil {
+		if d, err = volume.New(Name, volume.DriverParams{"path": testPath}); err != nil {
+			t.Fatalf("Failed to initialize Driver: %v", err)
+		}
+	}
+
+	id, err := d.Create(api.VolumeLocator{Name: "restore"}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	file := path.Join(nfsMountPath, string(id), "data")
+	err = ioutil.WriteFile(file, []byte("before"), 0644)
+	assert.NoError(t, err, "Failed to write volume")
+
+	snapID, err := d.Snapshot(id, true, api.VolumeLocator{Name: "restore.snap"})
+	assert.NoError(t, err, "Failed in Snapshot")
+	defer d.Delete(snapID)
+
+	err = ioutil.WriteFile(file, []byte("after"), 0644)
+	assert.NoError(t, err, "Failed to write volume")
+	err = ioutil.WriteFile(file+".new", []byte("after"), 0644)
+	assert.NoError(t, err, "Failed to write volume")
+
+	err = d.Restore(snapID, id)
+	assert.Equal(t, volume.ErrNotSnapshot, err)
+
+	q := &fakeQuota{limits: make(map[string]uint64)}
+	saved := d.(*driver).quota
+	d.(*driver).quota = q
+	defer func() { d.(*driver).quota = saved }()
+	err = d.Restore(id, snapID)
+	assert.NoError(t, err, "Failed in Restore")
+	assert.Equal(t, uint64(1<<20), q.limits[path.Join(nfsMountPath, string(id))],
+		"Restored volume must be limited to its size")
+	b, err := ioutil.ReadFile(file)
+	assert.NoError(t, err, "Failed to read restored volume")
+	assert.Equal(t, "before", string(b))
+	_, err = os.Stat(file + ".new")
+	assert.True(t, os.IsNotExist(err), "File created after snapshot survived restore")
+}
+
+func TestDuplicateName(t *testing.T) {
+	err := os.MkdirAll(testPath, 0744)
+	if err != nil {
+		t.Fatalf("Failed to create test path: %v", err)
+	}
+	d, err := volume.Get(Name)
+	if err != nil {
+		if d, err = volume.New(Name, volume.DriverParams{"path": testPath}); err != nil {
+			t.Fatalf("Failed to initialize Driver: %v", err)
+		}
+	}
+
+	id, err := d.Create(api.VolumeLocator{Name: "duplicate"}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	before, err := ioutil.ReadDir(nfsMountPath)
+	assert.NoError(t, err, "Failed to list volumes")
+
+	_, err = d.Create(api.VolumeLocator{Name: "duplicate"}, nil, &api.VolumeSpec{Size: 1 << 20})
+	assert.Equal(t, volume.ErrExist, err)
+	after, err := ioutil.ReadDir(nfsMountPath)
+	assert.NoError(t, err, "Failed to list volumes")
+	assert.Equal(t, len(before), len(after), "Failed Create must remove the volume files")
+}
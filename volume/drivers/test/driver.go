@@ -42,9 +42,11 @@ func NewContext(d volume.VolumeDriver) *Context {
 
 func RunShort(t *testing.T, ctx *Context) {
 	create(t, ctx)
+	capacity(t, ctx)
 	inspect(t, ctx)
 	set(t, ctx)
 	enumerate(t, ctx)
+	rawIO(t, ctx)
 	attach(t, ctx)
 	mount(t, ctx)
 	io(t, ctx)
@@ -57,6 +59,7 @@ func RunShort(t *testing.T, ctx *Context) {
 func Run(t *testing.T, ctx *Context) {
 	RunShort(t, ctx)
 	RunSnap(t, ctx)
+	RunClone(t, ctx)
 	runEnd(t, ctx)
 }
 
@@ -93,6 +96,17 @@ func create(t *testing.T, ctx *Context) {
 	ctx.volID = volID
 }
 
+func capacity(t *testing.T, ctx *Context) {
+	fmt.Println("capacity")
+
+	c, err := ctx.Capacity()
+	if err == volume.ErrNotSupported {
+		return
+	}
+	assert.NoError(t, err, "Failed in Capacity")
+	assert.True(t, c.ProvisionedBytes >= 1*1024*1024*1024, "Created volume is not provisioned")
+}
+
 func inspect(t *testing.T, ctx *Context) {
 	fmt.Println("inspect")
 
@@ -258,6 +272,44 @@ func io(t *testing.T, ctx *Context) {
 	assert.NoError(t, err, "data mismatch %s", string(o))
 }
 
+// rawIO patches the last bytes of the volume through the IODriver interface
+// and restores them.
+func rawIO(t *testing.T, ctx *Context) {
+	fmt.Println("rawIO")
+	vols, err := ctx.Inspect([]api.VolumeID{ctx.volID})
+	assert.NoError(t, err, "Failed in Inspect")
+	if len(vols) != 1 {
+		return
+	}
+	data := []byte("openstorage")
+	offset := int64(vols[0].Spec.Size) - int64(len(data))
+
+	orig := make([]byte, len(data))
+	n, err := ctx.Read(ctx.volID, orig, uint64(len(orig)), offset)
+	if err == volume.ErrNotSupported {
+		return
+	}
+	assert.NoError(t, err, "Failed in Read")
+	assert.Equal(t, int64(len(orig)), n, "Short read")
+
+	n, err = ctx.Write(ctx.volID, data, uint64(len(data)), offset)
+	assert.NoError(t, err, "Failed in Write")
+	assert.Equal(t, int64(len(data)), n, "Short write")
+	err = ctx.Flush(ctx.volID)
+	assert.NoError(t, err, "Failed in Flush")
+
+	buf := make([]byte, len(data))
+	_, err = ctx.Read(ctx.volID, buf, uint64(len(buf)), offset)
+	assert.NoError(t, err, "Failed in Read")
+	assert.Equal(t, data, buf, "Read back data mismatch")
+
+	_, err = ctx.Read(ctx.volID, buf, uint64(len(buf)), offset+1)
+	assert.Error(t, err, "Read beyond the end of the volume must fail")
+
+	_, err = ctx.Write(ctx.volID, orig, uint64(len(orig)), offset)
+	assert.NoError(t, err, "Failed in Write")
+}
+
 func detachBad(t *testing.T, ctx *Context) {
 	err := ctx.Detach(ctx.volID)
 	assert.True(t, (err == nil || err == volume.ErrNotSupported),
@@ -332,6 +384,59 @@ func snapEnumerate(t *testing.T, ctx *Context) {
 	assert.Equal(t, snaps[0].ID, ctx.snapID, "Expect snapID %v actual %v", ctx.snapID, snaps[0].ID)
 }
 
+// RunClone creates a volume with data on it, clones it and verifies that the
+// clone records its parent and holds the same data.
+func RunClone(t *testing.T, ctx *Context) {
+	create(t, ctx)
+	attach(t, ctx)
+	mount(t, ctx)
+	io(t, ctx)
+	unmount(t, ctx)
+	detach(t, ctx)
+	clone(t, ctx)
+	delete(t, ctx)
+}
+
+func clone(t *testing.T, ctx *Context) {
+	fmt.Println("clone")
+	parentID := ctx.volID
+	cloneID, err := ctx.Create(
+		api.VolumeLocator{Name: "foo.clone", VolumeLabels: api.Labels{"oh": "clone"}},
+		&api.Source{Parent: parentID},
+		&api.VolumeSpec{
+			Size:    1 * 1024 * 1024 * 1024,
+			HALevel: 1,
+			Format:  api.Filesystem(ctx.Filesystem),
+		})
+	assert.NoError(t, err, "Failed in Create of clone")
+	if err != nil {
+		return
+	}
+
+	vols, err := ctx.Inspect([]api.VolumeID{cloneID})
+	assert.NoError(t, err, "Failed in Inspect")
+	assert.Equal(t, 1, len(vols), "Expect 1 volume actual %v volumes", len(vols))
+	if len(vols) == 1 {
+		assert.NotNil(t, vols[0].Source, "Clone does not record its source")
+		if vols[0].Source != nil {
+			assert.Equal(t, parentID, vols[0].Source.Parent,
+				"Expect parent %v actual %v", parentID, vols[0].Source.Parent)
+			assert.True(t, vols[0].Source.Clone, "Clone is recorded as a snapshot")
+		}
+	}
+
+	ctx.volID = cloneID
+	attach(t, ctx)
+	mount(t, ctx)
+	cmd := exec.Command("diff", ctx.testFile, fmt.Sprintf("%s/xx", ctx.mountPath))
+	o, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "clone data mismatch %s", string(o))
+	unmount(t, ctx)
+	detach(t, ctx)
+	delete(t, ctx)
+	ctx.volID = parentID
+}
+
 func snapDiff(t *testing.T, ctx *Context) {
 	fmt.Println("snapDiff")
 }
@@ -4,14 +4,16 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/pkg/fscopy"
+	"github.com/libopenstorage/openstorage/pkg/quota"
+	"github.com/libopenstorage/openstorage/pkg/stats"
 	"github.com/libopenstorage/openstorage/volume"
-	"github.com/pborman/uuid"
 	"github.com/portworx/kvdb"
 )
 
@@ -26,14 +28,68 @@ type driver struct {
 	*volume.DefaultBlockDriver
 	*volume.DefaultEnumerator
 	*volume.SnapshotNotSupported
+	*volume.RestoreNotSupported
+	*volume.ThinPool
+	// quota enforces volume sizes, if the filesystem supports it.
+	quota quota.Quota
 }
 
 // Init Driver intialization.
 func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
-	return &driver{
+	if err := os.MkdirAll(volumeBase, 0744); err != nil {
+		return nil, err
+	}
+	inst := &driver{
 		IoNotSupported:    &volume.IoNotSupported{},
 		DefaultEnumerator: volume.NewDefaultEnumerator(Name, kvdb.Instance()),
-	}, nil
+	}
+	var err error
+	inst.ThinPool, err = volume.NewThinPool(volumeBase, params, inst.DefaultEnumerator, inst.usage)
+	if err != nil {
+		return nil, err
+	}
+
+	inst.quota, err = quota.New(volumeBase)
+	if err != nil {
+		logrus.Warnf("Volume sizes are not enforced on %v: %v", volumeBase, err)
+		inst.quota = nil
+	} else {
+		logrus.Infof("Enforcing volume sizes with %v quotas", inst.quota)
+	}
+	vols, err := inst.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vols {
+		inst.setQuota(&vols[i])
+	}
+	inst.Watch(volume.UsageCheckPeriod)
+	return inst, nil
+}
+
+// setQuota limits the files of v to its size.
+func (d *driver) setQuota(v *api.Volume) {
+	if d.quota == nil || v.Spec == nil {
+		return
+	}
+	if err := d.quota.Set(path.Join(volumeBase, string(v.ID)), v.Spec.Size); err != nil {
+		logrus.Warnf("Failed to set quota of volume %v: %v", v.ID, err)
+	}
+}
+
+// usage returns the bytes allocated to the files of v.
+func (d *driver) usage(v *api.Volume) (uint64, error) {
+	volPath := path.Join(volumeBase, string(v.ID))
+	if d.quota != nil {
+		if used, err := d.quota.Usage(volPath); err == nil {
+			return used, nil
+		}
+	}
+	s, err := stats.DirStats(volPath)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(s.BytesUsed), nil
 }
 
 func (d *driver) String() string {
@@ -46,18 +102,38 @@ func (d *driver) Type() api.DriverType {
 
 func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
 
-	volumeID := uuid.New()
-	volumeID = strings.TrimSuffix(volumeID, "\n")
+	var parent *api.Volume
+	if source != nil && source.Parent != api.BadVolumeID {
+		var err error
+		parent, err = d.GetVol(source.Parent)
+		if err == nil {
+			err = volume.CloneSpec(parent, spec)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
+
+	release, err := d.Provision(spec.Size)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	defer release()
+
+	volumeID := d.NewVolumeID()
+	volPath := path.Join(volumeBase, string(volumeID))
 
 	// Create a directory on the Local machine with this UUID.
-	err := os.MkdirAll(path.Join(volumeBase, string(volumeID)), 0744)
+	err = os.MkdirAll(volPath, 0744)
 	if err != nil {
 		logrus.Println(err)
 		return api.BadVolumeID, err
 	}
 
 	v := &api.Volume{
-		ID:         api.VolumeID(volumeID),
+		ID:         volumeID,
+		Source:     volume.CloneSource(source),
 		Locator:    locator,
 		Ctime:      time.Now(),
 		Spec:       spec,
@@ -65,11 +141,22 @@ func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api
 		Format:     "vfs",
 		State:      api.VolumeAvailable,
 		Status:     api.Up,
-		DevicePath: path.Join(volumeBase, string(volumeID)),
+		DevicePath: volPath,
+	}
+	d.setQuota(v)
+
+	if parent != nil {
+		err = fscopy.Dir(path.Join(volumeBase, string(source.Parent)), volPath, nil)
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			os.RemoveAll(volPath)
+			return api.BadVolumeID, err
+		}
 	}
 
 	err = d.CreateVol(v)
 	if err != nil {
+		os.RemoveAll(volPath)
 		return api.BadVolumeID, err
 	}
 
@@ -159,25 +246,35 @@ func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *ap
 	return err
 }
 
-// Stats Not Supported.
+// Stats returns the space used by the volume directory.
 func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
-	return api.Stats{}, volume.ErrNotSupported
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	s, err := stats.DirStats(v.DevicePath)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	volume.CheckUsage(v, s.BytesUsed)
+	return *s, nil
 }
 
-// Alerts Not Supported.
+// Alerts raised on this volume.
 func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
-	return api.Alerts{}, volume.ErrNotSupported
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
 }
 
 // Status returns a set of key-value pairs which give low
 // level diagnostic status about this driver.
 func (d *driver) Status() [][2]string {
-	return [][2]string{}
+	return d.CapacityStatus()
 }
 
 // Shutdown and cleanup.
 func (d *driver) Shutdown() {
 	logrus.Debugf("%s Shutting down", Name)
+	d.Unwatch()
 }
 
 func init() {
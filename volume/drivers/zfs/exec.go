@@ -0,0 +1,30 @@
+package zfs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Executor runs zfs commands.
+type Executor interface {
+	// Run runs zfs with args and returns its standard output.
+	Run(args ...string) (string, error)
+}
+
+// zfsExecutor runs the zfs binary.
+type zfsExecutor struct {
+}
+
+func (e *zfsExecutor) Run(args ...string) (string, error) {
+	cmd := exec.Command("zfs", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("zfs %v: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,606 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/pkg/alerts"
+	"github.com/libopenstorage/openstorage/pkg/fs"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/kvdb"
+)
+
+const (
+	Name = "zfs"
+	Type = api.File | api.Block
+	// DatasetParam driver parameter, the dataset volumes are created in,
+	// e.g. tank/openstorage.
+	DatasetParam = "dataset"
+	// ZvolDevPrefix is the directory of zvol block devices.
+	ZvolDevPrefix = "/dev/zvol/"
+	// zvolBlockSize is the volblocksize of new zvols, whose sizes must be
+	// a multiple of it.
+	zvolBlockSize = 16 << 10
+)
+
+// Implements the open storage volume interface with zfs datasets for file
+// volumes and zvols for block volumes.
+type driver struct {
+	*volume.IoNotSupported
+	*volume.RestoreNotSupported
+	*volume.DefaultEnumerator
+	// lock serializes attach and resize.
+	lock    sync.Mutex
+	zfs     Executor
+	dataset string
+	// overcommit is the ratio of the provisioned size of the volumes to
+	// the size of the dataset, 0 if volumes are provisioned without limit.
+	overcommit float64
+}
+
+func Init(params volume.DriverParams) (volume.VolumeDriver, error) {
+	return newDriver(params, &zfsExecutor{})
+}
+
+func newDriver(params volume.DriverParams, zfs Executor) (*driver, error) {
+	dataset, ok := params[DatasetParam]
+	if !ok {
+		return nil, fmt.Errorf("Dataset should be specified with key %q", DatasetParam)
+	}
+	overcommit := 0.0
+	if ratio, ok := params[volume.OvercommitParam]; ok {
+		var err error
+		overcommit, err = strconv.ParseFloat(ratio, 64)
+		if err != nil || overcommit <= 0 {
+			return nil, fmt.Errorf("Invalid %v %q", volume.OvercommitParam, ratio)
+		}
+	}
+	inst := &driver{
+		IoNotSupported:      &volume.IoNotSupported{},
+		RestoreNotSupported: &volume.RestoreNotSupported{},
+		DefaultEnumerator:   volume.NewDefaultEnumerator(Name, kvdb.Instance()),
+		zfs:                 zfs,
+		dataset:             dataset,
+		overcommit:          overcommit,
+	}
+	if _, err := inst.get(dataset, "used", "available"); err != nil {
+		return nil, err
+	}
+	logrus.Infof("ZFS driver initialized with dataset %v", dataset)
+	return inst, nil
+}
+
+// name returns the dataset or zvol of volumeID.
+func (d *driver) name(volumeID api.VolumeID) string {
+	return d.dataset + "/" + string(volumeID)
+}
+
+// isBlock returns true if v is backed by a zvol. Volumes formatted with
+// zfs are datasets.
+func isBlock(v *api.Volume) bool {
+	return v.Spec.Format != api.FsZfs
+}
+
+// sizeProperty returns the property limiting the size of v.
+func sizeProperty(v *api.Volume) string {
+	if isBlock(v) {
+		return "volsize"
+	}
+	return "quota"
+}
+
+// roundUp returns size rounded up to a multiple of block.
+func roundUp(size uint64, block uint64) uint64 {
+	return (size + block - 1) / block * block
+}
+
+// zvolSize returns size rounded up to a multiple of the volblocksize of
+// the zvol name.
+func (d *driver) zvolSize(name string, size uint64) (uint64, error) {
+	p, err := d.get(name, "volblocksize")
+	if err != nil {
+		return 0, err
+	}
+	if p["volblocksize"] == 0 {
+		return size, nil
+	}
+	return roundUp(size, p["volblocksize"]), nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// get returns the numeric properties of the dataset or zvol name.
+func (d *driver) get(name string, properties ...string) (map[string]uint64, error) {
+	out, err := d.zfs.Run("get", "-H", "-p", "-o", "property,value",
+		strings.Join(properties, ","), name)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v of %v: %q", fields[0], name, fields[1])
+		}
+		values[fields[0]] = n
+	}
+	for _, p := range properties {
+		if _, ok := values[p]; !ok {
+			return nil, fmt.Errorf("Missing %v of %v", p, name)
+		}
+	}
+	return values, nil
+}
+
+// used returns the space used by the children of the dataset of the driver.
+func (d *driver) used() (map[string]uint64, error) {
+	out, err := d.zfs.Run("list", "-H", "-p", "-o", "name,used", "-d", "1", d.dataset)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]uint64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid used of %v: %q", fields[0], fields[1])
+		}
+		used[fields[0]] = n
+	}
+	return used, nil
+}
+
+func (d *driver) String() string {
+	return Name
+}
+
+func (d *driver) Type() api.DriverType {
+	return Type
+}
+
+// Status reports the space used and available in the dataset.
+func (d *driver) Status() [][2]string {
+	p, err := d.get(d.dataset, "used", "available")
+	if err != nil {
+		return [][2]string{{"Error", err.Error()}}
+	}
+	return [][2]string{
+		{"Dataset", d.dataset},
+		{"Used", fmt.Sprintf("%d bytes", p["used"])},
+		{"Available", fmt.Sprintf("%d bytes", p["available"])},
+	}
+}
+
+// Capacity of the dataset. The usage of each volume is recorded in its
+// Usage.
+func (d *driver) Capacity() (api.Capacity, error) {
+	p, err := d.get(d.dataset, "used", "available")
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	c := api.Capacity{
+		TotalBytes:      p["used"] + p["available"],
+		FreeBytes:       p["available"],
+		UsedBytes:       p["used"],
+		OvercommitRatio: d.overcommit,
+	}
+	used, err := d.used()
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return api.Capacity{}, err
+	}
+	for i := range vols {
+		v := &vols[i]
+		if v.Spec != nil {
+			c.ProvisionedBytes += v.Spec.Size
+		}
+		u, ok := used[d.name(v.ID)]
+		if !ok || u == v.Usage {
+			continue
+		}
+		err := d.ModifyVol(v.ID, func(v *api.Volume) bool {
+			v.Usage = u
+			return true
+		})
+		if err != nil {
+			logrus.Warnf("Failed to update usage of volume %v: %v", v.ID, err)
+		}
+	}
+	return c, nil
+}
+
+// provision reserves size bytes of the dataset for a new volume. It returns
+// ErrNoSpace if the volume would take the provisioned size of the dataset,
+// with the volumes being created, beyond the overcommit ratio. The caller
+// calls the returned function once the volume is recorded or failed to be
+// created.
+func (d *driver) provision(size uint64) (func(), error) {
+	if d.overcommit == 0 {
+		return func() {}, nil
+	}
+	return d.Reserve(d.dataset, size, func(reserved uint64) error {
+		p, err := d.get(d.dataset, "used", "available")
+		if err != nil {
+			return err
+		}
+		vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+		if err != nil {
+			return err
+		}
+		provisioned := reserved + size
+		for _, v := range vols {
+			if v.Spec != nil {
+				provisioned += v.Spec.Size
+			}
+		}
+		if float64(provisioned) > d.overcommit*float64(p["used"]+p["available"]) {
+			return volume.ErrNoSpace
+		}
+		return nil
+	})
+}
+
+// Create a dataset or zvol by the format of spec, or a clone of a snapshot
+// of the parent volume if source specifies one.
+func (d *driver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	return d.create(locator, volume.CloneSource(source), spec)
+}
+
+// create creates a volume recording source as given, snapshots are created
+// with their parent as source.
+func (d *driver) create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	var parent *api.Volume
+	if source != nil && source.Parent != api.BadVolumeID {
+		var err error
+		parent, err = d.GetVol(source.Parent)
+		if err == nil {
+			err = volume.CloneSpec(parent, spec)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to clone %v: %v", source.Parent, err)
+			return api.BadVolumeID, err
+		}
+	}
+
+	if spec.Size == 0 {
+		return api.BadVolumeID, errors.New("Volume size cannot be zero")
+	}
+
+	if spec.Format == "" {
+		return api.BadVolumeID, errors.New("Missing volume format")
+	}
+
+	// The size of zvols is a multiple of their block size, that of
+	// clones is inherited from the parent.
+	if spec.Format != api.FsZfs {
+		if parent == nil {
+			spec.Size = roundUp(spec.Size, zvolBlockSize)
+		} else if spec.Size > parent.Spec.Size {
+			size, err := d.zvolSize(d.name(parent.ID), spec.Size)
+			if err != nil {
+				return api.BadVolumeID, err
+			}
+			spec.Size = size
+		}
+	}
+
+	release, err := d.provision(spec.Size)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	defer release()
+
+	v := &api.Volume{
+		ID:       d.NewVolumeID(),
+		Source:   source,
+		Locator:  locator,
+		Ctime:    time.Now(),
+		Spec:     spec,
+		LastScan: time.Now(),
+		State:    api.VolumeDetached,
+		Status:   api.Up,
+	}
+	name := d.name(v.ID)
+	size := strconv.FormatUint(spec.Size, 10)
+	dedup := "dedup=" + onOff(spec.Dedupe)
+	if parent != nil {
+		origin := d.name(parent.ID) + "@" + string(v.ID)
+		if _, err := d.zfs.Run("snapshot", origin); err != nil {
+			return api.BadVolumeID, err
+		}
+		// Clones inherit the quota of the parent dataset and not that
+		// of their origin, zvols keep the volsize of their origin.
+		args := []string{"clone", "-o", dedup}
+		if !isBlock(v) {
+			args = append(args, "-o", "quota="+size, "-o", "mountpoint=legacy")
+		}
+		_, err := d.zfs.Run(append(args, origin, name)...)
+		if err == nil && isBlock(v) && spec.Size > parent.Spec.Size {
+			_, err = d.zfs.Run("set", sizeProperty(v)+"="+size, name)
+		}
+		if err != nil {
+			d.zfs.Run("destroy", name)
+			d.zfs.Run("destroy", origin)
+			return api.BadVolumeID, err
+		}
+		v.Format = parent.Format
+	} else if isBlock(v) {
+		_, err := d.zfs.Run("create", "-s", "-V", size, "-o", dedup,
+			"-o", "volblocksize="+strconv.Itoa(zvolBlockSize), name)
+		if err != nil {
+			return api.BadVolumeID, err
+		}
+	} else {
+		_, err := d.zfs.Run("create", "-o", "quota="+size, "-o", dedup,
+			"-o", "mountpoint=legacy", name)
+		if err != nil {
+			return api.BadVolumeID, err
+		}
+		v.Format = api.FsZfs
+	}
+
+	if err := d.CreateVol(v); err != nil {
+		d.destroy(v)
+		return api.BadVolumeID, err
+	}
+	return v.ID, nil
+}
+
+// destroy destroys the dataset or zvol of v and the snapshot it was cloned
+// from.
+func (d *driver) destroy(v *api.Volume) error {
+	if _, err := d.zfs.Run("destroy", d.name(v.ID)); err != nil {
+		return err
+	}
+	if v.Source != nil && v.Source.Parent != api.BadVolumeID {
+		origin := d.name(v.Source.Parent) + "@" + string(v.ID)
+		if _, err := d.zfs.Run("destroy", origin); err != nil {
+			logrus.Warnf("Failed to destroy snapshot %v: %v", origin, err)
+		}
+	}
+	return nil
+}
+
+// Delete destroys the volume. Volumes with snapshots or clones cannot be
+// deleted, they are clones of zfs snapshots of the volume.
+func (d *driver) Delete(volumeID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		logrus.Println(err)
+		return err
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+	vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+	if err != nil {
+		return err
+	}
+	for _, child := range vols {
+		if child.Source != nil && child.Source.Parent == volumeID {
+			return volume.ErrVolHasSnaps
+		}
+	}
+	if err := d.destroy(v); err != nil {
+		return err
+	}
+	logrus.Infof("ZFS deleted volume %v", volumeID)
+
+	err = d.DeleteVol(volumeID)
+	if err != nil {
+		logrus.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (d *driver) Mount(volumeID api.VolumeID, mountpath string) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return fmt.Errorf("Failed to locate volume %q", string(volumeID))
+	}
+	source := d.name(volumeID)
+	if isBlock(v) {
+		if v.State != api.VolumeAttached {
+			return volume.ErrVolDetached
+		}
+		source = v.DevicePath
+	}
+	err = syscall.Mount(source, mountpath, string(v.Format), 0, "")
+	if err != nil {
+		logrus.Errorf("Mounting %s on %s failed because of %v", source, mountpath, err)
+		err = fmt.Errorf("Failed to mount %v at %v: %v", source, mountpath, err)
+		alerts.Raise(api.AlertWarning, api.ResourceVolume, string(volumeID), err.Error())
+		return err
+	}
+
+	logrus.Infof("ZFS mounted %s at %s", source, mountpath)
+
+	v.AttachPath = mountpath
+	return d.UpdateVol(v)
+}
+
+func (d *driver) Unmount(volumeID api.VolumeID, mountpath string) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if v.AttachPath == "" {
+		return fmt.Errorf("Device %v not mounted", volumeID)
+	}
+	err = syscall.Unmount(v.AttachPath, 0)
+	if err != nil {
+		return err
+	}
+	v.AttachPath = ""
+	return d.UpdateVol(v)
+}
+
+// Snapshot clones a zfs snapshot of the volume. Snapshots of mounted
+// volumes are crash consistent.
+func (d *driver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.VolumeLocator) (api.VolumeID, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	source := &api.Source{Parent: volumeID}
+	return d.create(locator, source, v.Spec)
+}
+
+// Set updates the locator and grows the volume if spec specifies a larger
+// size. Other fields in spec are ignored.
+func (d *driver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if spec != nil && spec.Size != 0 && spec.Size != v.Spec.Size {
+		if spec.Size < v.Spec.Size {
+			return volume.ErrVolShrink
+		}
+		if isBlock(v) {
+			size, err := d.zvolSize(d.name(volumeID), spec.Size)
+			if err != nil {
+				return err
+			}
+			spec.Size = size
+		}
+		property := sizeProperty(v) + "=" + strconv.FormatUint(spec.Size, 10)
+		if _, err := d.zfs.Run("set", property, d.name(volumeID)); err != nil {
+			return err
+		}
+		logrus.Infof("ZFS resized volume %v from %v to %v", volumeID, v.Spec.Size, spec.Size)
+		v.Spec.Size = spec.Size
+		if isBlock(v) && v.State == api.VolumeAttached {
+			if err := fs.Grow(string(v.Format), v.DevicePath, v.AttachPath); err != nil {
+				logrus.Warnf("Failed to grow filesystem on %v: %v", v.DevicePath, err)
+				return err
+			}
+		}
+	}
+	if locator != nil {
+		v.Locator = *locator
+	}
+	return d.UpdateVol(v)
+}
+
+// waitDevice waits for udev to create the link to the zvol device dev.
+func waitDevice(dev string) error {
+	for i := 0; ; i++ {
+		_, err := os.Stat(dev)
+		if err == nil || !os.IsNotExist(err) || i == 10 {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Attach returns the device of a zvol and creates its filesystem on first
+// attach. Datasets are mounted without being attached.
+func (d *driver) Attach(volumeID api.VolumeID) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return "", err
+	}
+	if !isBlock(v) {
+		return "", nil
+	}
+	v.DevicePath = ZvolDevPrefix + d.name(volumeID)
+
+	if v.Format == "" {
+		if v.Spec.Format != api.FsNone {
+			if err := waitDevice(v.DevicePath); err != nil {
+				return "", err
+			}
+			logrus.Infof("Formatting %s with %v", v.DevicePath, v.Spec.Format)
+			cmd := "/sbin/mkfs." + string(v.Spec.Format)
+			o, err := exec.Command(cmd, v.DevicePath).CombinedOutput()
+			if err != nil {
+				logrus.Warnf("Failed to run command %v %v: %s", cmd, v.DevicePath, o)
+				return "", err
+			}
+		}
+		v.Format = v.Spec.Format
+	}
+
+	v.State = api.VolumeAttached
+	if err := d.UpdateVol(v); err != nil {
+		return "", err
+	}
+	return v.DevicePath, nil
+}
+
+func (d *driver) Detach(volumeID api.VolumeID) error {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return err
+	}
+	if !isBlock(v) {
+		return nil
+	}
+	if v.AttachPath != "" {
+		return volume.ErrVolMounted
+	}
+	if v.State != api.VolumeAttached {
+		return volume.ErrVolDetached
+	}
+	v.DevicePath = ""
+	v.State = api.VolumeDetached
+	return d.UpdateVol(v)
+}
+
+// Stats returns the space used by the volume, zfs does not report I/O
+// statistics of datasets and zvols as properties.
+func (d *driver) Stats(volumeID api.VolumeID) (api.Stats, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.Stats{}, err
+	}
+	p, err := d.get(d.name(volumeID), "used")
+	if err != nil {
+		return api.Stats{}, err
+	}
+	volume.CheckUsage(v, int64(p["used"]))
+	return api.Stats{BytesUsed: int64(p["used"])}, nil
+}
+
+func (d *driver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
+	return alerts.Enumerate(api.ResourceVolume, string(volumeID))
+}
+
+func (d *driver) Shutdown() {
+	logrus.Printf("%s Shutting down", Name)
+}
+
+func init() {
+	// Register ourselves as an openstorage volume driver.
+	volume.Register(Name, Init)
+}
@@ -0,0 +1,287 @@
+package zfs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeZfs simulates the zfs commands of the driver. Datasets, zvols and
+// snapshots are kept by name with their properties.
+type fakeZfs struct {
+	datasets map[string]map[string]string
+}
+
+func newFakeZfs(root string) *fakeZfs {
+	return &fakeZfs{datasets: map[string]map[string]string{
+		root: {"used": "0", "available": strconv.Itoa(1 << 30)},
+	}}
+}
+
+// options returns the properties set with -o and the remaining arguments.
+func options(args []string) (map[string]string, []string) {
+	props := make(map[string]string)
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" && i+1 < len(args) {
+			kv := strings.SplitN(args[i+1], "=", 2)
+			props[kv[0]] = kv[1]
+			i++
+		} else {
+			rest = append(rest, args[i])
+		}
+	}
+	return props, rest
+}
+
+func (f *fakeZfs) lookup(name string) (map[string]string, error) {
+	if props, ok := f.datasets[name]; ok {
+		return props, nil
+	}
+	return nil, fmt.Errorf("cannot open '%v': dataset does not exist", name)
+}
+
+func (f *fakeZfs) Run(args ...string) (string, error) {
+	switch args[0] {
+	case "get":
+		props, err := f.lookup(args[len(args)-1])
+		if err != nil {
+			return "", err
+		}
+		out := ""
+		for _, p := range strings.Split(args[len(args)-2], ",") {
+			out += fmt.Sprintf("%v\t%v\n", p, props[p])
+		}
+		return out, nil
+	case "list":
+		root := args[len(args)-1]
+		var names []string
+		for name := range f.datasets {
+			if strings.HasPrefix(name, root+"/") && !strings.Contains(name, "@") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		out := ""
+		for _, name := range names {
+			out += fmt.Sprintf("%v\t%v\n", name, f.datasets[name]["used"])
+		}
+		return out, nil
+	case "create":
+		props, rest := options(args[1:])
+		name := rest[len(rest)-1]
+		if _, ok := f.datasets[name]; ok {
+			return "", fmt.Errorf("cannot create '%v': dataset already exists", name)
+		}
+		if rest[0] == "-s" {
+			props["volsize"] = rest[2]
+		}
+		props["used"] = "0"
+		f.datasets[name] = props
+	case "snapshot":
+		name := args[1]
+		parent, err := f.lookup(strings.Split(name, "@")[0])
+		if err != nil {
+			return "", err
+		}
+		snap := make(map[string]string)
+		for k, v := range parent {
+			snap[k] = v
+		}
+		f.datasets[name] = snap
+	case "clone":
+		props, rest := options(args[1:])
+		snap, err := f.lookup(rest[0])
+		if err != nil {
+			return "", err
+		}
+		// Local properties such as the quota are not copied from the
+		// origin.
+		clone := make(map[string]string)
+		for k, v := range snap {
+			if k != "quota" {
+				clone[k] = v
+			}
+		}
+		for k, v := range props {
+			clone[k] = v
+		}
+		clone["origin"] = rest[0]
+		f.datasets[rest[1]] = clone
+	case "set":
+		props, err := f.lookup(args[2])
+		if err != nil {
+			return "", err
+		}
+		kv := strings.SplitN(args[1], "=", 2)
+		props[kv[0]] = kv[1]
+	case "destroy":
+		name := args[1]
+		if _, err := f.lookup(name); err != nil {
+			return "", err
+		}
+		for other, props := range f.datasets {
+			if strings.HasPrefix(other, name+"@") || props["origin"] == name {
+				return "", fmt.Errorf("cannot destroy '%v': filesystem has children", name)
+			}
+		}
+		delete(f.datasets, name)
+	default:
+		return "", fmt.Errorf("Unknown command %v", args[0])
+	}
+	return "", nil
+}
+
+func newTestDriver(t *testing.T) (*driver, *fakeZfs) {
+	f := newFakeZfs("tank/osd")
+	d, err := newDriver(volume.DriverParams{DatasetParam: "tank/osd"}, f)
+	if err != nil {
+		t.Fatalf("Failed to initialize Driver: %v", err)
+	}
+	return d, f
+}
+
+func TestInit(t *testing.T) {
+	f := newFakeZfs("tank/osd")
+	_, err := newDriver(volume.DriverParams{}, f)
+	assert.Error(t, err, "Missing dataset must fail")
+	_, err = newDriver(volume.DriverParams{DatasetParam: "tank/none"}, f)
+	assert.Error(t, err, "Unknown dataset must fail")
+}
+
+func TestCreate(t *testing.T) {
+	d, f := newTestDriver(t)
+
+	id, err := d.Create(api.VolumeLocator{Name: "file"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsZfs, Dedupe: true})
+	assert.NoError(t, err, "Failed in Create")
+	props := f.datasets["tank/osd/"+string(id)]
+	assert.Equal(t, strconv.Itoa(1<<20), props["quota"], "Size must set the quota of datasets")
+	assert.Equal(t, "on", props["dedup"])
+	assert.Equal(t, "legacy", props["mountpoint"])
+	dev, err := d.Attach(id)
+	assert.NoError(t, err, "Datasets need not be attached")
+	assert.Empty(t, dev)
+	assert.NoError(t, d.Delete(id), "Failed in Delete")
+	assert.NotContains(t, f.datasets, "tank/osd/"+string(id))
+
+	id, err = d.Create(api.VolumeLocator{Name: "block"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	props = f.datasets["tank/osd/"+string(id)]
+	assert.Equal(t, strconv.Itoa(1<<20), props["volsize"], "Size must set the volsize of zvols")
+	assert.Equal(t, "off", props["dedup"])
+
+	dev, err = d.Attach(id)
+	assert.NoError(t, err, "Failed in Attach")
+	assert.Equal(t, "/dev/zvol/tank/osd/"+string(id), dev)
+	assert.NoError(t, d.Set(id, nil, &api.VolumeSpec{Size: 2 << 20}), "Failed to grow volume")
+	assert.Equal(t, strconv.Itoa(2<<20), props["volsize"])
+	assert.Equal(t, volume.ErrVolShrink, d.Set(id, nil, &api.VolumeSpec{Size: 1 << 20}))
+	assert.NoError(t, d.Detach(id), "Failed in Detach")
+	assert.Equal(t, volume.ErrVolDetached, d.Detach(id))
+
+	// Zvol sizes are rounded up to a multiple of their block size.
+	odd, err := d.Create(api.VolumeLocator{Name: "odd"}, nil,
+		&api.VolumeSpec{Size: 1<<20 + 1, Format: api.FsNone})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(odd)
+	props = f.datasets["tank/osd/"+string(odd)]
+	assert.Equal(t, strconv.Itoa(1<<20+zvolBlockSize), props["volsize"])
+	assert.NoError(t, d.Set(odd, nil, &api.VolumeSpec{Size: 2<<20 + 1}), "Failed to grow volume")
+	assert.Equal(t, strconv.Itoa(2<<20+zvolBlockSize), props["volsize"])
+	v, err := d.GetVol(odd)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, uint64(2<<20+zvolBlockSize), v.Spec.Size)
+}
+
+func TestOvercommit(t *testing.T) {
+	f := newFakeZfs("tank/osd")
+	d, err := newDriver(volume.DriverParams{DatasetParam: "tank/osd", volume.OvercommitParam: "2"}, f)
+	if err != nil {
+		t.Fatalf("Failed to initialize Driver: %v", err)
+	}
+	_, err = newDriver(volume.DriverParams{DatasetParam: "tank/osd", volume.OvercommitParam: "none"}, f)
+	assert.Error(t, err, "Invalid overcommit ratio must fail")
+
+	// Provision up to twice the size of the dataset.
+	id, err := d.Create(api.VolumeLocator{Name: "big"}, nil,
+		&api.VolumeSpec{Size: 2 << 30, Format: api.FsZfs})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	_, err = d.Create(api.VolumeLocator{Name: "over"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsZfs})
+	assert.Equal(t, volume.ErrNoSpace, err, "Dataset must not be overcommitted")
+
+	c, err := d.Capacity()
+	assert.NoError(t, err, "Failed to get capacity")
+	assert.Equal(t, 2.0, c.OvercommitRatio)
+}
+
+func TestSnapshot(t *testing.T) {
+	d, f := newTestDriver(t)
+
+	id, err := d.Create(api.VolumeLocator{Name: "origin"}, nil,
+		&api.VolumeSpec{Size: 1 << 20, Format: api.FsZfs})
+	assert.NoError(t, err, "Failed in Create")
+	snapID, err := d.Snapshot(id, true, api.VolumeLocator{Name: "snap"})
+	assert.NoError(t, err, "Failed in Snapshot")
+
+	origin := "tank/osd/" + string(id) + "@" + string(snapID)
+	assert.Contains(t, f.datasets, origin)
+	props := f.datasets["tank/osd/"+string(snapID)]
+	assert.Equal(t, origin, props["origin"], "Snapshots must be clones")
+	assert.Equal(t, "legacy", props["mountpoint"])
+	assert.Equal(t, strconv.Itoa(1<<20), props["quota"], "Snapshots must keep the quota")
+	snap, err := d.GetVol(snapID)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, api.FsZfs, snap.Format)
+
+	assert.Equal(t, volume.ErrVolHasSnaps, d.Delete(id), "Volumes with clones cannot be deleted")
+	assert.NoError(t, d.Delete(snapID), "Failed to delete snapshot")
+	assert.NotContains(t, f.datasets, origin, "Origin snapshot must be destroyed")
+	assert.NoError(t, d.Delete(id), "Failed in Delete")
+}
+
+func TestStatsCapacity(t *testing.T) {
+	d, f := newTestDriver(t)
+
+	id, err := d.Create(api.VolumeLocator{Name: "stats"}, nil,
+		&api.VolumeSpec{Size: 4 << 30, Format: api.FsZfs})
+	assert.NoError(t, err, "Failed in Create")
+	defer d.Delete(id)
+	f.datasets["tank/osd/"+string(id)]["used"] = strconv.Itoa(1 << 20)
+	f.datasets["tank/osd"]["used"] = strconv.Itoa(1 << 20)
+
+	s, err := d.Stats(id)
+	assert.NoError(t, err, "Failed in Stats")
+	assert.Equal(t, int64(1<<20), s.BytesUsed)
+
+	c, err := d.Capacity()
+	assert.NoError(t, err, "Failed to get capacity")
+	assert.Equal(t, uint64(1<<30+1<<20), c.TotalBytes)
+	assert.Equal(t, uint64(1<<30), c.FreeBytes)
+	assert.Equal(t, uint64(4<<30), c.ProvisionedBytes)
+	v, err := d.GetVol(id)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, uint64(1<<20), v.Usage, "Usage must be updated")
+
+	assert.Contains(t, d.Status(), [2]string{"Available", fmt.Sprintf("%d bytes", 1<<30)})
+}
+
+func init() {
+	kv, err := kvdb.New(mem.Name, "zfs_test", []string{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	kvdb.SetInstance(kv)
+}
@@ -3,8 +3,11 @@ package volume
 import (
 	"encoding/json"
 	"fmt"
-	_ "sync"
+	"net/url"
+	"strings"
+	"sync"
 
+	"github.com/pborman/uuid"
 	"github.com/portworx/kvdb"
 
 	"github.com/libopenstorage/openstorage/api"
@@ -14,22 +17,57 @@ const (
 	keyBase = "openstorage/"
 	locks   = "/locks/"
 	volumes = "/volumes/"
+	names   = "/names/"
+	// reservations holds the bytes reserved in the pools of a driver by
+	// volumes being created.
+	reservations = "/reservations/"
+	// reservationTTL expires the reservations of creates that did not
+	// finish, such as those of a daemon that crashed.
+	reservationTTL = 3600
+	// nameTTL expires the names reserved for volumes whose record was
+	// never written, such as those of a daemon that crashed in between.
+	nameTTL = 60
+	// modifyRetries is how many times a volume record changed concurrently
+	// is read again by ModifyVol.
+	modifyRetries = 10
 )
 
+// IDAllocator allocates system wide unique volume IDs.
+type IDAllocator interface {
+	// NewID returns a new volume ID.
+	NewID() api.VolumeID
+}
+
+// UUIDAllocator allocates volume IDs from random UUIDs.
+type UUIDAllocator struct {
+}
+
+// NewID returns a new UUID based volume ID.
+func (u *UUIDAllocator) NewID() api.VolumeID {
+	return api.VolumeID(strings.TrimSuffix(uuid.New(), "\n"))
+}
+
 type Store interface {
+	// NewVolumeID allocates a new volume ID.
+	NewVolumeID() api.VolumeID
+
 	// Lock volume specified by volID.
 	Lock(volID api.VolumeID) (interface{}, error)
 
 	// Lock volume with token obtained from call to Lock.
 	Unlock(token interface{}) error
 
-	// CreateVol returns error if volume with the same ID already existe.
+	// CreateVol returns ErrExist if volume with the same ID or name already exists.
 	CreateVol(vol *api.Volume) error
 
 	// GetVol from volID.
 	GetVol(volID api.VolumeID) (*api.Volume, error)
 
-	// UpdateVol with vol
+	// GetVolByName returns the volume reserved under name. ErrEnoEnt is
+	// returned if no volume has this name.
+	GetVolByName(name string) (*api.Volume, error)
+
+	// UpdateVol with vol. Returns ErrExist if the new name is already in use.
 	UpdateVol(vol *api.Volume) error
 
 	// DeleteVol. Returns error if volume does not exist.
@@ -42,6 +80,9 @@ type DefaultEnumerator struct {
 	driver        string
 	lockKeyPrefix string
 	volKeyPrefix  string
+	nameKeyPrefix string
+	idAllocator   IDAllocator
+	indexOnce     sync.Once
 }
 
 func (e *DefaultEnumerator) lockKey(volID api.VolumeID) string {
@@ -52,6 +93,10 @@ func (e *DefaultEnumerator) volKey(volID api.VolumeID) string {
 	return e.volKeyPrefix + string(volID)
 }
 
+func (e *DefaultEnumerator) nameKey(name string) string {
+	return e.nameKeyPrefix + url.QueryEscape(name)
+}
+
 func hasSubset(set api.Labels, subset api.Labels) bool {
 	if subset == nil || len(subset) == 0 {
 		return true
@@ -96,6 +141,92 @@ func NewDefaultEnumerator(driver string, kvdb kvdb.Kvdb) *DefaultEnumerator {
 		driver:        driver,
 		lockKeyPrefix: keyBase + driver + locks,
 		volKeyPrefix:  keyBase + driver + volumes,
+		nameKeyPrefix: keyBase + driver + names,
+		idAllocator:   &UUIDAllocator{},
+	}
+}
+
+// SetIDAllocator replaces the allocator used to generate volume IDs.
+func (e *DefaultEnumerator) SetIDAllocator(a IDAllocator) {
+	e.idAllocator = a
+}
+
+// NewVolumeID allocates a new volume ID.
+func (e *DefaultEnumerator) NewVolumeID() api.VolumeID {
+	return e.idAllocator.NewID()
+}
+
+// reserveName atomically reserves name for volID. The reservation expires
+// after ttl seconds unless it is kept by keepName, a ttl of 0 never expires.
+func (e *DefaultEnumerator) reserveName(name string, volID api.VolumeID, ttl uint64) error {
+	if name == "" {
+		return nil
+	}
+	_, err := e.kvdb.Create(e.nameKey(name), string(volID), ttl)
+	if err == nil {
+		return nil
+	}
+	// Not all datastores return kvdb.ErrExist, check who holds the name.
+	kvp, getErr := e.kvdb.Get(e.nameKey(name))
+	if getErr != nil {
+		return err
+	}
+	if api.VolumeID(kvp.Value) == volID {
+		return nil
+	}
+	return ErrExist
+}
+
+// keepName makes the reservation of name by volID permanent once the volume
+// record is written. ErrExist is returned if the reservation expired and
+// the name was taken in the meantime.
+func (e *DefaultEnumerator) keepName(name string, volID api.VolumeID) error {
+	if name == "" {
+		return nil
+	}
+	kvp, err := e.kvdb.Get(e.nameKey(name))
+	if err == kvdb.ErrNotFound {
+		return e.reserveName(name, volID, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if api.VolumeID(kvp.Value) != volID {
+		return ErrExist
+	}
+	_, err = e.kvdb.Put(e.nameKey(name), string(volID), 0)
+	return err
+}
+
+// releaseName releases name if it is reserved by volID.
+func (e *DefaultEnumerator) releaseName(name string, volID api.VolumeID) error {
+	if name == "" {
+		return nil
+	}
+	kvp, err := e.kvdb.Get(e.nameKey(name))
+	if err != nil {
+		return err
+	}
+	if api.VolumeID(kvp.Value) != volID {
+		return nil
+	}
+	_, err = e.kvdb.Delete(e.nameKey(name))
+	return err
+}
+
+// indexNames reserves names for volumes that were created before names were
+// indexed.
+func (e *DefaultEnumerator) indexNames() {
+	kvp, err := e.kvdb.Enumerate(e.volKeyPrefix)
+	if err != nil {
+		return
+	}
+	for _, v := range kvp {
+		var elem api.Volume
+		if err := json.Unmarshal(v.Value, &elem); err != nil {
+			continue
+		}
+		e.reserveName(elem.Locator.Name, elem.ID, 0)
 	}
 }
 
@@ -113,28 +244,155 @@ func (e *DefaultEnumerator) Unlock(token interface{}) error {
 	return e.kvdb.Unlock(v)
 }
 
-// CreateVol returns error if volume with the same ID already existe.
+// CreateVol returns ErrExist if volume with the same ID or name already exists.
 func (e *DefaultEnumerator) CreateVol(vol *api.Volume) error {
+	e.indexOnce.Do(e.indexNames)
+
+	if err := e.reserveName(vol.Locator.Name, vol.ID, nameTTL); err != nil {
+		return err
+	}
 	_, err := e.kvdb.Create(e.volKey(vol.ID), vol, 0)
-	return err
+	if err != nil {
+		e.releaseName(vol.Locator.Name, vol.ID)
+		if err == kvdb.ErrExist {
+			return ErrExist
+		}
+		return err
+	}
+	if err := e.keepName(vol.Locator.Name, vol.ID); err != nil {
+		e.kvdb.Delete(e.volKey(vol.ID))
+		return err
+	}
+	return nil
 }
 
 // GetVol from volID.
 func (e *DefaultEnumerator) GetVol(volID api.VolumeID) (*api.Volume, error) {
 	var v api.Volume
 	_, err := e.kvdb.GetVal(e.volKey(volID), &v)
+	if err == kvdb.ErrNotFound {
+		err = ErrEnoEnt
+	}
 
 	return &v, err
 }
 
-// UpdateVol with vol
+// GetVolByName returns the volume reserved under name.
+func (e *DefaultEnumerator) GetVolByName(name string) (*api.Volume, error) {
+	e.indexOnce.Do(e.indexNames)
+
+	kvp, err := e.kvdb.Get(e.nameKey(name))
+	if err != nil {
+		if err == kvdb.ErrNotFound {
+			return nil, ErrEnoEnt
+		}
+		return nil, err
+	}
+	return e.GetVol(api.VolumeID(kvp.Value))
+}
+
+// UpdateVol with vol. If the volume is renamed, the new name is reserved
+// and the old name released.
 func (e *DefaultEnumerator) UpdateVol(vol *api.Volume) error {
-	_, err := e.kvdb.Put(e.volKey(vol.ID), vol, 0)
+	var old api.Volume
+	_, getErr := e.kvdb.GetVal(e.volKey(vol.ID), &old)
+	renamed := getErr != nil || old.Locator.Name != vol.Locator.Name
+	if renamed {
+		if err := e.reserveName(vol.Locator.Name, vol.ID, nameTTL); err != nil {
+			return err
+		}
+	}
+	if _, err := e.kvdb.Put(e.volKey(vol.ID), vol, 0); err != nil {
+		return err
+	}
+	if renamed {
+		if err := e.keepName(vol.Locator.Name, vol.ID); err != nil {
+			return err
+		}
+		if getErr == nil {
+			e.releaseName(old.Locator.Name, vol.ID)
+		}
+	}
+	return nil
+}
+
+// ModifyVol applies modify to the latest record of volID and writes it back
+// if modify returns true. The record is read again and modify applied again
+// if it was changed in the meantime, so that concurrent updates are not
+// overwritten. The name of the volume may not be modified.
+func (e *DefaultEnumerator) ModifyVol(volID api.VolumeID, modify func(v *api.Volume) bool) error {
+	var err error
+	for i := 0; i < modifyRetries; i++ {
+		var kvp *kvdb.KVPair
+		kvp, err = e.kvdb.Get(e.volKey(volID))
+		if err == kvdb.ErrNotFound {
+			return ErrEnoEnt
+		} else if err != nil {
+			return err
+		}
+		var v api.Volume
+		if err := json.Unmarshal(kvp.Value, &v); err != nil {
+			return err
+		}
+		if !modify(&v) {
+			return nil
+		}
+		b, err := json.Marshal(&v)
+		if err != nil {
+			return err
+		}
+		next := &kvdb.KVPair{Key: e.volKey(volID), Value: b, ModifiedIndex: kvp.ModifiedIndex}
+		_, err = e.kvdb.CompareAndSet(next, kvdb.KVModifiedIndex, kvp.Value)
+		if err == kvdb.ErrNotSupported {
+			_, err = e.kvdb.Put(e.volKey(volID), &v, 0)
+		}
+		if err == nil {
+			return nil
+		}
+	}
 	return err
 }
 
+// Reserve reserves size bytes in pool for a volume being created. The pool
+// is locked while check is called with the bytes reserved by the other
+// volumes being created, it returns ErrNoSpace if size bytes may not be
+// provisioned. The reservation is held until the returned function is
+// called, once the volume is recorded or failed to be created.
+func (e *DefaultEnumerator) Reserve(pool string, size uint64, check func(reserved uint64) error) (func(), error) {
+	lock, err := e.kvdb.Lock(e.lockKeyPrefix+url.QueryEscape(pool), 10)
+	if err != nil {
+		return nil, err
+	}
+	defer e.kvdb.Unlock(lock)
+
+	prefix := keyBase + e.driver + reservations + url.QueryEscape(pool) + "/"
+	kvps, err := e.kvdb.Enumerate(prefix)
+	if err != nil && err != kvdb.ErrNotFound {
+		return nil, err
+	}
+	reserved := uint64(0)
+	for _, kvp := range kvps {
+		var n uint64
+		if err := json.Unmarshal(kvp.Value, &n); err == nil {
+			reserved += n
+		}
+	}
+	if err := check(reserved); err != nil {
+		return nil, err
+	}
+	key := prefix + strings.TrimSuffix(uuid.New(), "\n")
+	if _, err := e.kvdb.Put(key, size, reservationTTL); err != nil {
+		return nil, err
+	}
+	return func() { e.kvdb.Delete(key) }, nil
+}
+
 // DeleteVol. Returns error if volume does not exist.
 func (e *DefaultEnumerator) DeleteVol(volID api.VolumeID) error {
+	var v api.Volume
+	if _, err := e.kvdb.GetVal(e.volKey(volID), &v); err == nil {
+		e.releaseName(v.Locator.Name, volID)
+	}
 	_, err := e.kvdb.Delete(e.volKey(volID))
 	return err
 }
@@ -162,6 +420,22 @@ func (e *DefaultEnumerator) Inspect(ids []api.VolumeID) ([]api.Volume, error) {
 func (e *DefaultEnumerator) Enumerate(locator api.VolumeLocator,
 	labels api.Labels) ([]api.Volume, error) {
 
+	// Names are unique, lookup by name does not require a scan.
+	if locator.Name != "" {
+		vols := make([]api.Volume, 0, 1)
+		v, err := e.GetVolByName(locator.Name)
+		if err == ErrEnoEnt {
+			return vols, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if match(v, locator, labels) {
+			vols = append(vols, *v)
+		}
+		return vols, nil
+	}
+
 	kvp, err := e.kvdb.Enumerate(e.volKeyPrefix)
 	if err != nil {
 		return nil, err
@@ -195,8 +469,7 @@ func (e *DefaultEnumerator) SnapEnumerate(
 		if err != nil {
 			return nil, err
 		}
-		if elem.Source == nil ||
-			elem.Source.Parent == api.BadVolumeID ||
+		if !IsSnapshot(&elem) ||
 			(volIDs != nil && !contains(elem.Source.Parent, volIDs)) {
 			continue
 		}
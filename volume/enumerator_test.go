@@ -1,6 +1,7 @@
 package volume
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
@@ -85,13 +86,23 @@ func TestSnapEnumerate(t *testing.T) {
 	assert.NoError(t, err, "Failed in CreateVol")
 	snap := api.Volume{
 		ID:      snapID,
-		Locator: api.VolumeLocator{Name: volName, VolumeLabels: labels},
+		Locator: api.VolumeLocator{Name: snapName, VolumeLabels: labels},
 		State:   api.VolumeAvailable,
 		Spec:    &api.VolumeSpec{},
 		Source:  &api.Source{Parent: id},
 	}
 	err = e.CreateVol(&snap)
 	assert.NoError(t, err, "Failed in CreateSnap")
+	clone := api.Volume{
+		ID:      api.VolumeID("clone"),
+		Locator: api.VolumeLocator{Name: "clone", VolumeLabels: labels},
+		State:   api.VolumeAvailable,
+		Spec:    &api.VolumeSpec{},
+		Source:  CloneSource(&api.Source{Parent: id}),
+	}
+	err = e.CreateVol(&clone)
+	assert.NoError(t, err, "Failed in CreateVol of clone")
+	defer e.DeleteVol(clone.ID)
 
 	snaps, err := e.SnapEnumerate([]api.VolumeID{id}, nil)
 	assert.NoError(t, err, "Failed in Enumerate")
@@ -130,6 +141,106 @@ func TestSnapEnumerate(t *testing.T) {
 	assert.NoError(t, err, "Failed in Delete")
 }
 
+func TestModifyVol(t *testing.T) {
+	vol := api.Volume{
+		ID:      api.VolumeID("modify"),
+		Locator: api.VolumeLocator{Name: "modify"},
+		Spec:    &api.VolumeSpec{},
+	}
+	assert.NoError(t, e.CreateVol(&vol), "Failed in CreateVol")
+	defer e.DeleteVol(vol.ID)
+
+	err := e.ModifyVol(vol.ID, func(v *api.Volume) bool {
+		v.Usage = 1 << 20
+		return true
+	})
+	assert.NoError(t, err, "Failed in ModifyVol")
+	err = e.ModifyVol(vol.ID, func(v *api.Volume) bool {
+		v.Usage = 0
+		return false
+	})
+	assert.NoError(t, err, "Failed in ModifyVol")
+	v, err := e.GetVol(vol.ID)
+	assert.NoError(t, err, "Failed in GetVol")
+	assert.Equal(t, uint64(1<<20), v.Usage, "Unmodified records must not be written")
+
+	err = e.ModifyVol(api.VolumeID("none"), func(v *api.Volume) bool { return true })
+	assert.Equal(t, ErrEnoEnt, err)
+}
+
+type testAllocator struct {
+	next int
+}
+
+func (a *testAllocator) NewID() api.VolumeID {
+	a.next++
+	return api.VolumeID(fmt.Sprintf("test-%d", a.next))
+}
+
+func TestNameUniqueness(t *testing.T) {
+	vol := api.Volume{
+		ID:      api.VolumeID(volName),
+		Locator: api.VolumeLocator{Name: volName, VolumeLabels: labels},
+		State:   api.VolumeAvailable,
+		Spec:    &api.VolumeSpec{},
+	}
+	err := e.CreateVol(&vol)
+	assert.NoError(t, err, "Failed in CreateVol")
+
+	dup := vol
+	dup.ID = api.VolumeID(snapName)
+	err = e.CreateVol(&dup)
+	assert.Equal(t, ErrExist, err, "CreateVol with a duplicate name must fail")
+
+	v, err := e.GetVolByName(volName)
+	assert.NoError(t, err, "Failed in GetVolByName")
+	if v != nil {
+		assert.Equal(t, vol.ID, v.ID, "Invalid volume returned by GetVolByName")
+	}
+
+	// Renaming releases the old name.
+	vol.Locator.Name = "RenamedVolume"
+	err = e.UpdateVol(&vol)
+	assert.NoError(t, err, "Failed in UpdateVol")
+	_, err = e.GetVolByName(volName)
+	assert.Equal(t, ErrEnoEnt, err, "Old name must be released on rename")
+	err = e.CreateVol(&dup)
+	assert.NoError(t, err, "Failed to reuse a released name")
+
+	// Renaming to a name in use must fail.
+	vol.Locator.Name = volName
+	err = e.UpdateVol(&vol)
+	assert.Equal(t, ErrExist, err, "UpdateVol to a name in use must fail")
+
+	err = e.DeleteVol(dup.ID)
+	assert.NoError(t, err, "Failed in Delete")
+	_, err = e.GetVolByName(volName)
+	assert.Equal(t, ErrEnoEnt, err, "Name must be released on delete")
+	err = e.DeleteVol(vol.ID)
+	assert.NoError(t, err, "Failed in Delete")
+
+	// Names reserved by volumes whose record is not written yet are held
+	// until the reservation expires.
+	err = e.reserveName(volName, "creating", nameTTL)
+	assert.NoError(t, err, "Failed to reserve name")
+	err = e.CreateVol(&dup)
+	assert.Equal(t, ErrExist, err, "Names reserved by a create in progress must not be taken")
+	_, err = e.kvdb.Delete(e.nameKey(volName))
+	assert.NoError(t, err, "Failed to expire reservation")
+	err = e.CreateVol(&dup)
+	assert.NoError(t, err, "Failed to reuse an expired name")
+	err = e.DeleteVol(dup.ID)
+	assert.NoError(t, err, "Failed in Delete")
+}
+
+func TestIDAllocator(t *testing.T) {
+	ids := NewDefaultEnumerator("allocator_test", e.kvdb)
+	assert.NotEqual(t, ids.NewVolumeID(), ids.NewVolumeID(), "Volume IDs must be unique")
+
+	ids.SetIDAllocator(&testAllocator{})
+	assert.Equal(t, api.VolumeID("test-1"), ids.NewVolumeID(), "Custom allocator not used")
+}
+
 func init() {
 	kv, err := kvdb.New(mem.Name, "driver_test", []string{}, nil)
 	if err != nil {
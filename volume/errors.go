@@ -0,0 +1,72 @@
+package volume
+
+import (
+	"errors"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+// errorCodes maps the errors of this package to the codes reported by the
+// REST API.
+var errorCodes = []struct {
+	err  error
+	code api.ErrorCode
+}{
+	{ErrExist, api.ErrCodeExists},
+	{ErrDriverNotFound, api.ErrCodeDriverNotFound},
+	{ErrEnoEnt, api.ErrCodeNotFound},
+	{ErrEnomem, api.ErrCodeNoMemory},
+	{ErrEinval, api.ErrCodeInvalid},
+	{ErrVolDetached, api.ErrCodeVolDetached},
+	{ErrVolAttached, api.ErrCodeVolAttached},
+	{ErrVolHasSnaps, api.ErrCodeVolHasSnaps},
+	{ErrVolShrink, api.ErrCodeVolShrink},
+	{ErrVolMounted, api.ErrCodeVolMounted},
+	{ErrNotSnapshot, api.ErrCodeNotSnapshot},
+	{ErrVolBounds, api.ErrCodeVolBounds},
+	{ErrNoSpace, api.ErrCodeNoSpace},
+	{ErrNotSupported, api.ErrCodeNotSupported},
+}
+
+// ErrorCode returns the code of err, which may wrap an error of this
+// package or an ErrorResponse, or ErrCodeUnknown.
+func ErrorCode(err error) api.ErrorCode {
+	var resp *api.ErrorResponse
+	if errors.As(err, &resp) {
+		return resp.Code
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return api.ErrCodeUnknown
+}
+
+// responseError is an error of this package reported with a different
+// message.
+type responseError struct {
+	*api.ErrorResponse
+	err error
+}
+
+func (e *responseError) Unwrap() error {
+	return e.err
+}
+
+// ResponseError returns the error reported by resp. The errors of this
+// package are returned as is, so that they compare equal to the error
+// returned by the driver, or wrapped if the driver added to the message.
+// Responses with other codes are returned as errors.
+func ResponseError(resp *api.ErrorResponse) error {
+	for _, e := range errorCodes {
+		if e.code != resp.Code {
+			continue
+		}
+		if resp.Message == e.err.Error() {
+			return e.err
+		}
+		return &responseError{ErrorResponse: resp, err: e.err}
+	}
+	return resp
+}
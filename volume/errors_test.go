@@ -0,0 +1,27 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, e := range errorCodes {
+		resp := &api.ErrorResponse{Code: ErrorCode(e.err), Message: e.err.Error()}
+		assert.Equal(t, e.err, ResponseError(resp), "Error %v must be decoded as is", e.err)
+	}
+
+	wrapped := fmt.Errorf("%w: no such snapshot", ErrEnoEnt)
+	assert.Equal(t, api.ErrCodeNotFound, ErrorCode(wrapped))
+	err := ResponseError(&api.ErrorResponse{Code: ErrorCode(wrapped), Message: wrapped.Error()})
+	assert.True(t, errors.Is(err, ErrEnoEnt), "Wrapped errors must be decoded")
+	assert.Equal(t, wrapped.Error(), err.Error())
+
+	assert.Equal(t, api.ErrCodeUnknown, ErrorCode(errors.New("failed")))
+	resp := &api.ErrorResponse{Code: api.ErrCodeUnknown, Message: "failed", Retryable: true}
+	assert.Equal(t, resp, ResponseError(resp))
+}
@@ -0,0 +1,15 @@
+package volume
+
+import "github.com/libopenstorage/openstorage/api"
+
+// CheckIO verifies that an IODriver request of sz bytes at offset fits in
+// buf and lies within the volume v.
+func CheckIO(v *api.Volume, buf []byte, sz uint64, offset int64) error {
+	if sz > uint64(len(buf)) || offset < 0 {
+		return ErrEinval
+	}
+	if v.Spec == nil || uint64(offset)+sz > v.Spec.Size {
+		return ErrVolBounds
+	}
+	return nil
+}
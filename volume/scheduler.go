@@ -0,0 +1,199 @@
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/portworx/kvdb"
+)
+
+const (
+	snapLockKey = "snapshot/lock/"
+	// snapLockTTL seconds a node may hold the lock on a volume while it
+	// takes a snapshot.
+	snapLockTTL = 300
+	// SnapSchedulePeriod how often the scheduler checks for due snapshots.
+	SnapSchedulePeriod = time.Minute
+)
+
+// SnapScheduler periodically snapshots volumes with a non-zero
+// VolumeSpec.SnapshotInterval and prunes scheduled snapshots beyond the
+// retention count in the volume's ConfigLabels. Volumes are locked in the
+// KV store so that only one node in a cluster takes each snapshot.
+type SnapScheduler struct {
+	sync.Mutex
+	kv      kvdb.Kvdb
+	period  time.Duration
+	stop    chan struct{}
+	running bool
+}
+
+// NewSnapScheduler returns a scheduler that checks for due snapshots every
+// period.
+func NewSnapScheduler(kv kvdb.Kvdb, period time.Duration) *SnapScheduler {
+	return &SnapScheduler{
+		kv:     kv,
+		period: period,
+	}
+}
+
+// Start the scheduler.
+func (s *SnapScheduler) Start() {
+	s.Lock()
+	defer s.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	go s.loop(s.stop)
+}
+
+// Stop the scheduler.
+func (s *SnapScheduler) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.running {
+		return
+	}
+	close(s.stop)
+	s.running = false
+}
+
+func (s *SnapScheduler) loop(stop chan struct{}) {
+	ticker := time.NewTicker(s.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.Run(now)
+		}
+	}
+}
+
+// Run takes all snapshots that are due at time now.
+func (s *SnapScheduler) Run(now time.Time) {
+	for _, d := range Instances() {
+		vols, err := d.Enumerate(api.VolumeLocator{}, nil)
+		if err != nil {
+			logrus.Warnf("Snapshot scheduler failed to enumerate %v volumes: %v", d, err)
+			continue
+		}
+		for i := range vols {
+			v := &vols[i]
+			if v.Spec == nil || v.Spec.SnapshotInterval <= 0 {
+				continue
+			}
+			// Snapshots inherit the spec of their parent, do not
+			// schedule snapshots of snapshots. Clones are volumes of
+			// their own and are scheduled.
+			if IsSnapshot(v) {
+				continue
+			}
+			if err := s.schedule(d, v, now); err != nil && err != ErrNotSupported {
+				logrus.Warnf("Scheduled snapshot of %v failed: %v", v.ID, err)
+			}
+		}
+	}
+}
+
+// schedule snapshots v if its interval has elapsed since the last scheduled
+// snapshot and prunes old snapshots.
+func (s *SnapScheduler) schedule(d VolumeDriver, v *api.Volume, now time.Time) error {
+	lock, err := s.kv.Lock(snapLockKey+string(v.ID), snapLockTTL)
+	if err != nil {
+		return err
+	}
+	defer s.kv.Unlock(lock)
+
+	// Another node may have taken the snapshot while we waited for the
+	// lock, so look for existing snapshots only once it is held.
+	snaps, err := scheduledSnaps(d, v.ID)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(v.Spec.SnapshotInterval) * time.Minute
+	if len(snaps) == 0 || now.Sub(snapCreated(&snaps[len(snaps)-1])) >= interval {
+		name := v.Locator.Name
+		if name == "" {
+			name = string(v.ID)
+		}
+		locator := api.VolumeLocator{
+			Name: fmt.Sprintf("%s.snap.%s", name, now.UTC().Format("20060102150405")),
+			VolumeLabels: api.Labels{
+				api.SnapScheduleLabel: strconv.Itoa(v.Spec.SnapshotInterval),
+				api.SnapCreatedLabel:  now.UTC().Format(time.RFC3339),
+			},
+		}
+		snapID, err := d.Snapshot(v.ID, true, locator)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Scheduled snapshot %v of volume %v", snapID, v.ID)
+		if snaps, err = scheduledSnaps(d, v.ID); err != nil {
+			return err
+		}
+	}
+	return prune(d, v, snaps)
+}
+
+// scheduledSnaps returns the scheduled snapshots of volumeID, oldest first.
+func scheduledSnaps(d VolumeDriver, volumeID api.VolumeID) ([]api.Volume, error) {
+	snaps, err := d.SnapEnumerate([]api.VolumeID{volumeID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make([]api.Volume, 0, len(snaps))
+	for _, snap := range snaps {
+		if _, ok := snap.Locator.VolumeLabels[api.SnapScheduleLabel]; ok {
+			scheduled = append(scheduled, snap)
+		}
+	}
+	sort.Sort(byCreated(scheduled))
+	return scheduled, nil
+}
+
+// prune deletes the oldest scheduled snapshots of v beyond its retention
+// count.
+func prune(d VolumeDriver, v *api.Volume, snaps []api.Volume) error {
+	retain, ok := v.Spec.ConfigLabels[api.SpecSnapshotRetain]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(retain)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid %v %q", api.SpecSnapshotRetain, retain)
+	}
+	if n == 0 {
+		return nil
+	}
+	for i := 0; i < len(snaps)-n; i++ {
+		logrus.Infof("Pruning scheduled snapshot %v of volume %v", snaps[i].ID, v.ID)
+		if err := d.Delete(snaps[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapCreated returns the time a scheduled snapshot was taken.
+func snapCreated(v *api.Volume) time.Time {
+	t, err := time.Parse(time.RFC3339, v.Locator.VolumeLabels[api.SnapCreatedLabel])
+	if err != nil {
+		return v.Ctime
+	}
+	return t
+}
+
+type byCreated []api.Volume
+
+func (v byCreated) Len() int           { return len(v) }
+func (v byCreated) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byCreated) Less(i, j int) bool { return snapCreated(&v[i]).Before(snapCreated(&v[j])) }
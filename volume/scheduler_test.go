@@ -0,0 +1,126 @@
+package volume
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/stretchr/testify/assert"
+)
+
+const snapDriverName = "scheduler_test"
+
+// snapDriver is a minimal driver that records snapshots in the enumerator.
+type snapDriver struct {
+	*IoNotSupported
+	*DefaultBlockDriver
+	*DefaultEnumerator
+	*RestoreNotSupported
+	*CapacityNotSupported
+	next int
+}
+
+func (d *snapDriver) String() string       { return snapDriverName }
+func (d *snapDriver) Type() api.DriverType { return api.File }
+func (d *snapDriver) Status() [][2]string  { return nil }
+func (d *snapDriver) Shutdown()            {}
+
+func (d *snapDriver) Create(locator api.VolumeLocator, source *api.Source, spec *api.VolumeSpec) (api.VolumeID, error) {
+	d.next++
+	v := &api.Volume{
+		ID:      api.VolumeID(fmt.Sprintf("vol-%d", d.next)),
+		Locator: locator,
+		Source:  source,
+		Spec:    spec,
+		Ctime:   time.Now(),
+	}
+	return v.ID, d.CreateVol(v)
+}
+
+func (d *snapDriver) Delete(volumeID api.VolumeID) error {
+	return d.DeleteVol(volumeID)
+}
+
+func (d *snapDriver) Mount(volumeID api.VolumeID, mountpath string) error {
+	return nil
+}
+
+func (d *snapDriver) Unmount(volumeID api.VolumeID, mountpath string) error {
+	return nil
+}
+
+func (d *snapDriver) Set(volumeID api.VolumeID, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	return ErrNotSupported
+}
+
+func (d *snapDriver) Snapshot(volumeID api.VolumeID, readonly bool, locator api.VolumeLocator) (api.VolumeID, error) {
+	v, err := d.GetVol(volumeID)
+	if err != nil {
+		return api.BadVolumeID, err
+	}
+	return d.Create(locator, &api.Source{Parent: volumeID}, v.Spec)
+}
+
+func (d *snapDriver) Stats(volumeID api.VolumeID) (api.Stats, error) {
+	return api.Stats{}, ErrNotSupported
+}
+
+func (d *snapDriver) Alerts(volumeID api.VolumeID) (api.Alerts, error) {
+	return api.Alerts{}, ErrNotSupported
+}
+
+func TestSnapScheduler(t *testing.T) {
+	Register(snapDriverName, func(params DriverParams) (VolumeDriver, error) {
+		return &snapDriver{
+			IoNotSupported:    &IoNotSupported{},
+			DefaultEnumerator: NewDefaultEnumerator(snapDriverName, e.kvdb),
+		}, nil
+	})
+	d, err := New(snapDriverName, DriverParams{})
+	if err != nil {
+		t.Fatalf("Failed to initialize driver: %v", err)
+	}
+
+	spec := &api.VolumeSpec{
+		SnapshotInterval: 10,
+		ConfigLabels:     api.Labels{api.SpecSnapshotRetain: "2"},
+	}
+	id, err := d.Create(api.VolumeLocator{Name: "scheduled"}, nil, spec)
+	assert.NoError(t, err, "Failed in Create")
+	_, err = d.Create(api.VolumeLocator{Name: "unscheduled"}, nil, &api.VolumeSpec{})
+	assert.NoError(t, err, "Failed in Create")
+	cloneID, err := d.Create(api.VolumeLocator{Name: "clone"}, CloneSource(&api.Source{Parent: id}), spec)
+	assert.NoError(t, err, "Failed in Create")
+
+	s := NewSnapScheduler(e.kvdb, SnapSchedulePeriod)
+	start := time.Now()
+
+	s.Run(start)
+	snaps, err := scheduledSnaps(d, id)
+	assert.NoError(t, err, "Failed in SnapEnumerate")
+	assert.Equal(t, 1, len(snaps), "Expected a snapshot on the first run")
+
+	// Interval has not elapsed.
+	s.Run(start.Add(5 * time.Minute))
+	snaps, _ = scheduledSnaps(d, id)
+	assert.Equal(t, 1, len(snaps), "Snapshot taken before interval elapsed")
+
+	for i := 1; i <= 3; i++ {
+		s.Run(start.Add(time.Duration(i*10) * time.Minute))
+	}
+	snaps, _ = scheduledSnaps(d, id)
+	assert.Equal(t, 2, len(snaps), "Expected snapshots to be pruned to the retention count")
+	if len(snaps) == 2 {
+		assert.Equal(t, start.Add(30*time.Minute).UTC().Format(time.RFC3339),
+			snaps[1].Locator.VolumeLabels[api.SnapCreatedLabel])
+		assert.Equal(t, "10", snaps[1].Locator.VolumeLabels[api.SnapScheduleLabel])
+	}
+
+	snaps, _ = scheduledSnaps(d, cloneID)
+	assert.Equal(t, 2, len(snaps), "Clones must be scheduled like other volumes")
+
+	all, err := d.SnapEnumerate(nil, nil)
+	assert.NoError(t, err, "Failed in SnapEnumerate")
+	assert.Equal(t, 4, len(all), "Only the scheduled volumes should have snapshots")
+}
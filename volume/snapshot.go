@@ -8,3 +8,55 @@ type SnapshotNotSupported struct {
 func (s *SnapshotNotSupported) Snapshot(volumeID api.VolumeID, readonly bool, locator api.VolumeLocator) (api.VolumeID, error) {
 	return api.BadVolumeID, ErrNotSupported
 }
+
+type RestoreNotSupported struct {
+}
+
+func (s *RestoreNotSupported) Restore(volumeID api.VolumeID, snapID api.VolumeID) error {
+	return ErrNotSupported
+}
+
+// CheckRestore verifies that snap is a snapshot of v and that v is not
+// mounted, so that it may be restored.
+func CheckRestore(v *api.Volume, snap *api.Volume) error {
+	if !IsSnapshot(snap) || snap.Source.Parent != v.ID {
+		return ErrNotSnapshot
+	}
+	if v.AttachPath != "" {
+		return ErrVolMounted
+	}
+	return nil
+}
+
+// IsSnapshot returns true if v is a snapshot of another volume, as opposed
+// to a clone of it or a volume of its own.
+func IsSnapshot(v *api.Volume) bool {
+	return v.Source != nil && v.Source.Parent != api.BadVolumeID && !v.Source.Clone
+}
+
+// CloneSource returns the source to record for a volume created from
+// source. Volumes created from a parent are marked as clones, so that they
+// are not taken for its snapshots.
+func CloneSource(source *api.Source) *api.Source {
+	if source == nil || source.Parent == api.BadVolumeID {
+		return source
+	}
+	clone := *source
+	clone.Clone = true
+	return &clone
+}
+
+// CloneSpec fills in the size and format of a clone's spec that were left
+// unset from its parent. A clone may not be smaller than its parent.
+func CloneSpec(parent *api.Volume, spec *api.VolumeSpec) error {
+	if spec.Size == 0 {
+		spec.Size = parent.Spec.Size
+	}
+	if spec.Size < parent.Spec.Size {
+		return ErrVolShrink
+	}
+	if spec.Format == "" {
+		spec.Format = parent.Spec.Format
+	}
+	return nil
+}
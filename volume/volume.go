@@ -11,7 +11,7 @@ var (
 	instances         map[string]VolumeDriver
 	drivers           map[string]InitFunc
 	mutex             sync.Mutex
-	ErrExist          = errors.New("Driver already exists")
+	ErrExist          = errors.New("Already exists")
 	ErrDriverNotFound = errors.New("Driver implementation not found")
 	ErrEnoEnt         = errors.New("Volume does not exist.")
 	ErrEnomem         = errors.New("Out of memory.")
@@ -19,6 +19,11 @@ var (
 	ErrVolDetached    = errors.New("Volume is detached")
 	ErrVolAttached    = errors.New("Volume is attached")
 	ErrVolHasSnaps    = errors.New("Volume has snapshots associated")
+	ErrVolShrink      = errors.New("Volume size cannot be reduced")
+	ErrVolMounted     = errors.New("Volume is mounted")
+	ErrNotSnapshot    = errors.New("Not a snapshot of the volume")
+	ErrVolBounds      = errors.New("I/O beyond the end of the volume")
+	ErrNoSpace        = errors.New("Not enough space in the storage pool")
 	ErrNotSupported   = errors.New("Operation not supported")
 )
 
@@ -36,6 +41,7 @@ type VolumeDriver interface {
 }
 
 // IODriver interfaces applicable to object store interfaces.
+// Errors ErrEnoEnt, ErrEinval, ErrVolBounds may be returned.
 type IODriver interface {
 	// Read sz bytes from specified volume at specified offset.
 	// Return number of bytes read and error.
@@ -67,6 +73,7 @@ type ProtoDriver interface {
 
 	// Create a new Vol for the specific volume spec.
 	// It returns a system generated VolumeID that uniquely identifies the volume
+	// Errors ErrNoSpace may be returned.
 	Create(locator api.VolumeLocator,
 		Source *api.Source,
 		spec *api.VolumeSpec) (api.VolumeID, error)
@@ -91,10 +98,18 @@ type ProtoDriver interface {
 	// Errors ErrEnoEnt may be returned
 	Snapshot(volumeID api.VolumeID, readonly bool, locator api.VolumeLocator) (api.VolumeID, error)
 
+	// Restore rolls back volumeID to the contents of its snapshot snapID.
+	// Errors ErrEnoEnt, ErrNotSnapshot, ErrVolMounted may be returned.
+	Restore(volumeID api.VolumeID, snapID api.VolumeID) error
+
 	// Stats for specified volume.
 	// Errors ErrEnoEnt may be returned
 	Stats(volumeID api.VolumeID) (api.Stats, error)
 
+	// Capacity of the storage pool backing the volumes of this driver.
+	// Errors ErrNotSupported may be returned.
+	Capacity() (api.Capacity, error)
+
 	// Alerts on this volume.
 	// Errors ErrEnoEnt may be returned
 	Alerts(volumeID api.VolumeID) (api.Alerts, error)
@@ -149,6 +164,17 @@ func Get(name string) (VolumeDriver, error) {
 	return nil, ErrDriverNotFound
 }
 
+// Instances returns all volume drivers that have been started.
+func Instances() []VolumeDriver {
+	mutex.Lock()
+	defer mutex.Unlock()
+	d := make([]VolumeDriver, 0, len(instances))
+	for _, v := range instances {
+		d = append(d, v)
+	}
+	return d
+}
+
 func New(name string, params DriverParams) (VolumeDriver, error) {
 	mutex.Lock()
 	defer mutex.Unlock()